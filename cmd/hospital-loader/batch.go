@@ -29,25 +29,62 @@ var batchCmd = &cobra.Command{
 
 Each line in the JSONL file should have "mrf-url" and "location-name" fields.
 
+Entries are grouped by the host of their URL: different hosts are processed
+in parallel, while --host-parallel and --host-interval keep any single host
+(often a shared health-system CDN) from being hit by every worker at once.
+
+With --layout hive, files go under state=XX/updated=YYYY-MM-DD/ in --out-dir,
+so the whole run can be queried with one glob and partition pruning, e.g.
+read_parquet('s3://bucket/run/state=*/*/*.parquet', hive_partitioning=true).
+
+When the run finishes, _manifest.json and a _manifest.parquet index listing
+every output file (hospital, rows, bytes, code ranges, location) are written
+to --out-dir.
+
+With --output-format duckdb, every hospital is appended to one database,
+charges.duckdb in --out-dir, which must be local. With --output-format
+postgres, --out-dir is a postgres:// URL and each hospital's rows replace
+those of its previous load.
+
 Examples:
   hospital-loader batch --input cms-hpt.jsonl
-  hospital-loader batch --input cms-hpt.jsonl --limit 5 --out-dir output/`,
+  hospital-loader batch --input cms-hpt.jsonl --limit 5 --out-dir output/
+  hospital-loader batch --input cms-hpt.jsonl --parallel 16 --host-parallel 1 --host-interval 10s
+  hospital-loader batch --input cms-hpt.jsonl --layout hive --out-dir s3://hospital-mrf/dataset/
+  hospital-loader batch --input cms-hpt.jsonl --output-format duckdb --out-dir data/
+  hospital-loader batch --input cms-hpt.jsonl --output-format postgres --out-dir postgres://loader@db/prices`,
 	Run: func(cmd *cobra.Command, args []string) {
 		input, _ := cmd.Flags().GetString("input")
 		limit, _ := cmd.Flags().GetInt("limit")
 		outDir, _ := cmd.Flags().GetString("out-dir")
 		logPath, _ := cmd.Flags().GetString("log")
-		batch, _ := cmd.Flags().GetInt("batch")
-		skipPayer, _ := cmd.Flags().GetBool("skip-payer-charges")
 		parallel, _ := cmd.Flags().GetInt("parallel")
+		hostParallel, _ := cmd.Flags().GetInt("host-parallel")
+		hostInterval, _ := cmd.Flags().GetDuration("host-interval")
+		opts, err := processOptions(cmd)
+		if err != nil {
+			slog.Error("invalid options", "error", err)
+			os.Exit(1)
+		}
+
+		if opts.OutputFormat == internal.FormatDuckDB && strings.HasPrefix(outDir, "s3://") {
+			slog.Error("--output-format duckdb needs a local --out-dir", "out_dir", outDir)
+			os.Exit(1)
+		}
+		isPostgres := opts.OutputFormat == internal.FormatPostgres
+		if isPostgres && !strings.HasPrefix(outDir, "postgres://") && !strings.HasPrefix(outDir, "postgresql://") {
+			slog.Error("--output-format postgres needs a postgres:// --out-dir", "out_dir", outDir)
+			os.Exit(1)
+		}
 
+		runStart := time.Now()
 		entries, err := readJSONL(input, limit)
 		if err != nil {
 			slog.Error("failed to read input", "file", input, "error", err)
 			os.Exit(1)
 		}
 
-		if !strings.HasPrefix(outDir, "s3://") {
+		if !strings.HasPrefix(outDir, "s3://") && !isPostgres {
 			if err := os.MkdirAll(outDir, 0755); err != nil {
 				slog.Error("failed to create output directory", "error", err)
 				os.Exit(1)
@@ -80,54 +117,47 @@ Examples:
 			"entries", len(unique),
 			"duplicates_removed", duplicates,
 			"input", input,
-			"out_dir", outDir,
+			"out_dir", internal.RedactURL(outDir),
 			"log_file", logPath,
-			"parallel", parallel)
+			"parallel", parallel,
+			"host_parallel", hostParallel,
+			"host_interval", hostInterval.String())
 
 		var succeeded, failed atomic.Int64
 
-		if parallel <= 1 {
-			// Sequential processing.
-			for i, entry := range unique {
-				logger := internal.EntryLogger(i+1, len(unique))
-				ok := processBatchEntry(logger, entry, outDir, logPath, batch, skipPayer)
-				if ok {
-					succeeded.Add(1)
-				} else {
-					failed.Add(1)
-				}
-			}
-		} else {
-			// Parallel processing with worker pool.
-			type work struct {
-				entry jsonlEntry
-				index int
-			}
-			ch := make(chan work)
-			var wg sync.WaitGroup
-
-			for range parallel {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					for w := range ch {
-						logger := internal.EntryLogger(w.index+1, len(unique))
-						ok := processBatchEntry(logger, w.entry, outDir, logPath, batch, skipPayer)
-						if ok {
-							succeeded.Add(1)
-						} else {
-							failed.Add(1)
-						}
+		// Workers take entries from a scheduler that throttles each host
+		// while letting distinct hosts run in parallel.
+		urls := make([]string, len(unique))
+		for i, entry := range unique {
+			urls[i] = entry.MRFUrl
+		}
+		sched := internal.NewHostScheduler(urls, hostParallel, hostInterval)
+		var wg sync.WaitGroup
+		for range max(parallel, 1) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					i, ok := sched.Next()
+					if !ok {
+						return
 					}
-				}()
-			}
-
-			for i, entry := range unique {
-				ch <- work{entry: entry, index: i}
-			}
-			close(ch)
-			wg.Wait()
+					logger := internal.EntryLogger(i+1, len(unique))
+					// The host is free once the file is downloaded; the
+					// conversion doesn't need it.
+					release := sync.OnceFunc(func() { sched.Done(i) })
+					entryOpts := opts
+					entryOpts.DownloadDone = release
+					if processBatchEntry(logger, unique[i], outDir, logPath, entryOpts) {
+						succeeded.Add(1)
+					} else {
+						failed.Add(1)
+					}
+					release()
+				}
+			}()
 		}
+		wg.Wait()
 
 		s, f := succeeded.Load(), failed.Load()
 		slog.Info("batch done",
@@ -139,6 +169,11 @@ Examples:
 		if err := internal.GeocodeLogFile(logPath); err != nil {
 			slog.Warn("geocoding failed", "error", err)
 		}
+		if opts.OutputFormat == internal.FormatParquet {
+			if _, err := internal.WriteManifest(slog.Default(), logPath, outDir, runStart, opts.S3Region); err != nil {
+				slog.Warn("failed to write manifest", "error", err)
+			}
+		}
 	},
 }
 
@@ -149,17 +184,18 @@ func init() {
 	batchCmd.Flags().String("out-dir", defaultOutDir, "Output directory for Parquet files")
 	defaultLog := fmt.Sprintf("hospital-loader-log-%s.jsonl", time.Now().Format("20060102-150405"))
 	batchCmd.Flags().String("log", defaultLog, "JSONL log file path")
-	batchCmd.Flags().Int("batch", 10000, "Batch size for Parquet writes")
-	batchCmd.Flags().Bool("skip-payer-charges", true, "Skip payer-specific negotiated rates")
 	defaultParallel := runtime.NumCPU() - 1
 	if defaultParallel < 1 {
 		defaultParallel = 1
 	}
 	batchCmd.Flags().Int("parallel", defaultParallel, "Number of parallel workers")
+	batchCmd.Flags().Int("host-parallel", 2, "Max entries downloading from the same host at once (0 = no limit)")
+	batchCmd.Flags().Duration("host-interval", 2*time.Second, "Minimum wait between starting entries on the same host")
+	addProcessFlags(batchCmd)
 }
 
 // processBatchEntry processes a single entry and prints status. Returns true on success.
-func processBatchEntry(logger *slog.Logger, entry jsonlEntry, outDir, logPath string, batchSize int, skipPayer bool) bool {
+func processBatchEntry(logger *slog.Logger, entry jsonlEntry, outDir, logPath string, opts internal.ProcessOptions) bool {
 	hospitalName := entry.LocationName
 	if hospitalName == "" {
 		hospitalName = "unknown"
@@ -177,7 +213,7 @@ func processBatchEntry(logger *slog.Logger, entry jsonlEntry, outDir, logPath st
 	// the filename from hospital metadata.
 	outPath := ensureTrailingSlash(outDir)
 
-	err := internal.ProcessEntry(logger, url, outPath, logPath, batchSize, skipPayer, hospitalName)
+	err := internal.ProcessEntry(logger, url, outPath, logPath, hospitalName, opts)
 	if err == nil {
 		logger.Info("completed", "hospitalName", hospitalName)
 		return true
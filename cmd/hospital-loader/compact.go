@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"pricetool/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var compactCmd = &cobra.Command{
+	Use:   "compact [flags] <file|dir|s3://prefix>...",
+	Short: "Merge many per-hospital Parquet files into fewer, larger ones",
+	Long: `Read existing output Parquet files and rewrite them into fewer, larger files,
+re-sorted across hospitals by --sort, with the usual bloom filters and page
+statistics. Fewer files means fewer footer reads when querying over S3.
+
+Inputs are files, directories or s3:// prefixes; directories and prefixes are
+searched for .parquet files, skipping manifests and normalized table files.
+Outputs are named compacted-<timestamp>-NNNN.parquet in --out-dir. Each output
+is sorted in memory (roughly 1KB per row), so --target-rows bounds memory use.
+Row counts come from the input footers; each output's inputs are downloaded
+only when it is written.
+
+If --out-dir has a _manifest.json, the outputs are added to it and its
+_manifest.parquet. With --delete-inputs, the manifests of the runs the inputs
+came from are rewritten without them, or deleted once empty. A run
+written with --layout hive can't be compacted into its own root, where the
+outputs would be missed by state=*/*/*.parquet globs.
+
+Examples:
+  hospital-loader compact --out-dir compacted/ output/
+  hospital-loader compact --out-dir s3://hospital-mrf/compacted/ s3://hospital-mrf/20260201-120000/
+  hospital-loader compact --out-dir s3://hospital-mrf/run/ --delete-inputs --sort "zorder(cpt_code,ms_drg_code)" s3://hospital-mrf/run/`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := internal.CompactOptions{Inputs: args}
+		opts.OutDir, _ = cmd.Flags().GetString("out-dir")
+		opts.TargetRows, _ = cmd.Flags().GetInt64("target-rows")
+		opts.DeleteInputs, _ = cmd.Flags().GetBool("delete-inputs")
+		opts.S3Region, _ = cmd.Flags().GetString("s3-region")
+		var err error
+		if opts.Writer, opts.SortOrder, err = writerOptions(cmd); err != nil {
+			slog.Error("invalid options", "error", err)
+			os.Exit(1)
+		}
+		if opts.OutDir == "" {
+			slog.Error("--out-dir is required")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		outputs, err := internal.Compact(slog.Default(), opts)
+		if err != nil {
+			slog.Error("compaction failed", "error", err, "written", len(outputs))
+			os.Exit(1)
+		}
+		slog.Info("compaction done", "outputs", len(outputs))
+	},
+}
+
+func init() {
+	compactCmd.Flags().String("out-dir", "", "Local directory or s3:// prefix for the compacted files (required)")
+	compactCmd.Flags().Int64("target-rows", internal.DefaultCompactRows, "Approximate rows per output file; inputs are never split")
+	compactCmd.Flags().Bool("delete-inputs", false, "Delete the input files once all outputs are written")
+	compactCmd.Flags().String("s3-region", "", "AWS region for S3 access (default: AWS SDK resolution)")
+	addWriterFlags(compactCmd)
+}
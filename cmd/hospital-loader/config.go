@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to setting names for environment overrides:
+// HOSPITAL_LOADER_OUT_DIR overrides --out-dir, HOSPITAL_LOADER_BATCH_PARALLEL
+// overrides --parallel for the batch subcommand only.
+const envPrefix = "HOSPITAL_LOADER_"
+
+// Settings are layered lowest to highest: flag default, config file,
+// environment variable, explicit command-line flag. Keys are normalized to
+// flag names ("out_dir" and "out-dir" are the same key), and nested tables
+// are joined with "-", so this YAML:
+//
+//	parallel: 8
+//	download:
+//	  max_eta: 1h
+//	batch:
+//	  out_dir: s3://hospital-mrf/nightly/
+//
+// sets --parallel for every subcommand that has it, --download-max-eta
+// likewise, and --out-dir for batch only.
+//
+// A flag named like a subcommand would collide with that subcommand's table,
+// so it is configured under another key (see flagSettingKeys).
+var (
+	configPath string
+	fileConfig map[string]string
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect hospital-loader configuration",
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the effective configuration of every subcommand",
+	Long: `Print the effective value of every setting for each subcommand after
+layering the config file and HOSPITAL_LOADER_* environment variables over the
+flag defaults. Each value is annotated with where it came from.
+
+Examples:
+  hospital-loader config print
+  hospital-loader --config loader.yaml config print`,
+	Run: func(cmd *cobra.Command, args []string) {
+		printEffectiveConfig(os.Stdout)
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configPrintCmd)
+}
+
+// initConfig loads the config file named by --config (or HOSPITAL_LOADER_CONFIG)
+// and applies file and environment settings to every flag of cmd that was
+// not set explicitly on the command line.
+func initConfig(cmd *cobra.Command) error {
+	path, _ := cmd.Flags().GetString("config")
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if path != "" {
+		cfg, err := loadConfigFile(path)
+		if err == nil {
+			err = checkCommandTables(cfg)
+		}
+		if err != nil {
+			return fmt.Errorf("load config %s: %w", path, err)
+		}
+		configPath = path
+		fileConfig = cfg
+		warnUnknownSettings()
+	}
+	return applySettings(cmd)
+}
+
+// loadConfigFile parses a YAML or TOML file (chosen by extension) into a flat
+// map of normalized setting names to string values.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		if err := toml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("parse TOML: %w", err)
+		}
+	case ".yaml", ".yml", "":
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("parse YAML: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q (want .yaml, .yml or .toml)", filepath.Ext(path))
+	}
+
+	out := make(map[string]string)
+	flattenConfig("", raw, out)
+	return out, nil
+}
+
+// flattenConfig walks nested tables, joining keys with "-".
+func flattenConfig(prefix string, m map[string]any, out map[string]string) {
+	for k, v := range m {
+		key := settingKey(k)
+		if prefix != "" {
+			key = prefix + "-" + key
+		}
+		switch val := v.(type) {
+		case map[string]any:
+			flattenConfig(key, val, out)
+		case []any:
+			parts := make([]string, len(val))
+			for i, p := range val {
+				parts[i] = fmt.Sprint(p)
+			}
+			out[key] = strings.Join(parts, ",")
+		case nil:
+			// Explicit null: leave the flag default in place.
+		default:
+			out[key] = fmt.Sprint(val)
+		}
+	}
+}
+
+// settingKey normalizes a config key or environment suffix to flag-name form.
+func settingKey(k string) string {
+	k = strings.ToLower(strings.TrimSpace(k))
+	return strings.NewReplacer("_", "-", ".", "-").Replace(k)
+}
+
+// flagSettingKeys renames the config keys of flags whose names are taken by
+// a subcommand's table: --batch (the batch size) is set with batch_size.
+var flagSettingKeys = map[string]string{
+	"batch": "batch-size",
+}
+
+// flagKey returns the setting key of a flag.
+func flagKey(name string) string {
+	if key, ok := flagSettingKeys[name]; ok {
+		return key
+	}
+	return settingKey(name)
+}
+
+// checkCommandTables rejects a config file that gives a subcommand's table
+// name a plain value, such as "batch: 500".
+func checkCommandTables(cfg map[string]string) error {
+	for _, c := range settingCommands() {
+		if _, ok := cfg[c.Name()]; !ok {
+			continue
+		}
+		msg := fmt.Sprintf("%s is the table of %s settings, not a value", c.Name(), c.Name())
+		if key, ok := flagSettingKeys[c.Name()]; ok {
+			msg += fmt.Sprintf(" (set --%s with %s)", c.Name(), strings.ReplaceAll(key, "-", "_"))
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// envName returns the environment variable that overrides a setting key.
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// lookupSetting resolves a flag of the named subcommand from the environment
+// or config file. Command-scoped keys ("batch-parallel") win over global ones
+// ("parallel"), and environment variables win over the config file.
+func lookupSetting(cmdName, flagName string) (value, source string, ok bool) {
+	flagName = flagKey(flagName)
+	keys := []string{cmdName + "-" + flagName, flagName}
+	for _, key := range keys {
+		if v, found := os.LookupEnv(envName(key)); found {
+			return v, "env " + envName(key), true
+		}
+	}
+	for _, key := range keys {
+		if v, found := fileConfig[key]; found {
+			return v, "config " + configPath, true
+		}
+	}
+	return "", "", false
+}
+
+// applySettings sets every flag of cmd that wasn't given on the command line
+// from the environment or config file.
+func applySettings(cmd *cobra.Command) error {
+	var firstErr error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if firstErr != nil || f.Changed || skipSetting(f.Name) {
+			return
+		}
+		v, source, ok := lookupSetting(cmd.Name(), f.Name)
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(v); err != nil {
+			firstErr = fmt.Errorf("invalid %s from %s: %w", f.Name, source, err)
+		}
+	})
+	return firstErr
+}
+
+// skipSetting reports whether a flag is excluded from file/env layering.
+func skipSetting(name string) bool {
+	return name == "config" || name == "help"
+}
+
+// settingCommands returns the subcommands whose flags can be configured.
+func settingCommands() []*cobra.Command {
+	var cmds []*cobra.Command
+	for _, c := range rootCmd.Commands() {
+		if c.HasLocalFlags() && c != configCmd {
+			cmds = append(cmds, c)
+		}
+	}
+	return cmds
+}
+
+// warnUnknownSettings logs config keys that don't match any flag, which
+// usually means a typo.
+func warnUnknownSettings() {
+	known := make(map[string]bool)
+	for _, c := range settingCommands() {
+		c.LocalFlags().VisitAll(func(f *pflag.Flag) {
+			known[flagKey(f.Name)] = true
+			known[c.Name()+"-"+flagKey(f.Name)] = true
+		})
+	}
+	for key := range fileConfig {
+		if !known[key] {
+			slog.Warn("unknown config key", "key", key, "file", configPath)
+		}
+	}
+}
+
+// printEffectiveConfig writes the resolved settings of each subcommand as
+// YAML, with the source of each value in a trailing comment.
+func printEffectiveConfig(w io.Writer) {
+	if configPath != "" {
+		fmt.Fprintf(w, "# config file: %s\n", configPath)
+	} else {
+		fmt.Fprintln(w, "# config file: none")
+	}
+	for _, c := range settingCommands() {
+		fmt.Fprintf(w, "%s:\n", c.Name())
+		var lines [][3]string
+		c.LocalFlags().VisitAll(func(f *pflag.Flag) {
+			if skipSetting(f.Name) {
+				return
+			}
+			value, source, ok := lookupSetting(c.Name(), f.Name)
+			if !ok {
+				value, source = f.DefValue, "default"
+			}
+			if f.Value.Type() == "string" {
+				value = strconv.Quote(value)
+			}
+			lines = append(lines, [3]string{strings.ReplaceAll(flagKey(f.Name), "-", "_"), value, source})
+		})
+		sort.Slice(lines, func(i, j int) bool { return lines[i][0] < lines[j][0] })
+		for _, l := range lines {
+			fmt.Fprintf(w, "  %s: %s  # %s\n", l[0], l[1], l[2])
+		}
+	}
+}
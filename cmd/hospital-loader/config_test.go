@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestApplySettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     map[string]string // flattened config file
+		env      map[string]string
+		explicit string // --out-dir given on the command line
+		want     string
+		source   string
+	}{
+		{name: "flag default", want: "output", source: ""},
+		{
+			name: "config file",
+			file: map[string]string{"out-dir": "file/"},
+			want: "file/", source: "config loader.yaml",
+		},
+		{
+			name: "command key beats global in file",
+			file: map[string]string{"out-dir": "file/", "batch-out-dir": "batch-file/"},
+			want: "batch-file/", source: "config loader.yaml",
+		},
+		{
+			name: "env beats file",
+			file: map[string]string{"batch-out-dir": "batch-file/"},
+			env:  map[string]string{"HOSPITAL_LOADER_OUT_DIR": "env/"},
+			want: "env/", source: "env HOSPITAL_LOADER_OUT_DIR",
+		},
+		{
+			name: "command env beats global env",
+			env:  map[string]string{"HOSPITAL_LOADER_OUT_DIR": "env/", "HOSPITAL_LOADER_BATCH_OUT_DIR": "batch-env/"},
+			want: "batch-env/", source: "env HOSPITAL_LOADER_BATCH_OUT_DIR",
+		},
+		{
+			name:     "explicit flag beats everything",
+			file:     map[string]string{"batch-out-dir": "batch-file/"},
+			env:      map[string]string{"HOSPITAL_LOADER_BATCH_OUT_DIR": "batch-env/"},
+			explicit: "flag/",
+			want:     "flag/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFileConfig(t, tt.file)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cmd := testSettingsCommand()
+			if tt.explicit != "" {
+				cmd.Flags().Set("out-dir", tt.explicit)
+			}
+			if err := applySettings(cmd); err != nil {
+				t.Fatalf("applySettings: %v", err)
+			}
+			if got, _ := cmd.Flags().GetString("out-dir"); got != tt.want {
+				t.Errorf("out-dir = %q, want %q", got, tt.want)
+			}
+			if tt.explicit != "" {
+				return
+			}
+			_, source, _ := lookupSetting("batch", "out-dir")
+			if source != tt.source {
+				t.Errorf("source = %q, want %q", source, tt.source)
+			}
+		})
+	}
+}
+
+func TestApplySettingsNestedAndInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loader.yaml")
+	yaml := "parallel: 8\ndownload:\n  max_eta: 1h\nbatch:\n  out_dir: s3://bucket/nightly/\n"
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFileConfig(t, cfg)
+
+	cmd := testSettingsCommand()
+	if err := applySettings(cmd); err != nil {
+		t.Fatalf("applySettings: %v", err)
+	}
+	if got, _ := cmd.Flags().GetInt("parallel"); got != 8 {
+		t.Errorf("parallel = %d, want 8", got)
+	}
+	if got, _ := cmd.Flags().GetDuration("download-max-eta"); got.String() != "1h0m0s" {
+		t.Errorf("download-max-eta = %v, want 1h", got)
+	}
+	if got, _ := cmd.Flags().GetString("out-dir"); got != "s3://bucket/nightly/" {
+		t.Errorf("out-dir = %q, want the batch table's", got)
+	}
+
+	t.Setenv("HOSPITAL_LOADER_PARALLEL", "many")
+	if err := applySettings(testSettingsCommand()); err == nil {
+		t.Error("applySettings with parallel=many succeeded, want error")
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	toml := filepath.Join(dir, "loader.toml")
+	content := "parallel = 4\nbloom_columns = [\"cpt_code\", \"payer_name\"]\n\n[download]\nmax_eta = \"30m\"\n\n[batch]\nout_dir = \"out/\"\n"
+	if err := os.WriteFile(toml, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadConfigFile(toml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"parallel":         "4",
+		"bloom-columns":    "cpt_code,payer_name",
+		"download-max-eta": "30m",
+		"batch-out-dir":    "out/",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadConfigFile = %v, want %v", got, want)
+	}
+
+	if _, err := loadConfigFile(filepath.Join(dir, "loader.ini")); err == nil {
+		t.Error("loadConfigFile(.ini) succeeded, want error")
+	}
+}
+
+// TestBatchSizeSetting checks that --batch, which shares its name with the
+// batch subcommand's table, is configured as batch_size.
+func TestBatchSizeSetting(t *testing.T) {
+	setFileConfig(t, map[string]string{"batch-size": "500", "batch-out-dir": "nightly/"})
+	cmd := testSettingsCommand()
+	if err := applySettings(cmd); err != nil {
+		t.Fatalf("applySettings: %v", err)
+	}
+	if got, _ := cmd.Flags().GetInt("batch"); got != 500 {
+		t.Errorf("batch = %d, want 500", got)
+	}
+	if got, _ := cmd.Flags().GetString("out-dir"); got != "nightly/" {
+		t.Errorf("out-dir = %q, want nightly/", got)
+	}
+
+	err := checkCommandTables(map[string]string{"batch": "500"})
+	if err == nil || !strings.Contains(err.Error(), "batch_size") {
+		t.Errorf("checkCommandTables(batch: 500) = %v, want an error naming batch_size", err)
+	}
+	if err := checkCommandTables(map[string]string{"batch-size": "500", "batch-parallel": "4"}); err != nil {
+		t.Errorf("checkCommandTables: %v", err)
+	}
+}
+
+func TestFlattenConfig(t *testing.T) {
+	out := make(map[string]string)
+	flattenConfig("", map[string]any{
+		"Out_Dir":   "x/",
+		"s3.region": "us-east-2",
+		"batch": map[string]any{
+			"host": map[string]any{"interval": "5s"},
+			"log":  nil,
+		},
+	}, out)
+	want := map[string]string{
+		"out-dir":             "x/",
+		"s3-region":           "us-east-2",
+		"batch-host-interval": "5s",
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("flattenConfig = %v, want %v", out, want)
+	}
+}
+
+// testSettingsCommand returns a command named batch with a few flags of
+// the real one.
+func testSettingsCommand() *cobra.Command {
+	cmd := &cobra.Command{Use: "batch"}
+	cmd.Flags().String("out-dir", "output", "")
+	cmd.Flags().Int("parallel", 1, "")
+	cmd.Flags().Int("batch", 1000, "")
+	cmd.Flags().Duration("download-max-eta", 0, "")
+	return cmd
+}
+
+// setFileConfig installs a loaded config file for the test.
+func setFileConfig(t *testing.T, cfg map[string]string) {
+	t.Helper()
+	oldPath, oldConfig := configPath, fileConfig
+	t.Cleanup(func() { configPath, fileConfig = oldPath, oldConfig })
+	configPath, fileConfig = "loader.yaml", cfg
+}
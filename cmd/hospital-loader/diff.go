@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"pricetool/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff --old <file> --new <file> --out <file>",
+	Short: "List the charges that changed between two versions of a hospital's file",
+	Long: `Compare two denormalized Parquet outputs of the same hospital, typically
+consecutive monthly publications, and write the charges added, removed and
+changed between them.
+
+Charges are matched by description, setting, codes, payer and plan. Each
+output row has the change (added, removed or changed), those keys, the old
+and new gross, discounted cash, negotiated, estimated, min and max amounts
+with their percent change, and the old and new methodology and algorithm.
+Negotiated rates are only compared when both files were converted with
+--skip-payer-charges=false.
+
+--format parquet writes a Parquet file; --format json writes one JSON object
+per line. Inputs and --out may be local paths or s3:// URIs.
+
+Examples:
+  hospital-loader diff --old 2024-01.parquet --new 2024-02.parquet --out changes.parquet
+  hospital-loader diff --old a.parquet --new b.parquet --format json --out changes.jsonl`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var opts internal.DiffOptions
+		opts.Old, _ = cmd.Flags().GetString("old")
+		opts.New, _ = cmd.Flags().GetString("new")
+		opts.Out, _ = cmd.Flags().GetString("out")
+		opts.Format, _ = cmd.Flags().GetString("format")
+		opts.S3Region, _ = cmd.Flags().GetString("s3-region")
+		if opts.Old == "" || opts.New == "" || opts.Out == "" {
+			slog.Error("--old, --new and --out are required")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		summary, err := internal.Diff(slog.Default(), opts)
+		if err != nil {
+			slog.Error("diff failed", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("diff done", "out", opts.Out,
+			"added", summary.Added, "removed", summary.Removed, "changed", summary.Changed)
+	},
+}
+
+func init() {
+	diffCmd.Flags().String("old", "", "Earlier Parquet output (required)")
+	diffCmd.Flags().String("new", "", "Later Parquet output (required)")
+	diffCmd.Flags().String("out", "", "Local path or s3:// URI for the changes (required)")
+	diffCmd.Flags().String("format", internal.FormatParquet, "Output format: parquet or json (one object per line)")
+	diffCmd.Flags().String("s3-region", "", "AWS region for S3 access (default: AWS SDK resolution)")
+}
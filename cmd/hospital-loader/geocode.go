@@ -21,6 +21,7 @@ Examples:
   hospital-loader geocode --log s3://hospital-mrf/logs/run.jsonl`,
 	Run: func(cmd *cobra.Command, args []string) {
 		logPath, _ := cmd.Flags().GetString("log")
+		region, _ := cmd.Flags().GetString("s3-region")
 
 		if logPath == "" {
 			slog.Error("--log is required")
@@ -29,7 +30,7 @@ Examples:
 		}
 
 		if strings.HasPrefix(logPath, "s3://") {
-			geocodeS3(logPath)
+			geocodeS3(logPath, region)
 		} else {
 			geocodeLocal(logPath)
 		}
@@ -38,6 +39,7 @@ Examples:
 
 func init() {
 	geocodeCmd.Flags().String("log", "", "JSONL log file path or S3 URI (required)")
+	geocodeCmd.Flags().String("s3-region", "", "AWS region for S3 access (default: AWS SDK resolution)")
 }
 
 func geocodeLocal(logPath string) {
@@ -48,11 +50,11 @@ func geocodeLocal(logPath string) {
 	slog.Info("geocoding complete", "file", logPath)
 }
 
-func geocodeS3(s3URI string) {
+func geocodeS3(s3URI, region string) {
 	ctx := context.Background()
 
 	slog.Info("downloading log file from S3", "uri", s3URI)
-	localPath, cleanup, err := internal.DownloadFromS3(ctx, s3URI)
+	localPath, cleanup, err := internal.DownloadFromS3(ctx, s3URI, region)
 	if err != nil {
 		slog.Error("failed to download from S3", "error", err)
 		os.Exit(1)
@@ -65,7 +67,7 @@ func geocodeS3(s3URI string) {
 	}
 
 	slog.Info("uploading geocoded log file to S3", "uri", s3URI)
-	if err := internal.UploadToS3(ctx, localPath, s3URI); err != nil {
+	if err := internal.UploadToS3(ctx, localPath, s3URI, region); err != nil {
 		slog.Error("failed to upload to S3", "error", err)
 		os.Exit(1)
 	}
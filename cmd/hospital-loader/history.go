@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"pricetool/internal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Keep and query a history of each hospital's prices across runs",
+	Long: `A price history is a directory with one Parquet file per hospital. Each row
+is a charge with valid_from and valid_to columns, the last_updated_on dates of
+the file that published it at those prices and of the file that changed or
+dropped it (null while current). Adding a new conversion appends only the
+charges that changed.
+
+The files can be queried directly, e.g. with DuckDB:
+
+  SELECT * FROM 'history/*.parquet'
+  WHERE cpt_code = '93306' AND valid_from <= '2024-03-01'
+    AND (valid_to IS NULL OR valid_to > '2024-03-01')`,
+}
+
+var historyAddCmd = &cobra.Command{
+	Use:   "add --dir <history> <file|s3://uri>...",
+	Short: "Record converted files in the price history",
+	Long: `Record denormalized Parquet outputs in the price history. Charges are matched
+to the hospital's current ones by description, setting, codes, payer and plan;
+those whose prices changed, and new ones, are appended as of the file's
+last_updated_on, and the rows they replace or that were dropped are closed.
+
+Files are added in last_updated_on order, read from their footers, whatever
+order they are listed in. A file older than the hospital's history is an
+error; one as old as it is skipped. Each file must hold one hospital:
+compacted files are refused.
+
+Examples:
+  hospital-loader history add --dir history/ output/general-2024-01-15.parquet
+  hospital-loader history add --dir history/ output/*.parquet`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, _ := cmd.Flags().GetString("dir")
+		region, _ := cmd.Flags().GetString("s3-region")
+		inputs, err := internal.SortHistoryInputs(args, region)
+		if err != nil {
+			slog.Error("history update failed", "error", err)
+			os.Exit(1)
+		}
+		failed := 0
+		for _, input := range inputs {
+			if _, err := internal.AddToHistory(slog.Default(), dir, input, region); err != nil {
+				slog.Error("history update failed", "input", input, "error", err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var historyAtCmd = &cobra.Command{
+	Use:   "at --dir <history> --date YYYY-MM-DD",
+	Short: "Print the prices published for a date",
+	Long: `Print the charges of the price history that were current on --date,
+optionally only those with a code or of matching hospitals.
+
+Examples:
+  hospital-loader history at --dir history/ --date 2024-03-01 --code 93306
+  hospital-loader history at --dir history/ --date 2023-12-31 --hospital "general" --code 70553`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, _ := cmd.Flags().GetString("dir")
+		var q internal.HistoryQuery
+		q.Date, _ = cmd.Flags().GetString("date")
+		q.Code, _ = cmd.Flags().GetString("code")
+		q.Hospital, _ = cmd.Flags().GetString("hospital")
+		if q.Date == "" {
+			slog.Error("--date is required")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		rows, err := internal.PricesAt(dir, q)
+		if err != nil {
+			slog.Error("history query failed", "error", err)
+			os.Exit(1)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOSPITAL\tDESCRIPTION\tSETTING\tPAYER\tPLAN\tGROSS\tCASH\tNEGOTIATED\tVALID_FROM\tVALID_TO")
+		for _, r := range rows {
+			fmt.Fprintln(tw, strings.Join([]string{
+				r.HospitalName, r.Description, r.Setting, str(r.PayerName), str(r.PlanName),
+				amount(r.GrossCharge), amount(r.DiscountedCash), amount(r.NegotiatedDollar),
+				r.ValidFrom, str(r.ValidTo),
+			}, "\t"))
+		}
+		tw.Flush()
+	},
+}
+
+func str(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func amount(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f, 'f', 2, 64)
+}
+
+func init() {
+	historyCmd.PersistentFlags().String("dir", "history", "Price history directory")
+	historyAddCmd.Flags().String("s3-region", "", "AWS region for S3 access (default: AWS SDK resolution)")
+	historyAtCmd.Flags().String("date", "", "Date to look up, YYYY-MM-DD (required)")
+	historyAtCmd.Flags().String("code", "", "Only charges with this code, in any code column")
+	historyAtCmd.Flags().String("hospital", "", "Only hospitals whose name contains this, ignoring case")
+	historyCmd.AddCommand(historyAddCmd, historyAtCmd)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
+	"pricetool/internal"
+	"strings"
 	"time"
 
 	"github.com/lmittmann/tint"
@@ -16,7 +19,11 @@ var rootCmd = &cobra.Command{
 into query-optimized Parquet files.
 
 Use "hospital-loader single" to convert a single file, or
-"hospital-loader batch" to process multiple hospitals from a JSONL file.`,
+"hospital-loader batch" to process multiple hospitals from a JSONL file.
+
+Settings can also come from a YAML/TOML file (--config) and HOSPITAL_LOADER_*
+environment variables; command-line flags take precedence over both. Run
+"hospital-loader config print" to see the effective configuration.`,
 }
 
 func init() {
@@ -25,7 +32,143 @@ func init() {
 	})))
 	rootCmd.AddCommand(singleCmd)
 	rootCmd.AddCommand(batchCmd)
+	rootCmd.AddCommand(compactCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(historyCmd)
 	rootCmd.AddCommand(geocodeCmd)
+	rootCmd.AddCommand(configCmd)
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		return initConfig(cmd)
+	}
+	rootCmd.PersistentFlags().String("config", "", "YAML or TOML config file (env: HOSPITAL_LOADER_CONFIG)")
+}
+
+// addProcessFlags registers the conversion and download tuning flags shared
+// by the single and batch subcommands.
+func addProcessFlags(cmd *cobra.Command) {
+	defaults := internal.DefaultProcessOptions()
+	cmd.Flags().Int("batch", defaults.BatchSize, "Batch size for Parquet writes (config key: batch_size)")
+	cmd.Flags().Bool("skip-payer-charges", defaults.SkipPayerCharges, "Skip payer-specific negotiated rates")
+	cmd.Flags().Bool("normalized", defaults.Normalized, "Write hospitals, items, standard_charges and payer_charges tables (<name>-<table>.parquet) instead of one denormalized file")
+	cmd.Flags().String("output-format", internal.FormatParquet, "Output format: parquet, ndjson, csv, arrow (Arrow IPC file, readable as Feather v2), duckdb (appends to a database) or postgres (loads into the database at the postgres:// output URL)")
+	addWriterFlags(cmd)
+	cmd.Flags().String("layout", internal.LayoutFlat, `Directory output layout: "flat", or "hive" for state=XX/updated=YYYY-MM-DD/ partitions`)
+	cmd.Flags().String("s3-region", "", "AWS region for S3 uploads (default: AWS SDK resolution)")
+	cmd.Flags().String("archive", "", "Local directory or s3:// prefix to keep raw source files in, named by SHA-256 (default: don't keep)")
+	cmd.Flags().Bool("stream", defaults.Stream, "Convert URLs straight from the HTTP response without a temp file (zip still uses one; no resume)")
+	cmd.Flags().Duration("download-steady-state-after", defaults.Download.SteadyStateAfter, "Download time before the ETA check starts")
+	cmd.Flags().Duration("download-max-eta", defaults.Download.MaxETA, "Abort downloads whose estimated remaining time exceeds this (0 = never)")
+	cmd.Flags().Float64("download-min-speed", defaults.Download.MinSpeedMBs, "Abort downloads slower than this many MB/s after the steady-state period (0 = never)")
+	cmd.Flags().Int("download-attempts", defaults.Download.MaxAttempts, "Total download attempts, including the first")
+	cmd.Flags().Duration("download-backoff", defaults.Download.Backoff, "Wait before the first retry; doubles for each further retry")
+	cmd.Flags().Duration("download-max-backoff", defaults.Download.MaxBackoff, "Upper bound on the wait between retries")
+	cmd.Flags().Float64("download-jitter", defaults.Download.Jitter, "Randomize retry waits by this fraction (0.2 = ±20%)")
+	cmd.Flags().Int("download-chunks", defaults.Download.Chunks, "Parallel ranged requests for large files (1 = single stream)")
+	cmd.Flags().Int64("download-chunk-min-mb", defaults.Download.ChunkMinSize/1024/1024, "Only download files at least this many MB in chunks")
+	cmd.Flags().StringSlice("client-profiles", defaults.Download.Profiles, "TLS fingerprint and header profiles (chrome, firefox, safari), tried in order when a host blocks one")
+	cmd.Flags().StringSlice("proxy", nil, "Egress proxy URLs (http://, https:// or socks5://), rotated per host on block responses; default uses HTTPS_PROXY/HTTP_PROXY (repeatable)")
+	cmd.Flags().StringSlice("download-host-policy", nil, `Per-host download overrides, e.g. "hcadam.com:max-eta=1h;attempts=5" (repeatable)`)
+}
+
+// processOptions reads the flags registered by addProcessFlags.
+func processOptions(cmd *cobra.Command) (internal.ProcessOptions, error) {
+	opts := internal.DefaultProcessOptions()
+	opts.BatchSize, _ = cmd.Flags().GetInt("batch")
+	opts.SkipPayerCharges, _ = cmd.Flags().GetBool("skip-payer-charges")
+	opts.Normalized, _ = cmd.Flags().GetBool("normalized")
+	opts.OutputFormat, _ = cmd.Flags().GetString("output-format")
+	if err := internal.ValidateOutputFormat(opts.OutputFormat); err != nil {
+		return opts, err
+	}
+	if opts.Normalized && opts.OutputFormat != internal.FormatParquet {
+		return opts, fmt.Errorf("--normalized is only supported for parquet output")
+	}
+	var err error
+	if opts.Writer, opts.SortOrder, err = writerOptions(cmd); err != nil {
+		return opts, err
+	}
+	opts.Layout, _ = cmd.Flags().GetString("layout")
+	if err := internal.ValidateLayout(opts.Layout); err != nil {
+		return opts, err
+	}
+	opts.S3Region, _ = cmd.Flags().GetString("s3-region")
+	opts.Stream, _ = cmd.Flags().GetBool("stream")
+	opts.Archive, _ = cmd.Flags().GetString("archive")
+	opts.Download.SteadyStateAfter, _ = cmd.Flags().GetDuration("download-steady-state-after")
+	opts.Download.MaxETA, _ = cmd.Flags().GetDuration("download-max-eta")
+	opts.Download.MinSpeedMBs, _ = cmd.Flags().GetFloat64("download-min-speed")
+	opts.Download.MaxAttempts, _ = cmd.Flags().GetInt("download-attempts")
+	opts.Download.Backoff, _ = cmd.Flags().GetDuration("download-backoff")
+	opts.Download.MaxBackoff, _ = cmd.Flags().GetDuration("download-max-backoff")
+	opts.Download.Jitter, _ = cmd.Flags().GetFloat64("download-jitter")
+	opts.Download.Chunks, _ = cmd.Flags().GetInt("download-chunks")
+	chunkMinMB, _ := cmd.Flags().GetInt64("download-chunk-min-mb")
+	opts.Download.ChunkMinSize = chunkMinMB * 1024 * 1024
+	opts.Download.Profiles, _ = cmd.Flags().GetStringSlice("client-profiles")
+	if err := internal.ValidateProfiles(opts.Download.Profiles); err != nil {
+		return opts, err
+	}
+
+	proxies, _ := cmd.Flags().GetStringSlice("proxy")
+	if err := internal.UseProxies(proxies); err != nil {
+		return opts, err
+	}
+
+	// Host overrides inherit from the base policy, so parse them last.
+	hostPolicies, _ := cmd.Flags().GetStringSlice("download-host-policy")
+	for _, spec := range hostPolicies {
+		if err := opts.Download.SetHostOverride(spec); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// addWriterFlags registers the Parquet writer tuning and sort order flags
+// shared by the conversion and compact subcommands.
+func addWriterFlags(cmd *cobra.Command) {
+	defaults := internal.DefaultWriterConfig()
+	cmd.Flags().String("compression", defaults.Compression, "Parquet compression: zstd, snappy, lz4, gzip or none")
+	cmd.Flags().Int("compression-level", defaults.CompressionLevel, "Compression level: 1-22 for zstd, 1-9 for gzip and lz4 (0 = codec default)")
+	cmd.Flags().Int("page-size-kb", defaults.PageBufferSize/1024, "Parquet page size in KB; smaller pages allow finer page-level filtering")
+	cmd.Flags().Int("row-group-rows", defaults.RowsPerGroup, "Rows per Parquet row group")
+	cmd.Flags().StringSlice("bloom-columns", nil, `Columns with bloom filters (default: all code columns, payer_name and plan_name; "none" disables them)`)
+	cmd.Flags().Int("bloom-bits", defaults.BloomBitsPerValue, "Bloom filter bits per value (10 ≈ 1% false positives)")
+	cmd.Flags().StringSlice("column-encoding", nil, `Per-column encodings: plain, dict, delta (strings) or split (floats), e.g. "description=delta" (repeatable)`)
+	cmd.Flags().String("sort", internal.DefaultSortOrder.String(), `Row order: columns to sort by, e.g. "ms_drg_code,hcpcs_code,payer_name", or "zorder(cpt_code,ms_drg_code,ndc_code)" to cluster on several codes`)
+}
+
+// writerOptions reads the flags registered by addWriterFlags.
+func writerOptions(cmd *cobra.Command) (internal.WriterConfig, internal.SortOrder, error) {
+	config := internal.DefaultWriterConfig()
+	config.Compression, _ = cmd.Flags().GetString("compression")
+	config.CompressionLevel, _ = cmd.Flags().GetInt("compression-level")
+	pageKB, _ := cmd.Flags().GetInt("page-size-kb")
+	config.PageBufferSize = pageKB * 1024
+	config.RowsPerGroup, _ = cmd.Flags().GetInt("row-group-rows")
+	if bloom, _ := cmd.Flags().GetStringSlice("bloom-columns"); len(bloom) == 1 && bloom[0] == "none" {
+		config.BloomColumns = []string{}
+	} else if len(bloom) > 0 {
+		config.BloomColumns = bloom
+	}
+	config.BloomBitsPerValue, _ = cmd.Flags().GetInt("bloom-bits")
+	encodings, _ := cmd.Flags().GetStringSlice("column-encoding")
+	for _, e := range encodings {
+		col, enc, ok := strings.Cut(e, "=")
+		if !ok {
+			return config, internal.SortOrder{}, fmt.Errorf("invalid --column-encoding %q: want column=encoding", e)
+		}
+		if config.Encodings == nil {
+			config.Encodings = make(map[string]string)
+		}
+		config.Encodings[strings.TrimSpace(col)] = strings.TrimSpace(enc)
+	}
+	if err := config.Validate(); err != nil {
+		return config, internal.SortOrder{}, err
+	}
+	sortSpec, _ := cmd.Flags().GetString("sort")
+	sortOrder, err := internal.ParseSortOrder(sortSpec)
+	return config, sortOrder, err
 }
 
 func main() {
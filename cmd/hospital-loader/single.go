@@ -16,12 +16,12 @@ var singleCmd = &cobra.Command{
 Examples:
   hospital-loader single --file input.csv
   hospital-loader single --file input.json --out output.parquet
+  hospital-loader single --file input.csv --output-format ndjson --out output.ndjson
+  hospital-loader single --file input.csv --output-format postgres --out postgres://loader@localhost/prices
   hospital-loader single --file https://example.com/charges.csv`,
 	Run: func(cmd *cobra.Command, args []string) {
 		file, _ := cmd.Flags().GetString("file")
 		out, _ := cmd.Flags().GetString("out")
-		batch, _ := cmd.Flags().GetInt("batch")
-		skipPayer, _ := cmd.Flags().GetBool("skip-payer-charges")
 		logPath, _ := cmd.Flags().GetString("log")
 		hospitalName, _ := cmd.Flags().GetString("hospitalName")
 
@@ -31,7 +31,13 @@ Examples:
 			os.Exit(1)
 		}
 
-		if err := internal.ProcessEntry(slog.Default(), file, out, logPath, batch, skipPayer, hospitalName); err != nil {
+		opts, err := processOptions(cmd)
+		if err != nil {
+			slog.Error("invalid options", "error", err)
+			os.Exit(1)
+		}
+
+		if err := internal.ProcessEntry(slog.Default(), file, out, logPath, hospitalName, opts); err != nil {
 			slog.Error("conversion failed", "error", err)
 			os.Exit(1)
 		}
@@ -45,8 +51,7 @@ Examples:
 func init() {
 	singleCmd.Flags().String("file", "", "Input file path or URL (required)")
 	singleCmd.Flags().String("out", "", "Output Parquet file (default: derived from input)")
-	singleCmd.Flags().Int("batch", 10000, "Batch size for Parquet writes")
-	singleCmd.Flags().Bool("skip-payer-charges", true, "Skip payer-specific negotiated rates")
 	singleCmd.Flags().String("log", "hospital-loader-log.jsonl", "JSONL log file path")
 	singleCmd.Flags().String("hospitalName", "", "CMS HPT location name for log entry")
+	addProcessFlags(singleCmd)
 }
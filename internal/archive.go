@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// archiveSource keeps a copy of a raw source file (as served, before any
+// gzip or zip is unpacked) under dest, a local directory or an s3://
+// prefix. Objects are keyed by content hash as <dest>/<sha[:2]>/<sha><ext>,
+// so republished files that didn't change are stored once. Returns the
+// archive location.
+func archiveSource(logger *slog.Logger, rawPath string, source Provenance, dest, region string) (string, error) {
+	if len(source.SHA256) < 2 {
+		return "", fmt.Errorf("archive %s: no content hash", rawPath)
+	}
+	ext := strings.ToLower(filepath.Ext(rawPath))
+	if isGzipFile(rawPath) && ext != ".gz" {
+		ext += ".gz"
+	}
+	name := source.SHA256[:2] + "/" + source.SHA256 + ext
+
+	if strings.HasPrefix(dest, "s3://") {
+		uri := strings.TrimSuffix(dest, "/") + "/" + name
+		ctx := context.Background()
+		exists, err := s3ObjectExists(ctx, uri, region)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			logger.Debug("source already archived", "dest", uri)
+			return uri, nil
+		}
+		if err := uploadToS3(logger, ctx, rawPath, uri, region); err != nil {
+			return "", err
+		}
+		return uri, nil
+	}
+
+	target, err := filepath.Abs(filepath.Join(dest, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(target); err == nil {
+		logger.Debug("source already archived", "dest", target)
+		return target, nil
+	}
+	if err := copyFileAtomic(rawPath, target); err != nil {
+		return "", fmt.Errorf("archive source: %w", err)
+	}
+	return target, nil
+}
+
+// copyFileAtomic copies src to dst through a temp file in dst's directory,
+// so a partial copy is never visible under the final name.
+func copyFileAtomic(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".archive-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// s3ObjectExists reports whether an S3 object exists.
+func s3ObjectExists(ctx context.Context, s3URI, region string) (bool, error) {
+	bucket, key, err := parseS3URI(s3URI)
+	if err != nil {
+		return false, err
+	}
+	cfg, err := loadAWSConfig(ctx, region)
+	if err != nil {
+		return false, fmt.Errorf("load AWS config: %w", err)
+	}
+	_, err = s3.NewFromConfig(cfg).HeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &key})
+	if err == nil {
+		return true, nil
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey") {
+		return false, nil
+	}
+	return false, fmt.Errorf("S3 HeadObject: %w", err)
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessEntryArchivesSource(t *testing.T) {
+	csv, err := os.ReadFile(writeTallCSV(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipped := zipBytes(t, "tall.csv", csv)
+	gzipped := gzipBytes(t, csv)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/charges.zip", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(zipped)
+	})
+	mux.HandleFunc("/charges.csv", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(gzipped)
+	})
+	srv, _ := tlsServer(t, true, mux)
+	useTestServer(t, srv)
+
+	for _, tt := range []struct {
+		name   string
+		path   string
+		stream bool
+		raw    []byte
+		ext    string
+	}{
+		{"zip download", "/charges.zip", false, zipped, ".zip"},
+		{"gzip stream", "/charges.csv", true, gzipped, ".csv.gz"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := DefaultProcessOptions()
+			opts.Download = testPolicy()
+			opts.Stream = tt.stream
+			opts.Archive = filepath.Join(dir, "archive")
+			logPath := filepath.Join(dir, "log.jsonl")
+
+			// The second run finds the file already archived.
+			for range 2 {
+				if err := ProcessEntry(quietLogger(), srv.URL+tt.path, filepath.Join(dir, "out.parquet"), logPath, "Test", opts); err != nil {
+					t.Fatalf("ProcessEntry: %v", err)
+				}
+			}
+
+			sum := sha256Hex(tt.raw)
+			want := filepath.Join(opts.Archive, sum[:2], sum+tt.ext)
+			entries, err := readLogEntries(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.ArchivePath != want {
+					t.Errorf("archive_path = %q, want %q", e.ArchivePath, want)
+				}
+			}
+			got, err := os.ReadFile(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.raw) {
+				t.Errorf("archived %d bytes, want the %d raw bytes", len(got), len(tt.raw))
+			}
+		})
+	}
+}
+
+// TestStreamParseErrorArchive streams a file that fails to parse early:
+// it is archived if little is left to fetch, and skipped otherwise.
+func TestStreamParseErrorArchive(t *testing.T) {
+	defer func(limit int64) { archiveDrainLimit = limit }(archiveDrainLimit)
+	archiveDrainLimit = 64 << 10
+
+	bad := []byte(`{"hospital_name": "Test", "standard_charge_information": [{"description": ]`)
+	small := append(bytes.Clone(bad), bytes.Repeat([]byte(" "), 1<<10)...)
+	large := append(bytes.Clone(bad), bytes.Repeat([]byte(" "), 4<<20)...)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/small.json", func(w http.ResponseWriter, r *http.Request) { w.Write(small) })
+	mux.HandleFunc("/large.json", func(w http.ResponseWriter, r *http.Request) { w.Write(large) })
+	srv, _ := tlsServer(t, true, mux)
+	useTestServer(t, srv)
+
+	for _, tt := range []struct {
+		path     string
+		archived bool
+	}{
+		{"/small.json", true},
+		{"/large.json", false},
+	} {
+		dir := t.TempDir()
+		opts := DefaultProcessOptions()
+		opts.Download = testPolicy()
+		opts.Stream = true
+		opts.Archive = filepath.Join(dir, "archive")
+		if err := ProcessEntry(quietLogger(), srv.URL+tt.path, filepath.Join(dir, "out.parquet"), filepath.Join(dir, "log.jsonl"), "Test", opts); err == nil {
+			t.Fatalf("%s: ProcessEntry succeeded, want a parse error", tt.path)
+		}
+		archived, _ := filepath.Glob(filepath.Join(opts.Archive, "*", "*"))
+		if got := len(archived) > 0; got != tt.archived {
+			t.Errorf("%s: archived %v, want %v", tt.path, archived, tt.archived)
+		}
+	}
+}
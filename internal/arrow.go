@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+)
+
+// ArrowWriter writes rows as an Arrow IPC file (Feather v2), one record
+// batch per Write, with the HospitalChargeRow columns typed utf8, float64
+// and bool. Optional columns are nullable. Buffers are uncompressed.
+//
+// Key-value metadata is written as custom metadata on the schema, which
+// must be known before the file starts. Batches are therefore spooled to an
+// IPC stream next to the output and copied into the file on Close.
+type ArrowWriter struct {
+	filename string
+	spool    *os.File
+	stream   *ipc.Writer
+	builder  *array.RecordBuilder
+	kv       [][2]string
+}
+
+// NewArrowWriter starts an Arrow IPC file.
+func NewArrowWriter(filename string) (*ArrowWriter, error) {
+	spool, err := os.CreateTemp(filepath.Dir(filename), ".arrow-spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("create arrow file: %w", err)
+	}
+	schema := arrowSchema(nil)
+	return &ArrowWriter{
+		filename: filename,
+		spool:    spool,
+		stream:   ipc.NewWriter(spool, ipc.WithSchema(schema)),
+		builder:  array.NewRecordBuilder(memory.DefaultAllocator, schema),
+	}, nil
+}
+
+// Write appends rows to the file as one record batch.
+func (w *ArrowWriter) Write(rows []HospitalChargeRow) (int, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	for c, col := range chargeColumns {
+		field := w.builder.Field(c)
+		field.Reserve(len(rows))
+		for i := range rows {
+			v, ok := col.value(reflect.ValueOf(&rows[i]).Elem())
+			if !ok {
+				field.AppendNull()
+				continue
+			}
+			switch b := field.(type) {
+			case *array.StringBuilder:
+				b.Append(v.String())
+			case *array.Float64Builder:
+				b.Append(v.Float())
+			case *array.BooleanBuilder:
+				b.Append(v.Bool())
+			}
+		}
+	}
+	rec := w.builder.NewRecord()
+	defer rec.Release()
+	if err := w.stream.Write(rec); err != nil {
+		return 0, fmt.Errorf("write arrow batch: %w", err)
+	}
+	return len(rows), nil
+}
+
+// SetKeyValueMetadata sets a key-value pair in the schema's custom
+// metadata. It may be called any time before Close.
+func (w *ArrowWriter) SetKeyValueMetadata(key, value string) {
+	for i := range w.kv {
+		if w.kv[i][0] == key {
+			w.kv[i][1] = value
+			return
+		}
+	}
+	w.kv = append(w.kv, [2]string{key, value})
+}
+
+// Close writes the file from the spooled batches and removes the spool.
+func (w *ArrowWriter) Close() error {
+	defer w.removeSpool()
+	w.builder.Release()
+	if err := w.stream.Close(); err != nil {
+		return fmt.Errorf("write arrow batch: %w", err)
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r, err := ipc.NewReader(w.spool)
+	if err != nil {
+		return fmt.Errorf("read arrow spool: %w", err)
+	}
+	defer r.Release()
+
+	file, err := os.Create(w.filename)
+	if err != nil {
+		return fmt.Errorf("create arrow file: %w", err)
+	}
+	fw, err := ipc.NewFileWriter(file, ipc.WithSchema(arrowSchema(w.kv)))
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("write arrow file: %w", err)
+	}
+	for r.Next() {
+		if err := fw.Write(r.Record()); err != nil {
+			file.Close()
+			return fmt.Errorf("write arrow file: %w", err)
+		}
+	}
+	if err := r.Err(); err != nil {
+		file.Close()
+		return fmt.Errorf("read arrow spool: %w", err)
+	}
+	if err := fw.Close(); err != nil {
+		file.Close()
+		return fmt.Errorf("write arrow file: %w", err)
+	}
+	return file.Close()
+}
+
+// Abort removes the spool without writing the file.
+func (w *ArrowWriter) Abort() {
+	w.builder.Release()
+	w.removeSpool()
+}
+
+func (w *ArrowWriter) removeSpool() {
+	w.spool.Close()
+	os.Remove(w.spool.Name())
+}
+
+// arrowSchema returns the Arrow schema of chargeColumns with kv as its
+// custom metadata.
+func arrowSchema(kv [][2]string) *arrow.Schema {
+	fields := make([]arrow.Field, len(chargeColumns))
+	for i, col := range chargeColumns {
+		var typ arrow.DataType
+		switch col.kind {
+		case reflect.String:
+			typ = arrow.BinaryTypes.String
+		case reflect.Float64:
+			typ = arrow.PrimitiveTypes.Float64
+		case reflect.Bool:
+			typ = arrow.FixedWidthTypes.Boolean
+		}
+		fields[i] = arrow.Field{Name: col.name, Type: typ, Nullable: col.optional}
+	}
+	keys := make([]string, len(kv))
+	values := make([]string, len(kv))
+	for i, p := range kv {
+		keys[i], values[i] = p[0], p[1]
+	}
+	md := arrow.NewMetadata(keys, values)
+	return arrow.NewSchema(fields, &md)
+}
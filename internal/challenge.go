@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Error kinds recorded in the log for downloads that returned something
+// other than an MRF.
+const (
+	errorKindBlocked  = "blocked"    // bot protection or WAF challenge
+	errorKindNotAnMRF = "not_an_mrf" // an ordinary web page (login, "file moved", ...)
+)
+
+// sniffLen is how much of a response body is inspected for HTML and
+// challenge-page signatures.
+const sniffLen = 4096
+
+// contentError is returned when a response is a web page rather than a
+// machine-readable file.
+type contentError struct {
+	Kind   string
+	Reason string
+	URL    string // final URL after redirects
+	err    error  // the HTTP status error, for non-2xx responses
+
+	// For a block, req is the request that got it and rotated records
+	// whether the transport already moved the host to another proxy.
+	req     *http.Request
+	rotated bool
+}
+
+func (e *contentError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Kind, e.Reason)
+	if e.err != nil {
+		msg += " (" + e.err.Error() + ")"
+	}
+	return msg
+}
+
+func (e *contentError) Unwrap() error { return e.err }
+
+// errorKind returns the log error kind for err, or "" for other failures.
+func errorKind(err error) string {
+	var ce *contentError
+	if errors.As(err, &ce) {
+		return ce.Kind
+	}
+	return ""
+}
+
+// challengeSignatures are lowercase body fragments of bot-protection
+// interstitials, mapped to the vendor named in the error.
+var challengeSignatures = []struct {
+	fragment, vendor string
+}{
+	{"cf-chl-", "Cloudflare"},
+	{"challenge-platform", "Cloudflare"},
+	{"<title>just a moment...</title>", "Cloudflare"},
+	{"attention required! | cloudflare", "Cloudflare"},
+	{"sucuri website firewall", "Sucuri"},
+	{"_incapsula_resource", "Imperva"},
+	{"incapsula incident id", "Imperva"},
+	{"errors.edgesuite.net", "Akamai"},
+	{"px-captcha", "PerimeterX"},
+	{"captcha-delivery.com", "DataDome"},
+	{"g-recaptcha", "reCAPTCHA"},
+	{"hcaptcha.com", "hCaptcha"},
+}
+
+// classifyResponse checks whether resp, whose decoded body starts with
+// head, is a challenge page or an HTML page instead of an MRF. statusErr is
+// the error for a non-2xx response; such responses are only reclassified
+// when they are challenges. It returns nil for anything that may be an MRF.
+func classifyResponse(resp *http.Response, head []byte, statusErr error) *contentError {
+	finalURL := ""
+	if resp.Request != nil {
+		finalURL = resp.Request.URL.String()
+	}
+	blocked := func(reason string) *contentError {
+		return &contentError{Kind: errorKindBlocked, Reason: reason, URL: finalURL, err: statusErr,
+			req: resp.Request, rotated: isBlockResponse(resp)}
+	}
+
+	if strings.EqualFold(resp.Header.Get("Cf-Mitigated"), "challenge") {
+		return blocked("Cloudflare challenge page")
+	}
+	if resp.Header.Get("X-Sucuri-Block") != "" {
+		return blocked("Sucuri firewall block")
+	}
+
+	html := looksLikeHTML(head)
+	if html || strings.Contains(strings.ToLower(resp.Header.Get("Content-Type")), "html") {
+		lower := bytes.ToLower(head)
+		for _, sig := range challengeSignatures {
+			if bytes.Contains(lower, []byte(sig.fragment)) {
+				return blocked(sig.vendor + " challenge page")
+			}
+		}
+	}
+
+	if html && statusErr == nil {
+		reason := "HTML page"
+		if title := htmlTitle(head); title != "" {
+			reason = fmt.Sprintf("HTML page %q", title)
+		}
+		return &contentError{Kind: errorKindNotAnMRF, Reason: reason, URL: finalURL}
+	}
+	return nil
+}
+
+// fallBack prepares another attempt after err. For a challenge page it
+// moves the host on to the next proxy and client profile, and reports
+// whether there was anywhere new to go; for any other error it reports true.
+// Only retry loops call it, once they have decided to try again.
+func fallBack(err error) bool {
+	var ce *contentError
+	if !errors.As(err, &ce) || ce.Kind != errorKindBlocked || ce.req == nil {
+		return true
+	}
+	if ce.rotated {
+		// The transport already rotated the proxy and tried every profile.
+		return downloadProxies.Len() > 1
+	}
+	proxied := downloadProxies.rotate(ce.req.URL.Hostname())
+	if proxied {
+		chromeClient.CloseIdleConnections()
+	}
+	return advanceProfile(ce.req) || proxied
+}
+
+// looksLikeHTML reports whether a body starts like an HTML document. The
+// Content-Type alone isn't trusted: some servers send CSVs as text/html.
+func looksLikeHTML(head []byte) bool {
+	head = bytes.TrimPrefix(head, []byte{0xEF, 0xBB, 0xBF})
+	s := strings.ToLower(strings.TrimSpace(string(head)))
+	for _, prefix := range []string{"<!doctype html", "<html", "<head", "<body", "<!--", "<script"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// htmlTitle extracts the <title> text from the start of an HTML page.
+func htmlTitle(head []byte) string {
+	lower := bytes.ToLower(head)
+	start := bytes.Index(lower, []byte("<title"))
+	if start < 0 {
+		return ""
+	}
+	gt := bytes.IndexByte(lower[start:], '>')
+	if gt < 0 {
+		return ""
+	}
+	start += gt + 1
+	end := bytes.Index(lower[start:], []byte("</title>"))
+	if end < 0 {
+		return ""
+	}
+	return strings.Join(strings.Fields(string(head[start:start+end])), " ")
+}
+
+// peekReader wraps r so its first sniffLen bytes can be inspected without
+// consuming them.
+func peekReader(r io.Reader) (*bufio.Reader, []byte) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, _ := br.Peek(sniffLen) // a short body is fine; the reader reports real errors
+	return br, head
+}
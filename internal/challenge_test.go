@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClassifyResponse(t *testing.T) {
+	statusErr := &httpStatusError{StatusCode: 403, Status: "403 Forbidden"}
+	tests := []struct {
+		name      string
+		status    int
+		header    http.Header
+		body      string
+		statusErr error
+		wantKind  string
+	}{
+		{
+			name:      "cloudflare interstitial",
+			status:    403,
+			header:    http.Header{"Content-Type": {"text/html; charset=UTF-8"}},
+			body:      "<!DOCTYPE html><html><head><title>Just a moment...</title>",
+			statusErr: statusErr,
+			wantKind:  errorKindBlocked,
+		},
+		{
+			name:     "cloudflare header",
+			status:   200,
+			header:   http.Header{"Cf-Mitigated": {"challenge"}},
+			body:     "<html></html>",
+			wantKind: errorKindBlocked,
+		},
+		{
+			name:     "sucuri served with 200",
+			status:   200,
+			body:     "<html><title>Sucuri WebSite Firewall - Access Denied</title>",
+			wantKind: errorKindBlocked,
+		},
+		{
+			name:     "login page",
+			status:   200,
+			header:   http.Header{"Content-Type": {"text/html"}},
+			body:     "\n  <!doctype html>\n<html><head><title>Sign In</title></head>",
+			wantKind: errorKindNotAnMRF,
+		},
+		{
+			name:   "CSV mislabelled as HTML",
+			status: 200,
+			header: http.Header{"Content-Type": {"text/html"}},
+			body:   "hospital_name,last_updated_on,version\n",
+		},
+		{
+			name:   "JSON MRF",
+			status: 200,
+			body:   `{"hospital_name": "General"}`,
+		},
+		{
+			name:      "ordinary 404 page",
+			status:    404,
+			body:      "<html><title>Not Found</title></html>",
+			statusErr: &httpStatusError{StatusCode: 404, Status: "404 Not Found"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tt.status,
+				Header:     tt.header,
+				Request:    &http.Request{URL: &url.URL{Scheme: "https", Host: "example.com"}},
+			}
+			if resp.Header == nil {
+				resp.Header = http.Header{}
+			}
+			got := classifyResponse(resp, []byte(tt.body), tt.statusErr)
+			kind := ""
+			if got != nil {
+				kind = got.Kind
+			}
+			if kind != tt.wantKind {
+				t.Errorf("kind = %q, want %q (err %v)", kind, tt.wantKind, got)
+			}
+			if got != nil && tt.statusErr != nil && !errors.Is(got, tt.statusErr) {
+				t.Errorf("%v does not wrap the status error", got)
+			}
+		})
+	}
+}
+
+func TestFetchToFileRejectsHTML(t *testing.T) {
+	var requests int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/charges.csv", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login?next=charges.csv", http.StatusFound)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipBytes(t, []byte("<html><head><title>Patient Portal Login</title></head></html>")))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "download.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = fetchToFile(quietLogger(), f, srv.URL+"/charges.csv", testPolicy())
+	var ce *contentError
+	if !errors.As(err, &ce) {
+		t.Fatalf("fetchToFile error = %v, want contentError", err)
+	}
+	if ce.Kind != errorKindNotAnMRF || !strings.Contains(ce.Reason, "Patient Portal Login") {
+		t.Errorf("got %s %q, want not_an_mrf with the page title", ce.Kind, ce.Reason)
+	}
+	if !strings.HasSuffix(ce.URL, "/login?next=charges.csv") {
+		t.Errorf("URL = %q, want the redirect target", ce.URL)
+	}
+	if requests != 1 {
+		t.Errorf("login page requested %d times, want 1 (not retried)", requests)
+	}
+}
+
+// TestChallengeFallsBackOnlyOnRetry checks that spotting a challenge page
+// leaves the host's profile alone until a retry loop decides to try again.
+func TestChallengeFallsBackOnlyOnRetry(t *testing.T) {
+	resetHostProfiles(t)
+	var agents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head><title>Just a moment...</title></head></html>"))
+	}))
+	defer srv.Close()
+
+	policy := testPolicy()
+	policy.MaxAttempts = 1
+	for range 2 {
+		_, err := openStream(quietLogger(), srv.URL+"/charges.csv", policy, nil)
+		if errorKind(err) != errorKindBlocked {
+			t.Fatalf("openStream error = %v, want a block", err)
+		}
+	}
+	if len(agents) != 2 || !strings.Contains(agents[1], "Chrome") {
+		t.Errorf("user agents = %q, want Chrome twice", agents)
+	}
+
+	_, err := openStream(quietLogger(), srv.URL+"/charges.csv", policy, nil)
+	if !fallBack(err) {
+		t.Fatalf("fallBack(%v) = false, want another profile", err)
+	}
+	if _, err := openStream(quietLogger(), srv.URL+"/charges.csv", policy, nil); err == nil {
+		t.Fatal("openStream succeeded against a challenge page")
+	}
+	if last := agents[len(agents)-1]; !strings.Contains(last, "Firefox") {
+		t.Errorf("user agent after fallBack = %q, want Firefox", last)
+	}
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// rangeProbe is what a full response's headers tell us about a file that
+// can be fetched in chunks.
+type rangeProbe struct {
+	Size      int64
+	Validator string
+	Filename  string     // from Content-Disposition, if present
+	Source    Provenance // final URL and response headers
+}
+
+// chunkedHandoff is returned by doDownload, before any of the body is
+// written, when the response shows a file of at least policy.ChunkMinSize
+// that can be fetched in ranges. The caller continues with fetchChunked, so
+// small files never cost a request beyond the download itself.
+type chunkedHandoff struct {
+	probe rangeProbe
+}
+
+func (h *chunkedHandoff) Error() string {
+	return fmt.Sprintf("%.1f MB file supports ranges: download in chunks", float64(h.probe.Size)/1024/1024)
+}
+
+// chunkable returns the handoff for a 200 response worth downloading in
+// chunks, nil otherwise. Chunks must all come from the same version of the
+// file, so a validator is required.
+func chunkable(resp *http.Response, result downloadResult, policy DownloadPolicy) *chunkedHandoff {
+	if policy.Chunks <= 1 || !result.AcceptRanges || result.Validator == "" ||
+		resp.ContentLength <= 0 || resp.ContentLength < policy.ChunkMinSize {
+		return nil
+	}
+	return &chunkedHandoff{rangeProbe{
+		Size:      resp.ContentLength,
+		Validator: result.Validator,
+		Filename:  result.Filename,
+		Source:    result.Source,
+	}}
+}
+
+// fetchChunked downloads a file of known size into f using policy.Chunks
+// concurrent ranged requests, each written at its own offset. A chunk that
+// fails mid-transfer is retried from where it stopped. Any chunk exhausting
+// its attempts fails the whole download.
+func fetchChunked(logger *slog.Logger, f *os.File, rawURL string, probe rangeProbe, policy DownloadPolicy) (downloadResult, error) {
+	if err := f.Truncate(probe.Size); err != nil {
+		return downloadResult{}, &permanentError{fmt.Errorf("allocate temp file: %w", err)}
+	}
+
+	n := int64(policy.Chunks)
+	chunkSize := (probe.Size + n - 1) / n
+	logger.Info("chunked download",
+		"chunks", n,
+		"size_mb", fmt.Sprintf("%.1f", float64(probe.Size)/1024/1024),
+		"chunk_mb", fmt.Sprintf("%.1f", float64(chunkSize)/1024/1024))
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := range n {
+		start := i * chunkSize
+		end := min(start+chunkSize, probe.Size) - 1
+		if start > end {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fetchChunk(logger.With("chunk", fmt.Sprintf("%d/%d", i+1, n)), f, rawURL, start, end, probe.Validator, policy)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return downloadResult{}, fmt.Errorf("chunk %d/%d: %w", i+1, n, err)
+		}
+	}
+
+	return downloadResult{
+		N:            probe.Size,
+		Filename:     probe.Filename,
+		Source:       probe.Source,
+		AcceptRanges: true,
+		Validator:    probe.Validator,
+	}, nil
+}
+
+// fetchChunk downloads bytes [start, end] of rawURL into f at the same
+// offsets, resuming within the chunk on retry. doDownload checks the first
+// chunk for a challenge page like a full response.
+func fetchChunk(logger *slog.Logger, f *os.File, rawURL string, start, end int64, validator string, policy DownloadPolicy) error {
+	attempts := max(policy.MaxAttempts, 1)
+	pos := start
+	chunkStart := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		w := io.NewOffsetWriter(f, pos)
+		result, err := doDownload(w, rawURL, policy, &resumeState{Offset: pos, End: end, Validator: validator})
+		if result.N > pos {
+			pos = result.N
+		}
+		if err == nil && pos != end+1 {
+			err = fmt.Errorf("short chunk: got bytes %d-%d of %d-%d", start, pos-1, start, end)
+		}
+		if err == nil {
+			break
+		}
+		if attempt >= attempts || !policy.isRetryable(err) || !fallBack(err) {
+			return err
+		}
+		backoff := policy.retryDelay(attempt, err)
+		logger.Info("retrying chunk", "attempt", attempt+1, "backoff", backoff.Round(time.Second).String(), "error", err)
+		time.Sleep(backoff)
+	}
+
+	size := end - start + 1
+	elapsed := time.Since(chunkStart)
+	logger.Info("chunk downloaded",
+		"size_mb", fmt.Sprintf("%.1f", float64(size)/1024/1024),
+		"duration", elapsed.Round(time.Millisecond).String(),
+		"speed_mb_s", fmt.Sprintf("%.1f", float64(size)/1024/1024/elapsed.Seconds()))
+	return nil
+}
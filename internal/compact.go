@@ -0,0 +1,496 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/parquet-go/parquet-go"
+)
+
+// DefaultCompactRows is the default number of rows per compacted file.
+// Each output is sorted in memory, which takes roughly 1KB per row.
+const DefaultCompactRows = 2_000_000
+
+// CompactOptions configures Compact.
+type CompactOptions struct {
+	// Inputs are Parquet files, local directories, or s3:// prefixes;
+	// directories and prefixes are searched for .parquet files. Normalized
+	// table files and manifests are skipped.
+	Inputs []string
+	// OutDir is the local directory or s3:// prefix for the compacted files.
+	OutDir string
+	// TargetRows is the approximate number of rows per output file. Inputs
+	// are never split, so a file may exceed it by one input's rows.
+	TargetRows int64
+
+	Writer    WriterConfig
+	SortOrder SortOrder
+
+	// DeleteInputs removes the inputs once every output has been written.
+	DeleteInputs bool
+	S3Region     string
+}
+
+// compactInput is a Parquet file to compact.
+type compactInput struct {
+	Location  string // as listed: local path or s3:// URI
+	LocalPath string // where it can be read; a temp file for S3 inputs
+
+	// From the footer, by inspect.
+	Rows          int64
+	LastUpdatedOn string
+	CompactedFrom string
+}
+
+// Compact rewrites many per-hospital Parquet files into fewer, larger ones.
+// Inputs are grouped in order into files of about TargetRows rows; each
+// group's rows are re-sorted across hospitals by SortOrder and written with
+// the usual bloom filters and page statistics. Returns the output files.
+func Compact(logger *slog.Logger, opts CompactOptions) ([]string, error) {
+	if opts.TargetRows <= 0 {
+		opts.TargetRows = DefaultCompactRows
+	}
+	ctx := context.Background()
+
+	tmpDir, err := os.MkdirTemp("", "hospital-loader-compact-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	inputs, err := listCompactInputs(ctx, opts.Inputs, opts.S3Region)
+	if err != nil {
+		return nil, err
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("no Parquet files found in %s", strings.Join(opts.Inputs, ", "))
+	}
+	outDir := strings.TrimSuffix(opts.OutDir, "/")
+	if err := checkCompactLayout(logger, inputs, opts.Inputs, outDir); err != nil {
+		return nil, err
+	}
+	// Only footers are read up front; each group's files are downloaded
+	// when it is compacted.
+	for i := range inputs {
+		if err := inputs[i].inspect(ctx, opts.S3Region); err != nil {
+			return nil, err
+		}
+	}
+
+	// Outputs are named by run, so compacting a directory into itself
+	// never overwrites an input.
+	stamp := time.Now().UTC().Format("20060102T150405")
+	var outputs []string
+	var listed []manifestFile
+	for n, group := range groupInputs(inputs, opts.TargetRows) {
+		for i := range group {
+			if err := group[i].fetch(ctx, tmpDir, opts.S3Region); err != nil {
+				return outputs, err
+			}
+		}
+		name := fmt.Sprintf("compacted-%s-%04d.parquet", stamp, n)
+		localOut := filepath.Join(tmpDir, name)
+		entry, err := compactGroup(group, localOut, opts)
+		if err != nil {
+			return outputs, err
+		}
+
+		dest := outDir + "/" + name
+		if strings.HasPrefix(outDir, "s3://") {
+			err = uploadToS3(logger, ctx, localOut, dest, opts.S3Region)
+		} else {
+			dest = filepath.Join(outDir, name)
+			err = copyFileAtomic(localOut, dest)
+		}
+		os.Remove(localOut)
+		if err != nil {
+			return outputs, fmt.Errorf("write %s: %w", dest, err)
+		}
+		outputs = append(outputs, dest)
+		entry.Path = logPath(dest)
+		listed = append(listed, entry)
+		logger.Info("compacted", "dest", dest, "inputs", len(group), "rows", entry.Rows,
+			"size_mb", fmt.Sprintf("%.1f", float64(fileSize(dest))/1024/1024))
+
+		// Each group's temp copies go as soon as they're merged.
+		for _, in := range group {
+			if in.LocalPath != in.Location {
+				os.Remove(in.LocalPath)
+			}
+		}
+	}
+
+	deleted := make(map[string]bool)
+	if opts.DeleteInputs {
+		for _, in := range inputs {
+			if err := removeInput(ctx, in.Location, opts.S3Region); err != nil {
+				return outputs, fmt.Errorf("delete input: %w", err)
+			}
+			deleted[logPath(in.Location)] = true
+		}
+		logger.Info("deleted compacted inputs", "files", len(inputs))
+	}
+	if err := updateManifests(logger, ctx, inputs, deleted, outDir, listed, opts.S3Region); err != nil {
+		return outputs, err
+	}
+	return outputs, nil
+}
+
+// checkCompactLayout rejects compacting files of the Hive layout into
+// their own root: the outputs would sit beside the state=... directories,
+// where the state=*/*/*.parquet globs used to query such runs miss them.
+// Any other unpartitioned destination only gets a warning.
+func checkCompactLayout(logger *slog.Logger, inputs []compactInput, locations []string, outDir string) error {
+	if inPartition(outDir + "/x.parquet") {
+		return nil
+	}
+	i := slices.IndexFunc(inputs, func(in compactInput) bool { return inPartition(in.Location) })
+	if i < 0 {
+		return nil
+	}
+	for _, loc := range locations {
+		if logPath(strings.TrimSuffix(loc, "/")) == logPath(outDir) {
+			return fmt.Errorf("%s uses the hive layout (e.g. %s); compacted files in its root would be missed by state=*/*/*.parquet, so choose another --out-dir", loc, inputs[i].Location)
+		}
+	}
+	logger.Warn("inputs use the hive layout but the output isn't partitioned", "input", inputs[i].Location, "out_dir", outDir)
+	return nil
+}
+
+// inPartition reports whether a file lies in a Hive partition directory,
+// .../state=<state>/updated=<date>/file.
+func inPartition(loc string) bool {
+	dir := path.Dir(filepath.ToSlash(loc))
+	return strings.HasPrefix(path.Base(dir), "updated=") && strings.HasPrefix(path.Base(path.Dir(dir)), "state=")
+}
+
+// groupInputs splits inputs, in order, into runs of about targetRows rows.
+func groupInputs(inputs []compactInput, targetRows int64) [][]compactInput {
+	var groups [][]compactInput
+	var current []compactInput
+	var rows int64
+	for _, in := range inputs {
+		if len(current) > 0 && rows+in.Rows > targetRows {
+			groups = append(groups, current)
+			current, rows = nil, 0
+		}
+		current = append(current, in)
+		rows += in.Rows
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+	return groups
+}
+
+// compactGroup merges the rows of group into one file and returns its
+// manifest entry, without a path.
+func compactGroup(group []compactInput, outputPath string, opts CompactOptions) (manifestFile, error) {
+	w, err := NewChargeWriter(outputPath, opts.Writer)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	w.SortOrder = opts.SortOrder
+	closed := false
+	defer func() {
+		if !closed {
+			w.Abort()
+		}
+	}()
+
+	sources := make([]string, len(group))
+	hospitals := make(map[string]bool)
+	for i, in := range group {
+		rows, err := readChargeRows(in.LocalPath)
+		if err != nil {
+			return manifestFile{}, fmt.Errorf("read %s: %w", in.Location, err)
+		}
+		if _, err := w.Write(rows); err != nil {
+			return manifestFile{}, fmt.Errorf("write rows of %s: %w", in.Location, err)
+		}
+		for j := range rows {
+			hospitals[hospitalKey(rows[j].LicenseState, rows[j].LicenseNumber, nil, rows[j].HospitalName)] = true
+		}
+		sources[i] = in.Location
+	}
+	rows := w.Count()
+	w.SetKeyValueMetadata(metadataPrefix+"tool_version", ToolVersion)
+	w.SetKeyValueMetadata(metadataPrefix+"converted_at", time.Now().UTC().Format(time.RFC3339))
+	w.SetKeyValueMetadata(metadataPrefix+"row_count", strconv.Itoa(rows))
+	w.SetKeyValueMetadata(metadataPrefix+"compacted_from", strings.Join(sources, "\n"))
+	closed = true
+	if err := w.Close(); err != nil {
+		return manifestFile{}, err
+	}
+	st, err := parquetFileStats(outputPath)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	return manifestFile{fileStats: st, Hospitals: len(hospitals), CompactedFrom: sources}, nil
+}
+
+// readChargeRows reads every row of a denormalized output file.
+func readChargeRows(path string) ([]HospitalChargeRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := parquet.NewGenericReader[HospitalChargeRow](f)
+	defer r.Close()
+	rows := make([]HospitalChargeRow, r.NumRows())
+	n, err := r.Read(rows)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return rows[:n], nil
+}
+
+// listCompactInputs expands files, directories and S3 prefixes into the
+// Parquet files to compact. Row counts are filled in by inspect.
+func listCompactInputs(ctx context.Context, locations []string, region string) ([]compactInput, error) {
+	var inputs []compactInput
+	for _, loc := range locations {
+		if strings.HasPrefix(loc, "s3://") {
+			uris, err := listS3Parquet(ctx, loc, region)
+			if err != nil {
+				return nil, err
+			}
+			for _, uri := range uris {
+				inputs = append(inputs, compactInput{Location: uri})
+			}
+			continue
+		}
+		fi, err := os.Stat(loc)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			inputs = append(inputs, compactInput{Location: loc, LocalPath: loc})
+			continue
+		}
+		err = filepath.WalkDir(loc, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && isCompactCandidate(p) {
+				inputs = append(inputs, compactInput{Location: p, LocalPath: p})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inputs, nil
+}
+
+// isCompactCandidate reports whether a listed file looks like a
+// denormalized output rather than a manifest or a normalized table.
+func isCompactCandidate(name string) bool {
+	base := path.Base(filepath.ToSlash(name))
+	if !strings.HasSuffix(base, ".parquet") || strings.HasPrefix(base, "_") {
+		return false
+	}
+	for _, table := range normalizedTables {
+		if strings.HasSuffix(base, "-"+table+".parquet") {
+			return false
+		}
+	}
+	return true
+}
+
+// fetch downloads an S3 input to dir; a local input is left in place.
+func (in *compactInput) fetch(ctx context.Context, dir, region string) error {
+	if in.LocalPath != "" {
+		return nil
+	}
+	f, err := os.CreateTemp(dir, "input-*.parquet")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	in.LocalPath = f.Name()
+	return downloadS3(ctx, in.Location, in.LocalPath, region)
+}
+
+// inspect reads an input's row count from its footer, rejecting normalized
+// tables. An S3 input that hasn't been fetched is read with ranged
+// requests, so only the footer crosses the network.
+func (in *compactInput) inspect(ctx context.Context, region string) error {
+	var r io.ReaderAt
+	var size int64
+	if in.LocalPath != "" {
+		f, err := os.Open(in.LocalPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		r, size = f, fi.Size()
+	} else {
+		obj, err := openS3Object(ctx, in.Location, region)
+		if err != nil {
+			return err
+		}
+		r, size = obj, obj.size
+	}
+	pf, err := openFooter(r, size)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in.Location, err)
+	}
+	in.Rows = pf.NumRows()
+	in.LastUpdatedOn, _ = pf.Lookup(metadataPrefix + "last_updated_on")
+	in.CompactedFrom, _ = pf.Lookup(metadataPrefix + "compacted_from")
+	return nil
+}
+
+// openFooter opens a denormalized Parquet file for its metadata, reading
+// nothing but its footer.
+func openFooter(r io.ReaderAt, size int64) (*parquet.File, error) {
+	pf, err := parquet.OpenFile(r, size,
+		parquet.SkipMagicBytes(true),
+		parquet.SkipPageIndex(true),
+		parquet.SkipBloomFilters(true),
+		parquet.OptimisticRead(true),
+		parquet.ReadBufferSize(64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	if table, ok := pf.Lookup(metadataPrefix + "table"); ok {
+		return nil, fmt.Errorf("a normalized %s table; only denormalized files are supported", table)
+	}
+	return pf, nil
+}
+
+// s3Object reads an S3 object with ranged GetObject requests.
+type s3Object struct {
+	ctx         context.Context
+	client      *s3.Client
+	bucket, key string
+	size        int64
+}
+
+func openS3Object(ctx context.Context, s3URI, region string) (*s3Object, error) {
+	bucket, key, err := parseS3URI(s3URI)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadAWSConfig(ctx, region)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	client := s3.NewFromConfig(cfg)
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return nil, fmt.Errorf("S3 HeadObject %s: %w", s3URI, err)
+	}
+	if head.ContentLength == nil {
+		return nil, fmt.Errorf("S3 HeadObject %s: no Content-Length", s3URI)
+	}
+	return &s3Object{ctx: ctx, client: client, bucket: bucket, key: key, size: *head.ContentLength}, nil
+}
+
+func (o *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), o.size)
+	rng := fmt.Sprintf("bytes=%d-%d", off, end-1)
+	out, err := o.client.GetObject(o.ctx, &s3.GetObjectInput{Bucket: &o.bucket, Key: &o.key, Range: &rng})
+	if err != nil {
+		return 0, fmt.Errorf("S3 GetObject s3://%s/%s: %w", o.bucket, o.key, err)
+	}
+	defer out.Body.Close()
+	n, err := io.ReadFull(out.Body, p[:end-off])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// listS3Parquet lists the Parquet objects under an s3:// prefix.
+func listS3Parquet(ctx context.Context, prefix, region string) ([]string, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(prefix, "s3://"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid S3 prefix %q", prefix)
+	}
+	cfg, err := loadAWSConfig(ctx, region)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	var uris []string
+	p := s3.NewListObjectsV2Paginator(s3.NewFromConfig(cfg), &s3.ListObjectsV2Input{Bucket: &bucket, Prefix: &key})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("S3 ListObjectsV2: %w", err)
+		}
+		for _, obj := range page.Contents {
+			if isCompactCandidate(*obj.Key) {
+				uris = append(uris, "s3://"+bucket+"/"+*obj.Key)
+			}
+		}
+	}
+	return uris, nil
+}
+
+// downloadS3 copies an S3 object to a local file.
+func downloadS3(ctx context.Context, s3URI, localPath, region string) error {
+	bucket, key, err := parseS3URI(s3URI)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadAWSConfig(ctx, region)
+	if err != nil {
+		return fmt.Errorf("load AWS config: %w", err)
+	}
+	out, err := s3.NewFromConfig(cfg).GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return fmt.Errorf("S3 GetObject %s: %w", s3URI, err)
+	}
+	defer out.Body.Close()
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, out.Body); err != nil {
+		f.Close()
+		return fmt.Errorf("download %s: %w", s3URI, err)
+	}
+	return f.Close()
+}
+
+// removeInput deletes a local file or S3 object.
+func removeInput(ctx context.Context, loc, region string) error {
+	if !strings.HasPrefix(loc, "s3://") {
+		return os.Remove(loc)
+	}
+	bucket, key, err := parseS3URI(loc)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadAWSConfig(ctx, region)
+	if err != nil {
+		return fmt.Errorf("load AWS config: %w", err)
+	}
+	if _, err := s3.NewFromConfig(cfg).DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &bucket, Key: &key}); err != nil {
+		return fmt.Errorf("S3 DeleteObject %s: %w", loc, err)
+	}
+	return nil
+}
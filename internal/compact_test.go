@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	// writeInputs converts the tall and wide fixtures into dir, plus a
+	// manifest and a normalized table that compaction must skip.
+	writeInputs := func(t *testing.T) (string, int) {
+		t.Helper()
+		dir := t.TempDir()
+		logPath := filepath.Join(t.TempDir(), "log.jsonl")
+		for _, input := range []string{writeTallCSV(t), writeWideCSV(t)} {
+			if err := ProcessEntry(quietLogger(), input, dir+"/", logPath, "Test", DefaultProcessOptions()); err != nil {
+				t.Fatalf("ProcessEntry: %v", err)
+			}
+		}
+		rows := 0
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.parquet"))
+		for _, p := range matches {
+			rows += len(readParquet(t, p))
+		}
+		if len(matches) != 2 {
+			t.Fatalf("inputs = %v, want 2 files", matches)
+		}
+		os.WriteFile(filepath.Join(dir, manifestIndexName), []byte("not parquet"), 0644)
+		os.WriteFile(filepath.Join(dir, "x-items.parquet"), []byte("not parquet"), 0644)
+		return dir, rows
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		in, want := writeInputs(t)
+		out := t.TempDir()
+		outputs, err := Compact(quietLogger(), CompactOptions{
+			Inputs:    []string{in},
+			OutDir:    out,
+			SortOrder: DefaultSortOrder,
+		})
+		if err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+		if len(outputs) != 1 {
+			t.Fatalf("outputs = %v, want 1 file", outputs)
+		}
+		rows := readParquet(t, outputs[0])
+		if len(rows) != want {
+			t.Errorf("got %d rows, want %d", len(rows), want)
+		}
+		for i := 1; i < len(rows); i++ {
+			if cmpOptStr(rows[i-1].CPTCode, rows[i].CPTCode) > 0 {
+				t.Fatalf("rows not sorted by cpt_code at %d", i)
+			}
+		}
+		md := parquetMetadata(t, outputs[0])
+		if got := strings.Count(md[metadataPrefix+"compacted_from"], "\n") + 1; got != 2 {
+			t.Errorf("compacted_from lists %d inputs, want 2", got)
+		}
+		if got := md[metadataPrefix+"sort_order"]; got != "cpt_code" {
+			t.Errorf("sort_order = %q, want cpt_code", got)
+		}
+		if _, err := os.Stat(filepath.Join(in, manifestIndexName)); err != nil {
+			t.Errorf("inputs touched without DeleteInputs: %v", err)
+		}
+	})
+
+	t.Run("target rows", func(t *testing.T) {
+		in, _ := writeInputs(t)
+		outputs, err := Compact(quietLogger(), CompactOptions{Inputs: []string{in}, OutDir: t.TempDir(), TargetRows: 1})
+		if err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+		if len(outputs) != 2 {
+			t.Errorf("outputs = %v, want one per input", outputs)
+		}
+	})
+
+	t.Run("delete inputs", func(t *testing.T) {
+		in, want := writeInputs(t)
+		outputs, err := Compact(quietLogger(), CompactOptions{Inputs: []string{in}, OutDir: in, DeleteInputs: true})
+		if err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+		matches, _ := filepath.Glob(filepath.Join(in, "*.parquet"))
+		var kept []string
+		for _, p := range matches {
+			if isCompactCandidate(p) {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) != 1 || kept[0] != outputs[0] {
+			t.Errorf("directory holds %v, want only %v", kept, outputs)
+		}
+		if got := len(readParquet(t, outputs[0])); got != want {
+			t.Errorf("got %d rows, want %d", got, want)
+		}
+	})
+
+	t.Run("own root manifest", func(t *testing.T) {
+		in := t.TempDir()
+		logPath := filepath.Join(t.TempDir(), "log.jsonl")
+		start := time.Now()
+		for _, input := range []string{writeTallCSV(t), writeWideCSV(t)} {
+			if err := ProcessEntry(quietLogger(), input, in+"/", logPath, "Test", DefaultProcessOptions()); err != nil {
+				t.Fatalf("ProcessEntry: %v", err)
+			}
+		}
+		if _, err := WriteManifest(quietLogger(), logPath, in, start, ""); err != nil {
+			t.Fatalf("WriteManifest: %v", err)
+		}
+		before, _, _ := readManifest(context.Background(), in, "")
+		outputs, err := Compact(quietLogger(), CompactOptions{Inputs: []string{in}, OutDir: in, DeleteInputs: true})
+		if err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+		m, ok, err := readManifest(context.Background(), in, "")
+		if err != nil || !ok {
+			t.Fatalf("readManifest: %v, %v", ok, err)
+		}
+		if len(m.Files) != 1 || m.Files[0].Path != outputs[0] || len(m.Files[0].CompactedFrom) != 2 {
+			t.Fatalf("manifest lists %+v, want only %s", m.Files, outputs[0])
+		}
+		if m.Rows != before.Rows || m.Hospitals != 2 || m.Files[0].CodeRanges["cpt_code"].Min == "" {
+			t.Errorf("manifest has %d rows, %d hospitals, ranges %v; want %d rows, 2 hospitals, cpt_code range",
+				m.Rows, m.Hospitals, m.Files[0].CodeRanges, before.Rows)
+		}
+		index := readTable[manifestRow](t, filepath.Join(in, manifestIndexName))
+		if len(index) != 1 || index[0].Path != outputs[0] {
+			t.Errorf("manifest index = %+v, want the output", index)
+		}
+	})
+}
+
+func TestCompactHiveRun(t *testing.T) {
+	// writeRun converts the tall and wide fixtures into a Hive-layout run
+	// with a manifest, returning the run root and its files.
+	writeRun := func(t *testing.T) (string, []string) {
+		t.Helper()
+		root := t.TempDir()
+		logPath := filepath.Join(t.TempDir(), "log.jsonl")
+		opts := DefaultProcessOptions()
+		opts.Layout = LayoutHive
+		start := time.Now()
+		for _, input := range []string{writeTallCSV(t), writeWideCSV(t)} {
+			if err := ProcessEntry(quietLogger(), input, root+"/", logPath, "Test", opts); err != nil {
+				t.Fatalf("ProcessEntry: %v", err)
+			}
+		}
+		if _, err := WriteManifest(quietLogger(), logPath, root, start, ""); err != nil {
+			t.Fatalf("WriteManifest: %v", err)
+		}
+		files, _ := filepath.Glob(filepath.Join(root, "state=*", "*", "*.parquet"))
+		if len(files) != 2 {
+			t.Fatalf("run holds %v, want 2 files", files)
+		}
+		return root, files
+	}
+
+	t.Run("into own root", func(t *testing.T) {
+		root, _ := writeRun(t)
+		if _, err := Compact(quietLogger(), CompactOptions{Inputs: []string{root + "/"}, OutDir: root}); err == nil {
+			t.Error("Compact into the root of a hive run succeeded, want error")
+		}
+	})
+
+	t.Run("manifest rewritten", func(t *testing.T) {
+		root, files := writeRun(t)
+		if _, err := Compact(quietLogger(), CompactOptions{Inputs: files[:1], OutDir: t.TempDir(), DeleteInputs: true}); err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+		m, ok, err := readManifest(context.Background(), root, "")
+		if err != nil || !ok {
+			t.Fatalf("readManifest: %v, %v", ok, err)
+		}
+		if len(m.Files) != 1 || m.Files[0].Path != logPath(files[1]) || m.Hospitals != 1 {
+			t.Errorf("manifest lists %+v, want only %s", m.Files, files[1])
+		}
+	})
+
+	t.Run("manifest deleted", func(t *testing.T) {
+		root, _ := writeRun(t)
+		if _, err := Compact(quietLogger(), CompactOptions{Inputs: []string{root}, OutDir: t.TempDir(), DeleteInputs: true}); err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+		for _, name := range []string{manifestJSONName, manifestIndexName} {
+			if _, err := os.Stat(filepath.Join(root, name)); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s still there after deleting every file it lists: %v", name, err)
+			}
+		}
+	})
+}
+
+// countingReaderAt counts the bytes read through it.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestOpenFooter(t *testing.T) {
+	// Enough incompressible rows that the data pages dwarf the footer.
+	out := filepath.Join(t.TempDir(), "out.parquet")
+	w, err := NewChargeWriter(out, DefaultWriterConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]HospitalChargeRow, 20000)
+	for i := range rows {
+		sum := sha256.Sum256([]byte(strconv.Itoa(i)))
+		rows[i] = HospitalChargeRow{HospitalName: "Test", Description: hex.EncodeToString(sum[:])}
+	}
+	w.Write(rows)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+
+	r := &countingReaderAt{r: f}
+	pf, err := openFooter(r, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pf.NumRows(); n != int64(len(rows)) {
+		t.Errorf("NumRows = %d, want %d", n, len(rows))
+	}
+	if r.n > 64*1024 || r.n*10 > fi.Size() {
+		t.Errorf("read %d bytes of a %d-byte file, want only the footer", r.n, fi.Size())
+	}
+}
@@ -3,15 +3,16 @@ package internal
 import (
 	"archive/zip"
 	"bufio"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"mime"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -19,14 +20,16 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	utls "github.com/refraction-networking/utls"
-	"golang.org/x/net/http2"
+	"github.com/klauspost/compress/zstd"
 )
 
 // chargeReader is the common interface for CSV and JSON readers.
@@ -52,7 +55,11 @@ type logEntry struct {
 	StartTime          string          `json:"start_time"`
 	DurationSeconds    float64         `json:"duration_seconds"`
 	Error              string          `json:"error,omitempty"`
+	ErrorKind          string          `json:"error_kind,omitempty"`
 	OutputFile         string          `json:"output_file,omitempty"`
+	OutputFiles        []string        `json:"output_files,omitempty"` // table files of normalized output
+	OutputStats        []fileStats     `json:"output_stats,omitempty"`
+	ArchivePath        string          `json:"archive_path,omitempty"`
 	HospitalName       string          `json:"hospital_name"`
 	LocationNames      []string        `json:"location_names"`
 	HospitalAddresses  []string        `json:"hospital_addresses"`
@@ -63,6 +70,68 @@ type logEntry struct {
 	SchemaVersion      string          `json:"schema_version"`
 	Geocodes           []geocodeResult `json:"geocodes,omitempty"`
 	CMSHPTLocationName string          `json:"cms_hpt_location_name,omitempty"`
+
+	// Source artifact: final URL, response headers and content hashes.
+	Provenance
+}
+
+// ProcessOptions holds the tuning knobs shared by the single and batch
+// subcommands. A zero BatchSize falls back to the default.
+type ProcessOptions struct {
+	BatchSize        int
+	SkipPayerCharges bool
+	S3Region         string // empty = AWS SDK default resolution
+	Download         DownloadPolicy
+
+	// Stream converts URL inputs directly from the HTTP response instead of
+	// downloading them to a temp file first. Zip archives still go through
+	// a temp file. A transfer that fails mid-way can't be resumed.
+	Stream bool
+
+	// Normalized writes hospitals, items, standard_charges and
+	// payer_charges tables (see NormalizedWriter) instead of one
+	// denormalized file.
+	Normalized bool
+
+	// OutputFormat is FormatParquet (the default when empty), FormatNDJSON,
+	// FormatCSV, FormatArrow, FormatDuckDB or FormatPostgres. Writer and Normalized only
+	// apply to Parquet; SortOrder to Parquet and DuckDB. The other formats
+	// keep rows in input order.
+	OutputFormat string
+
+	// Writer tunes compression, page and row group sizes, bloom filters and
+	// column encodings of the Parquet output.
+	Writer WriterConfig
+
+	// SortOrder orders the rows of denormalized output; see ChargeWriter.
+	// The zero value means DefaultSortOrder.
+	SortOrder SortOrder
+
+	// Layout arranges files written to an output directory: LayoutFlat
+	// (the default) or LayoutHive.
+	Layout string
+
+	// Archive is a local directory or s3:// prefix where the raw source of
+	// every URL input is kept, keyed by SHA-256. Empty disables archiving.
+	Archive string
+
+	// DownloadDone, if set, is called once the input has been fetched to a
+	// temp file, before conversion starts, so a caller throttling hosts can
+	// let the next download begin. It isn't called for a streamed input,
+	// which reads from the host until the conversion ends, nor when the
+	// download fails.
+	DownloadDone func()
+}
+
+// DefaultProcessOptions returns the options used when no flags or config
+// file override them.
+func DefaultProcessOptions() ProcessOptions {
+	return ProcessOptions{
+		BatchSize:        10000,
+		SkipPayerCharges: true,
+		Download:         DefaultDownloadPolicy(),
+		Writer:           DefaultWriterConfig(),
+	}
 }
 
 // ProcessEntry handles a single file conversion: URL download, convert, log.
@@ -74,13 +143,25 @@ type logEntry struct {
 //   - A directory (local or S3, ending in "/"): "out/" or "s3://bucket/prefix/"
 //   - Empty: output to current directory with metadata-derived name
 //
+// For FormatDuckDB, outputFile is a local database to append to; a
+// directory or empty outputFile means DuckDBFileName in that directory.
+// For FormatPostgres, outputFile is a postgres:// connection URL.
+//
 // When outputFile is empty or a directory, the filename is derived from
-// hospital metadata: {hospital_name}-{license_number}-{last_updated_on}.parquet
-func ProcessEntry(logger *slog.Logger, inputFile, outputFile, logFile string, batchSize int, skipPayerCharges bool, hospitalName string) error {
+// hospital metadata: {hospital_name}-{license_number}-{last_updated_on}.parquet,
+// with the extension of opts.OutputFormat, placed in a state=/updated=
+// partition directory when opts.Layout is LayoutHive.
+func ProcessEntry(logger *slog.Logger, inputFile, outputFile, logFile, hospitalName string, opts ProcessOptions) error {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultProcessOptions().BatchSize
+	}
 	startTime := time.Now()
 	inputDisplay := inputFile
 	var meta RunMeta
 	var processErr error
+	var source Provenance
+	var archivePath string
+	var outputs []fileStats
 
 	// Always write a log entry when we're done, regardless of success/failure.
 	defer func() {
@@ -110,17 +191,30 @@ func ProcessEntry(logger *slog.Logger, inputFile, outputFile, logFile string, ba
 			LastUpdatedOn:      meta.LastUpdatedOn,
 			SchemaVersion:      meta.Version,
 			CMSHPTLocationName: hospitalName,
+			ArchivePath:        archivePath,
+			Provenance:         source,
 		}
 		if processErr != nil {
 			entry.Error = processErr.Error()
+			entry.ErrorKind = errorKind(processErr)
+			var ce *contentError
+			if entry.FinalURL == "" && errors.As(processErr, &ce) {
+				entry.FinalURL = ce.URL
+			}
 		}
 		if processErr == nil && outputFile != "" {
-			if strings.HasPrefix(outputFile, "s3://") {
-				entry.OutputFile = outputFile
-			} else if abs, err := filepath.Abs(outputFile); err == nil {
-				entry.OutputFile = abs
+			if opts.Normalized {
+				for _, p := range tablePaths(outputFile, true) {
+					entry.OutputFiles = append(entry.OutputFiles, logPath(p))
+				}
 			} else {
-				entry.OutputFile = outputFile
+				entry.OutputFile = logPath(outputFile)
+			}
+			for i, p := range tablePaths(outputFile, opts.Normalized) {
+				if i < len(outputs) {
+					outputs[i].Path = logPath(p)
+					entry.OutputStats = append(entry.OutputStats, outputs[i])
+				}
 			}
 		}
 
@@ -129,16 +223,100 @@ func ProcessEntry(logger *slog.Logger, inputFile, outputFile, logFile string, ba
 		}
 	}()
 
-	// If input is a URL, download to a temp file first.
+	// Raw sources are archived as soon as they're complete, so a file that
+	// fails to convert can still be examined later.
+	archive := func(rawPath string, raw Provenance) {
+		if opts.Archive == "" {
+			return
+		}
+		loc, err := archiveSource(logger, rawPath, raw, opts.Archive, opts.S3Region)
+		if err != nil {
+			logger.Warn("failed to archive source", "error", err)
+			return
+		}
+		archivePath = loc
+		logger.Info("archived source", "dest", loc)
+	}
+
+	// If input is a URL, stream it straight into the converter when asked
+	// to, otherwise download to a temp file first.
 	localInput := inputFile
-	if isURL(inputFile) {
-		localPath, cleanup, err := downloadURL(logger, inputFile)
+	var stream *mrfStream
+	var spool *os.File // copy of the streamed body, for the archive
+	if isURL(inputFile) && opts.Stream {
+		rawURL := httpsURL(inputFile)
+		if opts.Archive != "" {
+			ext := ""
+			if u, err := url.Parse(rawURL); err == nil {
+				ext = path.Ext(u.Path)
+			}
+			f, err := os.CreateTemp("", "hospital-loader-raw-*"+ext)
+			if err != nil {
+				processErr = fmt.Errorf("create temp file: %w", err)
+				return processErr
+			}
+			spool = f
+			defer func() {
+				f.Close()
+				os.Remove(f.Name())
+			}()
+		}
+		logger.Info("streaming", "url", rawURL)
+		s, err := openStream(logger, rawURL, opts.Download, spool)
+		switch {
+		case errors.Is(err, errNeedsFile):
+			logger.Info("content can't be streamed, downloading to temp file")
+		case err != nil:
+			processErr = fmt.Errorf("download %s: %w", inputFile, err)
+			return processErr
+		default:
+			stream = s
+			source = s.Source
+			defer stream.Close()
+		}
+	}
+	if isURL(inputFile) && stream == nil {
+		localPath, downloaded, cleanup, err := downloadURL(logger, inputFile, opts.Download, archive)
 		if err != nil {
 			processErr = fmt.Errorf("download %s: %w", inputFile, err)
 			return processErr
 		}
 		defer cleanup()
 		localInput = localPath
+		source = downloaded
+		if opts.DownloadDone != nil {
+			opts.DownloadDone()
+		}
+	}
+	if !isURL(inputFile) {
+		sum, size, err := hashFile(inputFile)
+		if err != nil {
+			processErr = err
+			return processErr
+		}
+		source.SHA256, source.Size = sum, size
+	}
+
+	// A DuckDB database is appended to in place, and a directory output
+	// holds one database for every hospital written to it.
+	if opts.OutputFormat == FormatDuckDB {
+		if strings.HasPrefix(outputFile, "s3://") {
+			processErr = fmt.Errorf("duckdb output must be a local file or directory, not %s", outputFile)
+			return processErr
+		}
+		if outputFile == "" || strings.HasSuffix(outputFile, "/") {
+			outputFile = filepath.Join(outputFile, DuckDBFileName)
+		}
+	}
+
+	// A database load replaces the hospital's rows in place; there is no
+	// file to name or move.
+	if opts.OutputFormat == FormatPostgres {
+		if !isPostgresURL(outputFile) {
+			processErr = fmt.Errorf("postgres output must be a postgres:// URL, not %q", outputFile)
+			return processErr
+		}
+		outputFile = strings.TrimSuffix(outputFile, "/")
 	}
 
 	// Determine if output is a directory (filename will be derived from metadata).
@@ -152,7 +330,7 @@ func ProcessEntry(logger *slog.Logger, inputFile, outputFile, logFile string, ba
 	localOut := outputFile
 
 	if isS3 || outputIsDir {
-		f, err := os.CreateTemp("", "hospital-loader-*.parquet")
+		f, err := os.CreateTemp("", "hospital-loader-*"+outputExt(opts.OutputFormat))
 		if err != nil {
 			processErr = fmt.Errorf("create temp file: %v", err)
 			return processErr
@@ -160,18 +338,23 @@ func ProcessEntry(logger *slog.Logger, inputFile, outputFile, logFile string, ba
 		tempFile = f.Name()
 		f.Close()
 		localOut = tempFile
-		defer func() {
-			if tempFile != "" {
-				os.Remove(tempFile)
+		removeTemp := func() {
+			if tempFile == "" {
+				return
 			}
-		}()
+			os.Remove(tempFile)
+			if opts.Normalized {
+				for _, p := range tablePaths(tempFile, true) {
+					os.Remove(p)
+				}
+			}
+		}
+		defer removeTemp()
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		go func() {
 			<-sigCh
-			if tempFile != "" {
-				os.Remove(tempFile)
-			}
+			removeTemp()
 			os.Exit(1)
 		}()
 		if isS3 {
@@ -180,14 +363,53 @@ func ProcessEntry(logger *slog.Logger, inputFile, outputFile, logFile string, ba
 	}
 
 	displayOut := outputFile
-	meta, processErr = convert(logger, localInput, inputDisplay, localOut, displayOut, batchSize, skipPayerCharges)
+	if isPostgresURL(outputFile) {
+		displayOut = RedactURL(outputFile)
+	}
+	if stream != nil {
+		// Hashes of a stream are only known once it has been read.
+		info := sourceInfo{Input: inputDisplay, LocationName: hospitalName, Provenance: stream.provenance}
+		meta, processErr = convertFrom(logger, stream, stream.IsJSON, stream.Size, info, localOut, displayOut, opts)
+		if spool != nil {
+			// After a parse error, fetch the rest so the whole file is
+			// kept, unless that means downloading much more of a file
+			// already known to be bad.
+			n, err := io.Copy(io.Discard, io.LimitReader(stream, archiveDrainLimit+1))
+			switch {
+			case err != nil:
+				logger.Warn("source not archived", "error", err)
+			case n > archiveDrainLimit:
+				logger.Warn("source not archived: too much left to fetch after the parse error", "limit_mb", archiveDrainLimit>>20)
+			default:
+				archive(spool.Name(), stream.provenance())
+			}
+		}
+		source = stream.provenance()
+	} else {
+		info := sourceInfo{Input: inputDisplay, LocationName: hospitalName, Provenance: func() Provenance { return source }}
+		meta, processErr = convert(logger, localInput, info, localOut, displayOut, opts)
+	}
 	if processErr != nil {
 		return processErr
 	}
+	// Only Parquet outputs have the statistics the manifest lists.
+	if outputExt(opts.OutputFormat) == outputExt(FormatParquet) {
+		for _, p := range tablePaths(localOut, opts.Normalized) {
+			st, err := parquetFileStats(p)
+			if err != nil {
+				logger.Warn("failed to read output statistics", "error", err)
+				break
+			}
+			outputs = append(outputs, st)
+		}
+	}
 
 	// Resolve the final output filename from metadata.
 	if outputIsDir {
-		filename := buildOutputFilename(meta)
+		filename := buildOutputFilename(meta, outputExt(opts.OutputFormat))
+		if opts.Layout == LayoutHive {
+			filename = partitionDir(meta) + "/" + filename
+		}
 		if isS3 {
 			outputFile = strings.TrimSuffix(outputFile, "/") + "/" + filename
 			s3Dest = outputFile
@@ -196,11 +418,21 @@ func ProcessEntry(logger *slog.Logger, inputFile, outputFile, logFile string, ba
 			if dir == "" {
 				dir = "."
 			}
-			finalPath := filepath.Join(dir, filename)
-			if err := os.Rename(localOut, finalPath); err != nil {
-				processErr = fmt.Errorf("rename output: %w", err)
+			finalPath := filepath.Join(dir, filepath.FromSlash(filename))
+			if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
+				processErr = fmt.Errorf("create output directory: %w", err)
 				return processErr
 			}
+			finalPaths := tablePaths(finalPath, opts.Normalized)
+			for i, p := range tablePaths(localOut, opts.Normalized) {
+				if err := os.Rename(p, finalPaths[i]); err != nil {
+					processErr = fmt.Errorf("rename output: %w", err)
+					return processErr
+				}
+			}
+			if opts.Normalized {
+				os.Remove(tempFile) // placeholder; the tables were written beside it
+			}
 			tempFile = "" // renamed successfully, don't clean up
 			outputFile = finalPath
 		}
@@ -208,20 +440,56 @@ func ProcessEntry(logger *slog.Logger, inputFile, outputFile, logFile string, ba
 	}
 
 	if s3Dest != "" {
-		if err := uploadToS3(logger, context.Background(), localOut, s3Dest); err != nil {
-			processErr = err
-			return processErr
+		dests := tablePaths(s3Dest, opts.Normalized)
+		for i, p := range tablePaths(localOut, opts.Normalized) {
+			if err := uploadToS3(logger, context.Background(), p, dests[i], opts.S3Region); err != nil {
+				processErr = err
+				return processErr
+			}
 		}
 	}
 
 	return nil
 }
 
-func convert(logger *slog.Logger, inputPath, inputDisplay, outputPath, displayPath string, batchSize int, skipPayerCharges bool) (RunMeta, error) {
-	start := time.Now()
-	var meta RunMeta
+// logPath returns an output location as recorded in the log: S3 URIs as
+// given, database URLs without their password, local paths made absolute.
+func logPath(p string) string {
+	if strings.HasPrefix(p, "s3://") {
+		return p
+	}
+	if isPostgresURL(p) {
+		return RedactURL(p)
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
 
+func convert(logger *slog.Logger, inputPath string, info sourceInfo, outputPath, displayPath string, opts ProcessOptions) (RunMeta, error) {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return RunMeta{}, fmt.Errorf("open %s: %w", inputPath, err)
+	}
+	defer f.Close()
+
+	inputSize := int64(0)
+	if fi, err := f.Stat(); err == nil {
+		inputSize = fi.Size()
+	}
 	isJSON := strings.EqualFold(filepath.Ext(inputPath), ".json")
+	return convertFrom(logger, f, isJSON, inputSize, info, outputPath, displayPath, opts)
+}
+
+// convertFrom converts an MRF read from src, which may be a file or a
+// network stream. inputSize is only used for logging (0 = unknown). src is
+// read to the end before the Parquet footer, which describes the run and
+// info's provenance, is written.
+func convertFrom(logger *slog.Logger, src io.Reader, isJSON bool, inputSize int64, info sourceInfo, outputPath, displayPath string, opts ProcessOptions) (RunMeta, error) {
+	batchSize := opts.BatchSize
+	start := time.Now()
+	var meta RunMeta
 
 	var reader chargeReader
 	var csvReader *CSVReader
@@ -229,38 +497,38 @@ func convert(logger *slog.Logger, inputPath, inputDisplay, outputPath, displayPa
 	var err error
 
 	if isJSON {
-		jsonReader, err = NewJSONReader(inputPath)
+		jsonReader, err = NewJSONReaderFrom(src)
 		if err != nil {
 			return meta, fmt.Errorf("open JSON: %w", err)
 		}
-		jsonReader.SkipPayerCharges = skipPayerCharges
+		jsonReader.SkipPayerCharges = opts.SkipPayerCharges
 		reader = jsonReader
 		meta = jsonReader.Meta()
 	} else {
-		csvReader, err = NewCSVReader(inputPath)
+		csvReader, err = NewCSVReaderFrom(src)
 		if err != nil {
 			return meta, fmt.Errorf("open CSV: %w", err)
 		}
-		csvReader.SkipPayerCharges = skipPayerCharges
+		csvReader.SkipPayerCharges = opts.SkipPayerCharges
 		reader = csvReader
 		meta = csvReader.Meta()
 	}
 	defer reader.Close()
 
-	writer, err := NewChargeWriter(outputPath)
+	writer, err := newRowWriter(outputPath, opts)
 	if err != nil {
-		return meta, fmt.Errorf("create Parquet: %w", err)
-	}
-
-	fi, _ := os.Stat(inputPath)
-	inputSize := int64(0)
-	if fi != nil {
-		inputSize = fi.Size()
+		return meta, fmt.Errorf("create output: %w", err)
 	}
+	closed := false
+	defer func() {
+		if !closed {
+			writer.Abort()
+		}
+	}()
 
 	// Log conversion start as a single line with all metadata.
 	attrs := []any{
-		"input", inputDisplay,
+		"input", info.Input,
 		"output", displayPath,
 		"format", reader.Format(),
 	}
@@ -299,7 +567,7 @@ func convert(logger *slog.Logger, inputPath, inputDisplay, outputPath, displayPa
 
 		if len(batch) >= batchSize {
 			if _, err := writer.Write(batch); err != nil {
-				return meta, fmt.Errorf("write Parquet batch: %w", err)
+				return meta, fmt.Errorf("write batch: %w", err)
 			}
 			totalRows += len(batch)
 			batch = batch[:0]
@@ -319,20 +587,29 @@ func convert(logger *slog.Logger, inputPath, inputDisplay, outputPath, displayPa
 	// Flush remaining
 	if len(batch) > 0 {
 		if _, err := writer.Write(batch); err != nil {
-			return meta, fmt.Errorf("write final Parquet batch: %w", err)
+			return meta, fmt.Errorf("write final batch: %w", err)
 		}
 		totalRows += len(batch)
 	}
 
+	// The parsers may stop short of trailing whitespace; read it so a
+	// streamed input's hash covers the whole file.
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return meta, fmt.Errorf("read input: %w", err)
+	}
+	for _, kv := range runKeyValues(info, meta, reader.Format(), inputCount, totalRows, time.Now()) {
+		writer.SetKeyValueMetadata(kv[0], kv[1])
+	}
+
+	closed = true
 	if err := writer.Close(); err != nil {
-		return meta, fmt.Errorf("close Parquet: %w", err)
+		return meta, fmt.Errorf("close output: %w", err)
 	}
 
 	elapsed := time.Since(start)
-	outFi, _ := os.Stat(outputPath)
 	outSize := int64(0)
-	if outFi != nil {
-		outSize = outFi.Size()
+	for _, p := range tablePaths(outputPath, opts.Normalized) {
+		outSize += fileSize(p)
 	}
 
 	// Log completion as a single line with all stats.
@@ -355,10 +632,10 @@ func convert(logger *slog.Logger, inputPath, inputDisplay, outputPath, displayPa
 	return meta, nil
 }
 
-// buildOutputFilename builds a parquet filename from hospital metadata:
-// {hospital_name}-{license_number}-{last_updated_on}.parquet
+// buildOutputFilename builds an output filename from hospital metadata:
+// {hospital_name}-{license_number}-{last_updated_on}{ext}
 // Missing parts are omitted.
-func buildOutputFilename(meta RunMeta) string {
+func buildOutputFilename(meta RunMeta, ext string) string {
 	var parts []string
 
 	name := sanitizeFilename(meta.HospitalName)
@@ -375,7 +652,7 @@ func buildOutputFilename(meta RunMeta) string {
 		parts = append(parts, sanitizeFilename(meta.LastUpdatedOn))
 	}
 
-	return strings.Join(parts, "-") + ".parquet"
+	return strings.Join(parts, "-") + ext
 }
 
 // sanitizeFilename replaces characters that are unsafe in filenames with
@@ -421,7 +698,17 @@ func parseS3URI(uri string) (bucket, key string, err error) {
 	return parts[0], parts[1], nil
 }
 
-func uploadToS3(logger *slog.Logger, ctx context.Context, localPath, s3URI string) error {
+// loadAWSConfig loads the default AWS config, overriding the region when one
+// is given.
+func loadAWSConfig(ctx context.Context, region string) (aws.Config, error) {
+	var optFns []func(*config.LoadOptions) error
+	if region != "" {
+		optFns = append(optFns, config.WithRegion(region))
+	}
+	return config.LoadDefaultConfig(ctx, optFns...)
+}
+
+func uploadToS3(logger *slog.Logger, ctx context.Context, localPath, s3URI, region string) error {
 	bucket, key, err := parseS3URI(s3URI)
 	if err != nil {
 		return err
@@ -443,7 +730,7 @@ func uploadToS3(logger *slog.Logger, ctx context.Context, localPath, s3URI strin
 		"dest", s3URI)
 	start := time.Now()
 
-	cfg, err := config.LoadDefaultConfig(ctx)
+	cfg, err := loadAWSConfig(ctx, region)
 	if err != nil {
 		return fmt.Errorf("load AWS config: %w", err)
 	}
@@ -464,13 +751,13 @@ func uploadToS3(logger *slog.Logger, ctx context.Context, localPath, s3URI strin
 
 // DownloadFromS3 downloads an S3 object to a local temp file.
 // Returns the temp file path and a cleanup function.
-func DownloadFromS3(ctx context.Context, s3URI string) (string, func(), error) {
+func DownloadFromS3(ctx context.Context, s3URI, region string) (string, func(), error) {
 	bucket, key, err := parseS3URI(s3URI)
 	if err != nil {
 		return "", nil, err
 	}
 
-	cfg, err := config.LoadDefaultConfig(ctx)
+	cfg, err := loadAWSConfig(ctx, region)
 	if err != nil {
 		return "", nil, fmt.Errorf("load AWS config: %w", err)
 	}
@@ -502,26 +789,35 @@ func DownloadFromS3(ctx context.Context, s3URI string) (string, func(), error) {
 }
 
 // UploadToS3 uploads a local file to S3.
-func UploadToS3(ctx context.Context, localPath, s3URI string) error {
-	return uploadToS3(slog.Default(), ctx, localPath, s3URI)
+func UploadToS3(ctx context.Context, localPath, s3URI, region string) error {
+	return uploadToS3(slog.Default(), ctx, localPath, s3URI, region)
 }
 
 func isURL(s string) bool {
 	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
 }
 
-// downloadURL downloads a URL to a temp file, preserving the original file
-// extension so format detection works. Returns the temp file path and a
-// cleanup function that removes the temp file.
-func downloadURL(logger *slog.Logger, rawURL string) (localPath string, cleanup func(), err error) {
-	// Upgrade http:// to https:// to avoid WAF/CDN challenges (e.g. Sucuri).
+// httpsURL upgrades http:// to https:// to avoid WAF/CDN challenges
+// (e.g. Sucuri).
+func httpsURL(rawURL string) string {
 	if strings.HasPrefix(rawURL, "http://") {
-		rawURL = "https://" + strings.TrimPrefix(rawURL, "http://")
+		return "https://" + strings.TrimPrefix(rawURL, "http://")
 	}
+	return rawURL
+}
+
+// downloadURL downloads a URL to a temp file, preserving the original file
+// extension so format detection works. Returns the path of the CSV or JSON
+// to convert, the provenance of the download (including the hashes of the
+// raw file and of any file unpacked from it), and a cleanup function that
+// removes the temp files. archive, if not nil, is called with the raw file
+// before it is unpacked.
+func downloadURL(logger *slog.Logger, rawURL string, policy DownloadPolicy, archive func(rawPath string, source Provenance)) (localPath string, source Provenance, cleanup func(), err error) {
+	rawURL = httpsURL(rawURL)
 
 	u, err := url.Parse(rawURL)
 	if err != nil {
-		return "", nil, fmt.Errorf("parse URL: %w", err)
+		return "", Provenance{}, nil, fmt.Errorf("parse URL: %w", err)
 	}
 
 	ext := path.Ext(u.Path)
@@ -531,7 +827,7 @@ func downloadURL(logger *slog.Logger, rawURL string) (localPath string, cleanup
 
 	f, err := os.CreateTemp("", "hospital-loader-*"+ext)
 	if err != nil {
-		return "", nil, fmt.Errorf("create temp file: %w", err)
+		return "", Provenance{}, nil, fmt.Errorf("create temp file: %w", err)
 	}
 	tmpPath := f.Name()
 
@@ -549,43 +845,22 @@ func downloadURL(logger *slog.Logger, rawURL string) (localPath string, cleanup
 	logger.Info("downloading", "url", rawURL)
 	start := time.Now()
 
-	const maxAttempts = 3
-	var result downloadResult
-	var lastErr error
-
-	for attempt := range maxAttempts {
-		if attempt > 0 {
-			backoff := time.Duration(1<<(attempt-1)) * 15 * time.Second // 15s, 30s
-			logger.Info("retrying download", "attempt", attempt+1, "backoff", backoff.String(), "error", lastErr)
-			time.Sleep(backoff)
-			// Truncate the file for a fresh write.
-			if err := f.Truncate(0); err != nil {
-				f.Close()
-				cleanupFn()
-				return "", nil, fmt.Errorf("truncate temp file: %w", err)
-			}
-			if _, err := f.Seek(0, 0); err != nil {
-				f.Close()
-				cleanupFn()
-				return "", nil, fmt.Errorf("seek temp file: %w", err)
-			}
-		}
-
-		result, lastErr = doDownload(f, rawURL)
-		if lastErr == nil {
-			break
-		}
-	}
-
+	result, lastErr := fetchToFile(logger, f, rawURL, policy.ForHost(u.Hostname()))
 	if lastErr != nil {
 		f.Close()
 		cleanupFn()
-		return "", nil, lastErr
+		return "", Provenance{}, nil, lastErr
 	}
 
 	if err := f.Close(); err != nil {
 		cleanupFn()
-		return "", nil, fmt.Errorf("close temp file: %w", err)
+		return "", Provenance{}, nil, fmt.Errorf("close temp file: %w", err)
+	}
+
+	source = result.Source
+	if source.SHA256, source.Size, err = hashFile(tmpPath); err != nil {
+		cleanupFn()
+		return "", Provenance{}, nil, err
 	}
 
 	n := result.N
@@ -610,19 +885,28 @@ func downloadURL(logger *slog.Logger, rawURL string) (localPath string, cleanup
 		}
 	}
 
+	if archive != nil {
+		archive(tmpPath, source)
+	}
+
 	// If the file starts with gzip magic bytes (0x1f 0x8b), decompress it.
 	// Some servers serve .json files that are actually gzip-compressed.
 	if isGzipFile(tmpPath) {
-		decompressed, err := decompressGzipFile(tmpPath)
+		source.InnerFile = gunzippedName(source.FinalURL, result.Filename)
+		decompressed, err := decompressGzipFile(tmpPath, filepath.Ext(source.InnerFile))
 		if err != nil {
 			cleanupFn()
-			return "", nil, fmt.Errorf("decompress gzip: %w", err)
+			return "", Provenance{}, nil, fmt.Errorf("decompress gzip: %w", err)
 		}
 		os.Remove(tmpPath)
 		logger.Info("decompressed gzip",
 			"size_mb", fmt.Sprintf("%.1f", float64(fileSize(decompressed))/1024/1024))
 		tmpPath = decompressed
 		cleanupFn = func() { os.Remove(decompressed) }
+		if source.InnerSHA256, source.InnerSize, err = hashFile(tmpPath); err != nil {
+			cleanupFn()
+			return "", Provenance{}, nil, err
+		}
 	}
 
 	// If the extension is ambiguous (e.g. .aspx, .csv default), sniff the
@@ -641,10 +925,10 @@ func downloadURL(logger *slog.Logger, rawURL string) (localPath string, cleanup
 
 	// If the downloaded file is a zip, extract the first CSV/JSON from it.
 	if strings.HasSuffix(strings.ToLower(tmpPath), ".zip") {
-		extracted, err := extractZip(tmpPath)
+		extracted, member, err := extractZip(tmpPath)
 		if err != nil {
 			cleanupFn()
-			return "", nil, fmt.Errorf("extract zip: %w", err)
+			return "", Provenance{}, nil, fmt.Errorf("extract zip: %w", err)
 		}
 		// Clean up the zip file, return the extracted file instead.
 		os.Remove(tmpPath)
@@ -656,21 +940,27 @@ func downloadURL(logger *slog.Logger, rawURL string) (localPath string, cleanup
 				os.RemoveAll(extractedDir)
 			}
 		}
+		source.InnerFile = member
+		if source.InnerSHA256, source.InnerSize, err = hashFile(extracted); err != nil {
+			extractedCleanup()
+			return "", Provenance{}, nil, err
+		}
 		logger.Info("extracted",
-			"file", filepath.Base(extracted),
-			"size_mb", fmt.Sprintf("%.1f", float64(fileSize(extracted))/1024/1024))
-		return extracted, extractedCleanup, nil
+			"file", member,
+			"size_mb", fmt.Sprintf("%.1f", float64(source.InnerSize)/1024/1024))
+		return extracted, source, extractedCleanup, nil
 	}
 
-	return tmpPath, cleanupFn, nil
+	return tmpPath, source, cleanupFn, nil
 }
 
 // extractZip opens a zip file and extracts the first CSV or JSON file to a
-// temp file. Returns the path to the extracted file.
-func extractZip(zipPath string) (string, error) {
+// temp file. Returns the path to the extracted file and its name in the
+// archive.
+func extractZip(zipPath string) (string, string, error) {
 	r, err := zip.OpenReader(zipPath)
 	if err != nil {
-		return "", fmt.Errorf("open zip: %w", err)
+		return "", "", fmt.Errorf("open zip: %w", err)
 	}
 	defer r.Close()
 
@@ -686,7 +976,7 @@ func extractZip(zipPath string) (string, error) {
 	if target == nil {
 		// Fall back to first file.
 		if len(r.File) == 0 {
-			return "", fmt.Errorf("empty zip archive")
+			return "", "", fmt.Errorf("empty zip archive")
 		}
 		target = r.File[0]
 	}
@@ -700,23 +990,24 @@ func extractZip(zipPath string) (string, error) {
 	if err != nil {
 		// Fallback to system unzip for unsupported compression (e.g. Deflate64).
 		r.Close()
-		return extractZipExternal(zipPath, target.Name)
+		extracted, err := extractZipExternal(zipPath, target.Name)
+		return extracted, target.Name, err
 	}
 	defer rc.Close()
 
 	tmp, err := os.CreateTemp("", "hospital-loader-*"+ext)
 	if err != nil {
-		return "", fmt.Errorf("create temp file: %w", err)
+		return "", "", fmt.Errorf("create temp file: %w", err)
 	}
 
 	if _, err := io.Copy(tmp, rc); err != nil {
 		tmp.Close()
 		os.Remove(tmp.Name())
-		return "", fmt.Errorf("extract %s: %w", target.Name, err)
+		return "", "", fmt.Errorf("extract %s: %w", target.Name, err)
 	}
 	tmp.Close()
 
-	return tmp.Name(), nil
+	return tmp.Name(), target.Name, nil
 }
 
 // extractZipExternal uses the system unzip command to extract a file from a
@@ -743,102 +1034,140 @@ func extractZipExternal(zipPath, targetName string) (string, error) {
 	return extracted, nil
 }
 
-// utlsTransport is an http.RoundTripper that uses a Chrome TLS fingerprint.
-// It checks the negotiated ALPN protocol and delegates to either the HTTP/2
-// or HTTP/1.1 transport accordingly.
-type utlsTransport struct {
-	h1 *http.Transport
-	h2 *http2.Transport
+// archiveDrainLimit caps how much of a streamed input that failed to parse
+// is still fetched to archive it. A variable for tests.
+var archiveDrainLimit int64 = 256 << 20
+
+// progressCheckInterval is how often a running download is checked against
+// the policy's speed limits.
+const progressCheckInterval = 10 * time.Second
+
+// downloadResult holds the result of a single HTTP download.
+type downloadResult struct {
+	N        int64
+	Filename string     // from Content-Disposition, if present
+	Source   Provenance // final URL and response headers; hashes are filled in later
+
+	// Resume support, filled in as soon as response headers arrive so a
+	// failed attempt can still be resumed.
+	AcceptRanges bool   // server advertised "Accept-Ranges: bytes"
+	Validator    string // strong ETag, else Last-Modified; empty if neither
+	Resumed      bool   // this attempt continued a partial download (206)
 }
 
-func (t *utlsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// For non-HTTPS, use default transport.
-	if req.URL.Scheme != "https" {
-		return t.h1.RoundTrip(req)
-	}
+// resumeState describes a partial download to continue with a Range request.
+type resumeState struct {
+	Offset    int64  // bytes already on disk
+	End       int64  // last byte to fetch, inclusive; 0 = to end of file
+	Validator string // sent as If-Range so a changed file restarts from zero
+}
 
-	addr := req.URL.Host
-	if !strings.Contains(addr, ":") {
-		addr += ":443"
-	}
+// fetchToFile downloads rawURL into f, retrying according to policy. Large
+// files on servers that support byte ranges are fetched in parallel chunks.
+// Otherwise, when a transfer fails mid-body and the server supports byte
+// ranges, the next attempt resumes from the bytes already written instead
+// of starting over.
+func fetchToFile(logger *slog.Logger, f *os.File, rawURL string, policy DownloadPolicy) (downloadResult, error) {
+	attempts := max(policy.MaxAttempts, 1)
+	var result downloadResult
+	var resume *resumeState
+	var err error
 
-	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("dial %s: %w", addr, err)
-	}
+	for attempt := 1; ; attempt++ {
+		result, err = doDownload(f, rawURL, policy, resume)
+		var handoff *chunkedHandoff
+		if errors.As(err, &handoff) {
+			result, err = fetchChunked(logger, f, rawURL, handoff.probe, policy)
+			if err == nil {
+				return result, nil
+			}
+			logger.Info("chunked download failed, falling back to single stream", "error", err)
+			if err := resetFile(f); err != nil {
+				return result, err
+			}
+			// The handoff doesn't count as an attempt.
+			policy.Chunks = 1
+			attempt--
+			continue
+		}
+		if err == nil || attempt >= attempts {
+			return result, err
+		}
+		if !policy.isRetryable(err) || !fallBack(err) {
+			logger.Info("download failed, not retrying", "error", err)
+			return result, err
+		}
 
-	host, _, _ := net.SplitHostPort(addr)
-	tlsConn := utls.UClient(conn, &utls.Config{ServerName: host}, utls.HelloChrome_Auto)
-	if err := tlsConn.HandshakeContext(req.Context()); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("TLS handshake: %w", err)
-	}
+		backoff := policy.retryDelay(attempt, err)
+		// An attempt that failed before reaching a body (a dial error, an
+		// error status) left the file alone, so the last resume still holds.
+		if result.Source.FinalURL != "" {
+			resume = nil
+			if result.AcceptRanges && result.Validator != "" {
+				if fi, statErr := f.Stat(); statErr == nil && fi.Size() > 0 {
+					resume = &resumeState{Offset: fi.Size(), Validator: result.Validator}
+				}
+			}
+		}
 
-	alpn := tlsConn.ConnectionState().NegotiatedProtocol
-	if alpn == "h2" {
-		return t.h2.RoundTrip(req)
+		attrs := []any{"attempt", attempt + 1, "backoff", backoff.Round(time.Second).String(), "error", err}
+		if resume != nil {
+			attrs = append(attrs, "resume_from_mb", fmt.Sprintf("%.1f", float64(resume.Offset)/1024/1024))
+		}
+		logger.Info("retrying download", attrs...)
+		time.Sleep(backoff)
+
+		if resume == nil {
+			if err := resetFile(f); err != nil {
+				return result, err
+			}
+		}
 	}
+}
 
-	// HTTP/1.1: write request and read response directly.
-	if err := req.Write(tlsConn); err != nil {
-		tlsConn.Close()
-		return nil, fmt.Errorf("write request: %w", err)
+// resetFile truncates f and rewinds it for a fresh write.
+func resetFile(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return &permanentError{fmt.Errorf("truncate temp file: %w", err)}
 	}
-	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
-	if err != nil {
-		tlsConn.Close()
-		return nil, fmt.Errorf("read response: %w", err)
-	}
-	return resp, nil
-}
-
-var chromeClient = &http.Client{
-	Transport: &utlsTransport{
-		h1: &http.Transport{
-			DialContext: (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
-		},
-		h2: &http2.Transport{
-			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
-				conn, err := net.DialTimeout(network, addr, 30*time.Second)
-				if err != nil {
-					return nil, err
-				}
-				host, _, _ := net.SplitHostPort(addr)
-				tlsConn := utls.UClient(conn, &utls.Config{ServerName: host}, utls.HelloChrome_Auto)
-				if err := tlsConn.HandshakeContext(ctx); err != nil {
-					conn.Close()
-					return nil, err
-				}
-				return tlsConn, nil
-			},
-		},
-	},
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return &permanentError{fmt.Errorf("seek temp file: %w", err)}
+	}
+	return nil
 }
 
-// downloadResult holds the result of a single HTTP download.
-type downloadResult struct {
-	N        int64
-	Filename string // from Content-Disposition, if present
+// newDownloadRequest builds a GET request with the headers of the host's
+// current client profile, chosen from profiles in fallback order.
+func newDownloadRequest(rawURL string, profiles []string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	return withProfile(req, profiles), nil
 }
 
 // doDownload performs a single HTTP GET and writes the response body to w.
-func doDownload(w io.Writer, rawURL string) (downloadResult, error) {
-	req, err := http.NewRequest("GET", rawURL, nil)
+// With a non-nil resume it requests only the given byte range (normally the
+// missing tail of the file); if the server answers with the full body
+// instead (no range support, or the file changed), w must be an *os.File so
+// the partial data can be discarded.
+func doDownload(w io.Writer, rawURL string, policy DownloadPolicy, resume *resumeState) (downloadResult, error) {
+	req, err := newDownloadRequest(rawURL, policy.Profiles)
 	if err != nil {
-		return downloadResult{}, fmt.Errorf("create request: %w", err)
-	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Sec-Ch-Ua", `"Chromium";v="131", "Not_A Brand";v="24"`)
-	req.Header.Set("Sec-Ch-Ua-Mobile", "?0")
-	req.Header.Set("Sec-Ch-Ua-Platform", `"macOS"`)
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "none")
-	req.Header.Set("Sec-Fetch-User", "?1")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
+		return downloadResult{}, &permanentError{err}
+	}
+	if resume != nil {
+		rng := fmt.Sprintf("bytes=%d-", resume.Offset)
+		if resume.End > 0 {
+			rng += strconv.FormatInt(resume.End, 10)
+		}
+		req.Header.Set("Range", rng)
+		if resume.Validator != "" {
+			req.Header.Set("If-Range", resume.Validator)
+		}
+		// Byte offsets refer to the encoded body, so ask for it unencoded.
+		req.Header.Set("Accept-Encoding", "identity")
+	}
 
 	resp, err := chromeClient.Do(req)
 	if err != nil {
@@ -846,52 +1175,105 @@ func doDownload(w io.Writer, rawURL string) (downloadResult, error) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return downloadResult{}, fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
-	}
+	var result downloadResult
+	var totalBytes int64
 
-	// Decompress gzip response body if Content-Encoding indicates gzip.
-	// (When Accept-Encoding is set explicitly, Go's http.Client does NOT
-	// auto-decompress, so we must do it ourselves.)
-	body := resp.Body
-	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
-		gz, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return downloadResult{}, fmt.Errorf("gzip reader: %w", err)
+	switch {
+	case resume != nil && resp.StatusCode == http.StatusPartialContent:
+		start, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != resume.Offset {
+			return downloadResult{Source: responseSource(resp)}, fmt.Errorf("resume: unexpected Content-Range %q for offset %d", resp.Header.Get("Content-Range"), resume.Offset)
+		}
+		if v := responseValidator(resp); v != "" && v != resume.Validator {
+			return downloadResult{Source: responseSource(resp)}, fmt.Errorf("resume: validator changed from %s to %s", resume.Validator, v)
+		}
+		result.Resumed = true
+		totalBytes = resume.Offset
+	case resp.StatusCode == http.StatusOK:
+		if resume != nil {
+			// The server ignored the Range (or the file changed): start over.
+			f, ok := w.(*os.File)
+			if !ok {
+				return downloadResult{}, &permanentError{fmt.Errorf("resume: server sent full body but writer can't be reset")}
+			}
+			if err := resetFile(f); err != nil {
+				return downloadResult{}, err
+			}
+		}
+	default:
+		statusErr := newHTTPStatusError(resp)
+		if body, err := decodeContent(resp.Header.Get("Content-Encoding"), resp.Body); err == nil {
+			defer body.Close()
+			_, head := peekReader(body)
+			if cerr := classifyResponse(resp, head, statusErr); cerr != nil {
+				return downloadResult{}, cerr
+			}
 		}
-		defer gz.Close()
-		body = gz
+		return downloadResult{}, statusErr
+	}
+	result.Source = responseSource(resp)
+
+	// Ranges address the encoded bytes, but we write decoded bytes, so
+	// only identity-encoded bodies can be resumed.
+	contentEncoding := resp.Header.Get("Content-Encoding")
+	result.AcceptRanges = strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") &&
+		(contentEncoding == "" || strings.EqualFold(contentEncoding, "identity"))
+	result.Validator = responseValidator(resp)
+	if result.Resumed && result.Validator == "" {
+		result.Validator = resume.Validator
 	}
 
 	// Extract filename from Content-Disposition header if present.
-	var filename string
 	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
 		if _, params, err := mime.ParseMediaType(cd); err == nil {
-			filename = params["filename"]
+			result.Filename = params["filename"]
 		}
 	}
 
-	// Copy with speed check: after 1 minutes of downloading, if the
-	// estimated remaining time exceeds 10 minutes, abort.
-	const (
-		steadyStateAfter = 1 * time.Minute
-		maxETA           = 10 * time.Minute
-		checkInterval    = 10 * time.Second
-	)
+	if resume == nil {
+		if h := chunkable(resp, result, policy); h != nil {
+			return result, h
+		}
+	}
+
+	body, err := decodeContent(contentEncoding, resp.Body)
+	if err != nil {
+		return result, err
+	}
+	defer body.Close()
+
+	// A full response or the first chunk may be a challenge or login page
+	// instead of the file. (Any other range continues a file that already
+	// passed this check.)
+	var src io.Reader = body
+	if !result.Resumed || resume.Offset == 0 {
+		br, head := peekReader(body)
+		if cerr := classifyResponse(resp, head, nil); cerr != nil {
+			return result, cerr
+		}
+		src = br
+	}
+
+	// Copy with speed check: after policy.SteadyStateAfter of downloading,
+	// abort if the download is too slow to finish within the policy limits.
 
 	contentLength := resp.ContentLength // -1 if unknown
+	if contentLength > 0 {
+		contentLength += totalBytes
+	}
+	resumedBytes := totalBytes
 	dlStart := time.Now()
 	lastCheck := dlStart
-	var totalBytes int64
 
 	buf := make([]byte, 256*1024)
 	for {
-		nr, readErr := body.Read(buf)
+		nr, readErr := src.Read(buf)
 		if nr > 0 {
 			nw, writeErr := w.Write(buf[:nr])
 			totalBytes += int64(nw)
 			if writeErr != nil {
-				return downloadResult{N: totalBytes}, fmt.Errorf("download: %w", writeErr)
+				result.N = totalBytes
+				return result, &permanentError{fmt.Errorf("download: %w", writeErr)}
 			}
 		}
 
@@ -899,33 +1281,145 @@ func doDownload(w io.Writer, rawURL string) (downloadResult, error) {
 			if readErr == io.EOF {
 				break
 			}
-			return downloadResult{N: totalBytes}, fmt.Errorf("download: %w", readErr)
+			result.N = totalBytes
+			return result, fmt.Errorf("download: %w", readErr)
 		}
 
 		now := time.Now()
-		if contentLength > 0 && now.Sub(lastCheck) >= checkInterval {
+		if now.Sub(lastCheck) >= progressCheckInterval {
 			lastCheck = now
-			elapsed := now.Sub(dlStart)
-			if elapsed >= steadyStateAfter {
-				speed := float64(totalBytes) / elapsed.Seconds() // bytes/sec
-				if speed > 0 {
-					remaining := float64(contentLength-totalBytes) / speed
-					eta := time.Duration(remaining) * time.Second
-					if eta > maxETA {
-						return downloadResult{N: totalBytes}, fmt.Errorf(
-							"download too slow: %.1f MB downloaded in %s, ETA %s exceeds %s limit",
-							float64(totalBytes)/1024/1024,
-							elapsed.Round(time.Second),
-							eta.Round(time.Second),
-							maxETA,
-						)
-					}
-				}
+			// Judge speed on this attempt's bytes only.
+			remaining := int64(-1)
+			if contentLength > 0 {
+				remaining = contentLength - resumedBytes
+			}
+			if err := policy.checkProgress(totalBytes-resumedBytes, remaining, now.Sub(dlStart)); err != nil {
+				result.N = totalBytes
+				return result, err
 			}
 		}
 	}
 
-	return downloadResult{N: totalBytes, Filename: filename}, nil
+	if contentLength > 0 && totalBytes < contentLength && contentEncoding == "" {
+		result.N = totalBytes
+		return result, fmt.Errorf("download: %w: got %d of %d bytes", io.ErrUnexpectedEOF, totalBytes, contentLength)
+	}
+
+	result.N = totalBytes
+	return result, nil
+}
+
+// decodeContent wraps an HTTP body in decoders for its Content-Encoding.
+// (When Accept-Encoding is set explicitly, Go's http.Client does NOT
+// auto-decompress, so we must do it ourselves.) Closing the result does not
+// close body. An encoding we can't decode is a permanent error: writing the
+// compressed bytes out would only fail later in the parser.
+func decodeContent(contentEncoding string, body io.Reader) (io.ReadCloser, error) {
+	d := &decodedBody{Reader: body}
+	// Codings are listed in the order they were applied.
+	codings := strings.Split(contentEncoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch coding := strings.ToLower(strings.TrimSpace(codings[i])); coding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			var gz *gzip.Reader
+			if gz, err = gzip.NewReader(d.Reader); err == nil {
+				d.push(gz, gz)
+			}
+		case "deflate":
+			d.push(newDeflateReader(d.Reader))
+		case "br":
+			d.push(brotli.NewReader(d.Reader), nil)
+		case "zstd":
+			// Browsers cap the window at 8 MB for HTTP (RFC 8878).
+			var zr *zstd.Decoder
+			if zr, err = zstd.NewReader(d.Reader, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(8<<20)); err == nil {
+				d.push(zr, zr.IOReadCloser())
+			}
+		default:
+			d.Close()
+			return nil, &permanentError{fmt.Errorf("unsupported Content-Encoding %q", coding)}
+		}
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("%s reader: %w", strings.TrimSpace(codings[i]), err)
+		}
+	}
+	return d, nil
+}
+
+// decodedBody is a chain of content decoders over a response body.
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// push makes r the outermost decoder; c, if not nil, is closed with it.
+func (d *decodedBody) push(r io.Reader, c io.Closer) {
+	d.Reader = r
+	if c != nil {
+		d.closers = append(d.closers, c)
+	}
+}
+
+func (d *decodedBody) Close() error {
+	var errs []error
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		errs = append(errs, d.closers[i].Close())
+	}
+	return errors.Join(errs...)
+}
+
+// newDeflateReader decodes a "deflate" body. The spec says zlib-wrapped,
+// but some servers send a raw DEFLATE stream, so the header is checked.
+func newDeflateReader(r io.Reader) (io.Reader, io.Closer) {
+	br := bufio.NewReader(r)
+	if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+		if zr, err := zlib.NewReader(br); err == nil {
+			return zr, zr
+		}
+	}
+	fr := flate.NewReader(br)
+	return fr, fr
+}
+
+// responseValidator returns the value to send in If-Range for a resumed
+// request: a strong ETag if present, else Last-Modified. Weak ETags can't
+// be used with If-Range.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// parseContentRange parses a Content-Range header such as
+// "bytes 1000-1999/2000" into its first byte position and the complete
+// length (-1 when the server sends "*").
+func parseContentRange(cr string) (start, total int64, err error) {
+	spec, ok := strings.CutPrefix(cr, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported Content-Range %q", cr)
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed Content-Range %q", cr)
+	}
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed Content-Range %q", cr)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("malformed Content-Range %q", cr)
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("malformed Content-Range %q", cr)
+		}
+	}
+	return start, total, nil
 }
 
 // sniffFileType reads the first few bytes of a file to detect if it's JSON
@@ -942,9 +1436,12 @@ func sniffFileType(path string) string {
 	if err != nil || n == 0 {
 		return ""
 	}
+	return sniffContent(buf[:n])
+}
 
+// sniffContent detects JSON vs CSV from the first bytes of a file.
+func sniffContent(content []byte) string {
 	// Skip BOM if present.
-	content := buf[:n]
 	if len(content) >= 3 && content[0] == 0xEF && content[1] == 0xBB && content[2] == 0xBF {
 		content = content[3:]
 	}
@@ -974,9 +1471,9 @@ func isGzipFile(path string) bool {
 	return magic[0] == 0x1f && magic[1] == 0x8b
 }
 
-// decompressGzipFile decompresses a gzip file to a new temp file.
-// Returns the path to the decompressed file.
-func decompressGzipFile(gzPath string) (string, error) {
+// decompressGzipFile decompresses a gzip file to a new temp file with the
+// extension outExt. Returns the path to the decompressed file.
+func decompressGzipFile(gzPath, outExt string) (string, error) {
 	in, err := os.Open(gzPath)
 	if err != nil {
 		return "", err
@@ -989,15 +1486,6 @@ func decompressGzipFile(gzPath string) (string, error) {
 	}
 	defer gz.Close()
 
-	// Determine output extension from the original path (strip .gz if present).
-	outExt := filepath.Ext(gzPath)
-	if strings.EqualFold(outExt, ".gz") {
-		outExt = filepath.Ext(strings.TrimSuffix(gzPath, outExt))
-		if outExt == "" {
-			outExt = ".json"
-		}
-	}
-
 	out, err := os.CreateTemp("", "hospital-gunzip-*"+outExt)
 	if err != nil {
 		return "", err
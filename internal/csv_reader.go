@@ -59,7 +59,7 @@ type payerPlanCols struct {
 // CSVReader streams a CMS V2.x CSV file (Tall or Wide) and emits
 // HospitalChargeRow records one CSV row at a time.
 type CSVReader struct {
-	file    *os.File
+	src     io.Closer // underlying file or stream; nil if not owned
 	csv     *csv.Reader
 	format  csvFormat
 	rowNum  int64
@@ -78,8 +78,19 @@ func NewCSVReader(filepath string) (*CSVReader, error) {
 	if err != nil {
 		return nil, fmt.Errorf("open %s: %w", filepath, err)
 	}
+	r, err := NewCSVReaderFrom(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r.src = file
+	return r, nil
+}
 
-	bufReader := bufio.NewReaderSize(file, 256*1024)
+// NewCSVReaderFrom reads a CSV MRF from a stream, such as an HTTP response
+// body. The caller owns src and must close it after the reader.
+func NewCSVReaderFrom(src io.Reader) (*CSVReader, error) {
+	bufReader := bufio.NewReaderSize(src, 256*1024)
 
 	// Skip UTF-8 BOM if present
 	bom, err := bufReader.Peek(3)
@@ -92,13 +103,11 @@ func NewCSVReader(filepath string) (*CSVReader, error) {
 	reader.FieldsPerRecord = -1
 
 	r := &CSVReader{
-		file:   file,
 		csv:    reader,
 		colIdx: make(map[string]int),
 	}
 
 	if err := r.readHeaders(); err != nil {
-		file.Close()
 		return nil, err
 	}
 
@@ -501,8 +510,8 @@ func (r *CSVReader) Meta() RunMeta {
 }
 
 func (r *CSVReader) Close() error {
-	if r.file != nil {
-		return r.file.Close()
+	if r.src != nil {
+		return r.src.Close()
 	}
 	return nil
 }
@@ -602,6 +611,3 @@ func parseFloat(s string) *float64 {
 	}
 	return &f
 }
-
-// Ensure we use io.EOF for the interface contract.
-var _ = io.EOF
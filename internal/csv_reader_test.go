@@ -84,7 +84,7 @@ func csvToParquet(t *testing.T, csvPath string) (string, []HospitalChargeRow) {
 
 	dir := t.TempDir()
 	parquetPath := filepath.Join(dir, "output.parquet")
-	w, err := NewChargeWriter(parquetPath)
+	w, err := NewChargeWriter(parquetPath, DefaultWriterConfig())
 	if err != nil {
 		t.Fatalf("NewChargeWriter: %v", err)
 	}
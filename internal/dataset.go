@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Output layouts for directory outputs.
+const (
+	// LayoutFlat writes every file straight into the output directory.
+	LayoutFlat = "flat"
+	// LayoutHive nests files under Hive-style partition directories,
+	// state=<license_state>/updated=<last_updated_on>/, so query engines
+	// can prune by state and publication date.
+	LayoutHive = "hive"
+)
+
+// hiveDefaultPartition is the value Hive, Spark and Athena read as NULL
+// when a partition column is unknown.
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// ValidateLayout reports an error for an unknown layout name.
+func ValidateLayout(layout string) error {
+	switch layout {
+	case "", LayoutFlat, LayoutHive:
+		return nil
+	}
+	return fmt.Errorf("unknown output layout %q (want %s or %s)", layout, LayoutFlat, LayoutHive)
+}
+
+// partitionDir returns the slash-separated partition directory for a file
+// in the Hive layout, e.g. "state=NY/updated=2026-02-01".
+func partitionDir(meta RunMeta) string {
+	state := hiveDefaultPartition
+	if meta.LicenseState != nil {
+		if s := sanitizeFilename(*meta.LicenseState); s != "" {
+			state = strings.ToUpper(s)
+		}
+	}
+	updated := hiveDefaultPartition
+	if d := normalizeDate(meta.LastUpdatedOn); d != "" {
+		updated = d
+	}
+	return "state=" + state + "/updated=" + updated
+}
+
+// dateLayouts are the last_updated_on formats seen in published MRFs.
+var dateLayouts = []string{"2006-01-02", "01/02/2006", "1/2/2006", "2006/01/02", "01-02-2006", time.RFC3339}
+
+// normalizeDate returns s as YYYY-MM-DD, or "" when it isn't a date in a
+// known format, so partition values sort and compare as dates.
+func normalizeDate(s string) string {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return ""
+}
+
+// manifestCodeColumns are the code columns whose ranges are recorded per
+// output file, so readers can skip files that can't hold a code.
+var manifestCodeColumns = []string{"cpt_code", "hcpcs_code", "ms_drg_code", "ndc_code", "rc_code"}
+
+// valueRange is the smallest and largest value of a column in a file.
+type valueRange struct {
+	Min string `json:"min"`
+	Max string `json:"max"`
+}
+
+// fileStats describes one written Parquet file.
+type fileStats struct {
+	Path       string                `json:"path"`
+	Table      string                `json:"table,omitempty"` // normalized output only
+	Rows       int64                 `json:"rows"`
+	Bytes      int64                 `json:"bytes"`
+	CodeRanges map[string]valueRange `json:"code_ranges,omitempty"`
+}
+
+// parquetFileStats reads the row count and code column ranges of a
+// Parquet file from its footer.
+func parquetFileStats(path string) (fileStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileStats{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fileStats{}, err
+	}
+	pf, err := parquet.OpenFile(f, fi.Size())
+	if err != nil {
+		return fileStats{}, fmt.Errorf("open %s: %w", path, err)
+	}
+
+	md := pf.Metadata()
+	st := fileStats{Path: path, Rows: md.NumRows, Bytes: fi.Size()}
+	for _, kv := range md.KeyValueMetadata {
+		if kv.Key == metadataPrefix+"table" {
+			st.Table = kv.Value
+		}
+	}
+	for _, rg := range md.RowGroups {
+		for _, col := range rg.Columns {
+			name := strings.Join(col.MetaData.PathInSchema, ".")
+			stats := col.MetaData.Statistics
+			if !slices.Contains(manifestCodeColumns, name) || stats.MinValue == nil || stats.MaxValue == nil {
+				continue
+			}
+			lo, hi := string(stats.MinValue), string(stats.MaxValue)
+			if r, ok := st.CodeRanges[name]; ok {
+				lo, hi = min(lo, r.Min), max(hi, r.Max)
+			}
+			if st.CodeRanges == nil {
+				st.CodeRanges = make(map[string]valueRange)
+			}
+			st.CodeRanges[name] = valueRange{Min: lo, Max: hi}
+		}
+	}
+	return st, nil
+}
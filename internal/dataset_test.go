@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartitionDir(t *testing.T) {
+	for _, tt := range []struct {
+		state, updated string
+		want           string
+	}{
+		{"NY", "2026-02-01", "state=NY/updated=2026-02-01"},
+		{"ny", "02/01/2026", "state=NY/updated=2026-02-01"},
+		{"", "2026-02-01T08:00:00Z", "state=__HIVE_DEFAULT_PARTITION__/updated=2026-02-01"},
+		{"CA", "last spring", "state=CA/updated=__HIVE_DEFAULT_PARTITION__"},
+	} {
+		meta := RunMeta{LastUpdatedOn: tt.updated}
+		if tt.state != "" {
+			meta.LicenseState = &tt.state
+		}
+		if got := partitionDir(meta); got != tt.want {
+			t.Errorf("partitionDir(%q, %q) = %q, want %q", tt.state, tt.updated, got, tt.want)
+		}
+	}
+}
+
+func TestProcessEntryHiveLayout(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultProcessOptions()
+	opts.Layout = LayoutHive
+	if err := ProcessEntry(quietLogger(), writeTallCSV(t), dir+"/", filepath.Join(dir, "log.jsonl"), "Test", opts); err != nil {
+		t.Fatalf("ProcessEntry: %v", err)
+	}
+
+	// The tall test file has no license; its date is 2024-01-15.
+	want := filepath.Join(dir, "state=__HIVE_DEFAULT_PARTITION__", "updated=2024-01-15", "test_general_hospital-2024-01-15.parquet")
+	if _, err := os.Stat(want); err != nil {
+		t.Fatalf("partitioned output: %v", err)
+	}
+	entries, err := readLogEntries(filepath.Join(dir, "log.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].OutputFile != want {
+		t.Errorf("log output_file = %+v, want %s", entries, want)
+	}
+}
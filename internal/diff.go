@@ -0,0 +1,389 @@
+package internal
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Changes in a ChargeChange.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// diffValueColumns are the HospitalChargeRow columns a diff compares. Each
+// has old_ and new_ columns in ChargeChange, and the numeric ones a
+// _pct_change column. Other columns (notes, drug units, ...) are ignored.
+var diffValueColumns = []string{
+	"gross_charge", "discounted_cash", "negotiated_dollar", "negotiated_percentage",
+	"estimated_amount", "min_charge", "max_charge", "methodology", "negotiated_algorithm",
+}
+
+// ChargeChange is a charge added, removed or changed between two versions
+// of a hospital's file. Charges are matched by description, setting,
+// codes, payer and plan. Added charges have only new_ values, removed ones
+// only old_ values; changed ones have both, and the percent change of
+// each amount that had an old value.
+type ChargeChange struct {
+	Change      string  `parquet:"change" json:"change"` // added | removed | changed
+	Description string  `parquet:"description" json:"description"`
+	Setting     string  `parquet:"setting" json:"setting"`
+	Codes       string  `parquet:"codes" json:"codes"` // e.g. CPT:93306|HCPCS:G0389
+	PayerName   *string `parquet:"payer_name,optional" json:"payer_name,omitempty"`
+	PlanName    *string `parquet:"plan_name,optional" json:"plan_name,omitempty"`
+
+	OldGrossCharge          *float64 `parquet:"old_gross_charge,optional" json:"old_gross_charge,omitempty"`
+	NewGrossCharge          *float64 `parquet:"new_gross_charge,optional" json:"new_gross_charge,omitempty"`
+	GrossChargePctChange    *float64 `parquet:"gross_charge_pct_change,optional" json:"gross_charge_pct_change,omitempty"`
+	OldDiscountedCash       *float64 `parquet:"old_discounted_cash,optional" json:"old_discounted_cash,omitempty"`
+	NewDiscountedCash       *float64 `parquet:"new_discounted_cash,optional" json:"new_discounted_cash,omitempty"`
+	DiscountedCashPctChange *float64 `parquet:"discounted_cash_pct_change,optional" json:"discounted_cash_pct_change,omitempty"`
+
+	OldNegotiatedDollar           *float64 `parquet:"old_negotiated_dollar,optional" json:"old_negotiated_dollar,omitempty"`
+	NewNegotiatedDollar           *float64 `parquet:"new_negotiated_dollar,optional" json:"new_negotiated_dollar,omitempty"`
+	NegotiatedDollarPctChange     *float64 `parquet:"negotiated_dollar_pct_change,optional" json:"negotiated_dollar_pct_change,omitempty"`
+	OldNegotiatedPercentage       *float64 `parquet:"old_negotiated_percentage,optional" json:"old_negotiated_percentage,omitempty"`
+	NewNegotiatedPercentage       *float64 `parquet:"new_negotiated_percentage,optional" json:"new_negotiated_percentage,omitempty"`
+	NegotiatedPercentagePctChange *float64 `parquet:"negotiated_percentage_pct_change,optional" json:"negotiated_percentage_pct_change,omitempty"`
+	OldEstimatedAmount            *float64 `parquet:"old_estimated_amount,optional" json:"old_estimated_amount,omitempty"`
+	NewEstimatedAmount            *float64 `parquet:"new_estimated_amount,optional" json:"new_estimated_amount,omitempty"`
+	EstimatedAmountPctChange      *float64 `parquet:"estimated_amount_pct_change,optional" json:"estimated_amount_pct_change,omitempty"`
+
+	OldMinCharge       *float64 `parquet:"old_min_charge,optional" json:"old_min_charge,omitempty"`
+	NewMinCharge       *float64 `parquet:"new_min_charge,optional" json:"new_min_charge,omitempty"`
+	MinChargePctChange *float64 `parquet:"min_charge_pct_change,optional" json:"min_charge_pct_change,omitempty"`
+	OldMaxCharge       *float64 `parquet:"old_max_charge,optional" json:"old_max_charge,omitempty"`
+	NewMaxCharge       *float64 `parquet:"new_max_charge,optional" json:"new_max_charge,omitempty"`
+	MaxChargePctChange *float64 `parquet:"max_charge_pct_change,optional" json:"max_charge_pct_change,omitempty"`
+
+	OldMethodology         *string `parquet:"old_methodology,optional" json:"old_methodology,omitempty"`
+	NewMethodology         *string `parquet:"new_methodology,optional" json:"new_methodology,omitempty"`
+	OldNegotiatedAlgorithm *string `parquet:"old_negotiated_algorithm,optional" json:"old_negotiated_algorithm,omitempty"`
+	NewNegotiatedAlgorithm *string `parquet:"new_negotiated_algorithm,optional" json:"new_negotiated_algorithm,omitempty"`
+}
+
+// DiffSummary counts the changes of a diff.
+type DiffSummary struct {
+	Added, Removed, Changed int
+}
+
+// DiffOptions configures Diff.
+type DiffOptions struct {
+	// Old and New are denormalized output files, local or s3:// URIs.
+	Old, New string
+	// Out is the local path or s3:// URI the changes are written to.
+	Out string
+	// Format is FormatParquet (the default when empty) or "json", one JSON
+	// object per line.
+	Format   string
+	S3Region string
+}
+
+// Diff compares two versions of a hospital's output and writes the
+// charges added, removed and changed between them to opts.Out.
+func Diff(logger *slog.Logger, opts DiffOptions) (DiffSummary, error) {
+	if opts.Format == "" {
+		opts.Format = FormatParquet
+	}
+	if opts.Format != FormatParquet && opts.Format != "json" {
+		return DiffSummary{}, fmt.Errorf("unknown diff format %q (want parquet or json)", opts.Format)
+	}
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp("", "hospital-loader-diff-*")
+	if err != nil {
+		return DiffSummary{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var versions [2][]HospitalChargeRow
+	for i, loc := range []string{opts.Old, opts.New} {
+		in := compactInput{Location: loc}
+		if !strings.HasPrefix(loc, "s3://") {
+			in.LocalPath = loc
+		}
+		if err := in.fetch(ctx, tmpDir, opts.S3Region); err != nil {
+			return DiffSummary{}, err
+		}
+		if versions[i], err = readChargeRows(in.LocalPath); err != nil {
+			return DiffSummary{}, fmt.Errorf("read %s: %w", loc, err)
+		}
+	}
+	if o, n := versions[0], versions[1]; len(o) > 0 && len(n) > 0 && o[0].HospitalName != n[0].HospitalName {
+		logger.Warn("comparing different hospitals", "old", o[0].HospitalName, "new", n[0].HospitalName)
+	}
+
+	changes := DiffCharges(versions[0], versions[1])
+	var summary DiffSummary
+	for _, c := range changes {
+		switch c.Change {
+		case ChangeAdded:
+			summary.Added++
+		case ChangeRemoved:
+			summary.Removed++
+		case ChangeChanged:
+			summary.Changed++
+		}
+	}
+
+	localOut := opts.Out
+	if strings.HasPrefix(opts.Out, "s3://") {
+		localOut = filepath.Join(tmpDir, "diff")
+	}
+	if opts.Format == FormatParquet {
+		err = writeChargeChanges(localOut, changes, opts)
+	} else {
+		err = writeChargeChangesJSON(localOut, changes)
+	}
+	if err != nil {
+		return summary, fmt.Errorf("write %s: %w", opts.Out, err)
+	}
+	if localOut != opts.Out {
+		if err := uploadToS3(logger, ctx, localOut, opts.Out, opts.S3Region); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+// DiffCharges matches the charges of two versions of a hospital's file by
+// description, setting, codes, payer and plan and returns those added,
+// removed or changed, ordered by those keys.
+func DiffCharges(old, new []HospitalChargeRow) []ChargeChange {
+	var changes []ChargeChange
+	matchCharges(old, new, func(o, n *HospitalChargeRow) {
+		change := ChangeChanged
+		switch {
+		case n == nil:
+			change = ChangeRemoved
+		case o == nil:
+			change = ChangeAdded
+		}
+		changes = append(changes, newChargeChange(change, o, n))
+	})
+	slices.SortStableFunc(changes, func(a, b ChargeChange) int {
+		return cmp.Or(
+			strings.Compare(a.Description, b.Description),
+			strings.Compare(a.Setting, b.Setting),
+			strings.Compare(a.Codes, b.Codes),
+			cmpOptStr(a.PayerName, b.PayerName),
+			cmpOptStr(a.PlanName, b.PlanName),
+		)
+	})
+	return changes
+}
+
+// matchCharges matches old and new charges by diffKey and calls changed
+// for each pair whose diffValues differ, with a nil old for added charges
+// and a nil new for removed ones.
+//
+// Files may list the same key more than once (for modifiers, say). Such
+// charges are paired up after setting aside those that are unchanged, and
+// any left over are added or removed.
+func matchCharges(old, new []HospitalChargeRow, changed func(old, new *HospitalChargeRow)) {
+	type group struct{ old, new []*HospitalChargeRow }
+	groups := make(map[string]*group)
+	var keys []string
+	for side, rows := range [][]HospitalChargeRow{old, new} {
+		for i := range rows {
+			k := diffKey(&rows[i])
+			g, ok := groups[k]
+			if !ok {
+				g = &group{}
+				groups[k] = g
+				keys = append(keys, k)
+			}
+			if side == 0 {
+				g.old = append(g.old, &rows[i])
+			} else {
+				g.new = append(g.new, &rows[i])
+			}
+		}
+	}
+
+	for _, k := range keys {
+		g := groups[k]
+		// Set aside as many unchanged pairs per set of values as both sides
+		// have, taking the first old rows with those values.
+		sigs := make([]string, len(g.old))
+		oldCount := make(map[string]int)
+		for i, o := range g.old {
+			sigs[i] = diffValues(o)
+			oldCount[sigs[i]]++
+		}
+		same := make(map[string]int)
+		var news []*HospitalChargeRow
+		for _, n := range g.new {
+			if sig := diffValues(n); same[sig] < oldCount[sig] {
+				same[sig]++
+				continue
+			}
+			news = append(news, n)
+		}
+		var olds []*HospitalChargeRow
+		for i, o := range g.old {
+			if same[sigs[i]] > 0 {
+				same[sigs[i]]--
+				continue
+			}
+			olds = append(olds, o)
+		}
+		for i := range max(len(olds), len(news)) {
+			switch {
+			case i >= len(news):
+				changed(olds[i], nil)
+			case i >= len(olds):
+				changed(nil, news[i])
+			default:
+				changed(olds[i], news[i])
+			}
+		}
+	}
+}
+
+// diffKey returns the key diff matches charges by.
+func diffKey(row *HospitalChargeRow) string {
+	return strings.Join([]string{row.Description, row.Setting, chargeCodes(row), derefOr(row.PayerName), derefOr(row.PlanName)}, "\x00")
+}
+
+// diffValues returns the values a diff compares, as one comparable string.
+func diffValues(row *HospitalChargeRow) string {
+	v := reflect.ValueOf(row).Elem()
+	var b strings.Builder
+	for _, name := range diffValueColumns {
+		if f, ok := chargeColumnsByName[name].value(v); ok {
+			fmt.Fprint(&b, f.Interface())
+		}
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// chargeCodes lists a row's codes as TYPE:code, joined by "|", in schema
+// order.
+func chargeCodes(row *HospitalChargeRow) string {
+	v := reflect.ValueOf(row).Elem()
+	var codes []string
+	for _, col := range chargeColumns {
+		name, ok := strings.CutSuffix(col.name, "_code")
+		if !ok {
+			continue
+		}
+		if f, ok := col.value(v); ok {
+			codes = append(codes, strings.ToUpper(strings.ReplaceAll(name, "_", "-"))+":"+f.String())
+		}
+	}
+	return strings.Join(codes, "|")
+}
+
+func derefOr(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+var (
+	chargeColumnsByName = columnsByName(chargeColumns)
+	chargeChangeColumns = columnsByName(rowColumnsOf(reflect.TypeFor[ChargeChange]()))
+)
+
+func columnsByName(columns []rowColumn) map[string]rowColumn {
+	m := make(map[string]rowColumn, len(columns))
+	for _, col := range columns {
+		m[col.name] = col
+	}
+	return m
+}
+
+// newChargeChange builds a change from the old and new versions of a
+// charge, either of which may be nil.
+func newChargeChange(change string, old, new *HospitalChargeRow) ChargeChange {
+	row := old
+	if row == nil {
+		row = new
+	}
+	c := ChargeChange{
+		Change:      change,
+		Description: row.Description,
+		Setting:     row.Setting,
+		Codes:       chargeCodes(row),
+		PayerName:   row.PayerName,
+		PlanName:    row.PlanName,
+	}
+	cv := reflect.ValueOf(&c).Elem()
+	for _, name := range diffValueColumns {
+		col := chargeColumnsByName[name]
+		var values [2]reflect.Value
+		for i, r := range []*HospitalChargeRow{old, new} {
+			if r == nil {
+				continue
+			}
+			rv := reflect.ValueOf(r).Elem()
+			if f, ok := col.value(rv); ok {
+				values[i] = f
+				side := [...]string{"old_", "new_"}[i]
+				cv.Field(chargeChangeColumns[side+name].field).Set(rv.Field(col.field))
+			}
+		}
+		pct, ok := chargeChangeColumns[name+"_pct_change"]
+		if ok && values[0].IsValid() && values[1].IsValid() && values[0].Float() != 0 {
+			p := (values[1].Float() - values[0].Float()) / values[0].Float() * 100
+			cv.Field(pct.field).Set(reflect.ValueOf(&p))
+		}
+	}
+	return c
+}
+
+// writeChargeChanges writes changes as a Parquet file.
+func writeChargeChanges(path string, changes []ChargeChange, opts DiffOptions) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := parquet.NewGenericWriter[ChargeChange](f, DefaultWriterConfig().options(reflect.TypeFor[ChargeChange](), nil)...)
+	w.SetKeyValueMetadata(metadataPrefix+"tool_version", ToolVersion)
+	w.SetKeyValueMetadata(metadataPrefix+"diff.old", opts.Old)
+	w.SetKeyValueMetadata(metadataPrefix+"diff.new", opts.New)
+	if _, err := w.Write(changes); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeChargeChangesJSON writes changes as one JSON object per line.
+func writeChargeChangesJSON(path string, changes []ChargeChange) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(f)
+	enc := json.NewEncoder(buf)
+	for i := range changes {
+		if err := enc.Encode(&changes[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
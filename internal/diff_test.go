@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestDiffCharges(t *testing.T) {
+	charge := func(desc, payer string, dollar float64) HospitalChargeRow {
+		return HospitalChargeRow{
+			Description:      desc,
+			Setting:          "outpatient",
+			CPTCode:          strPtr("93306"),
+			PayerName:        strPtr(payer),
+			PlanName:         strPtr("PPO"),
+			NegotiatedDollar: &dollar,
+			Methodology:      strPtr("fee_schedule"),
+		}
+	}
+	old := []HospitalChargeRow{
+		charge("ECHO", "Aetna", 900),
+		charge("ECHO", "Cigna", 1000),
+		charge("XRAY", "Aetna", 100),
+		charge("XRAY", "Aetna", 200), // same key twice
+	}
+	new := []HospitalChargeRow{
+		charge("ECHO", "Aetna", 990),
+		charge("MRI", "Aetna", 3000),
+		charge("XRAY", "Aetna", 200),
+		charge("XRAY", "Aetna", 100),
+	}
+
+	changes := DiffCharges(old, new)
+	if len(changes) != 3 {
+		t.Fatalf("got %d changes, want 3: %+v", len(changes), changes)
+	}
+	c := changes[0]
+	if c.Change != ChangeChanged || c.Description != "ECHO" || *c.PayerName != "Aetna" || c.Codes != "CPT:93306" {
+		t.Errorf("changes[0] = %+v, want ECHO/Aetna changed", c)
+	}
+	if *c.OldNegotiatedDollar != 900 || *c.NewNegotiatedDollar != 990 || *c.NegotiatedDollarPctChange != 10 {
+		t.Errorf("negotiated_dollar %v -> %v (%v%%), want 900 -> 990 (10%%)",
+			*c.OldNegotiatedDollar, *c.NewNegotiatedDollar, *c.NegotiatedDollarPctChange)
+	}
+	if *c.OldMethodology != "fee_schedule" || c.GrossChargePctChange != nil {
+		t.Errorf("methodology %v, gross pct change %v", c.OldMethodology, c.GrossChargePctChange)
+	}
+	if c := changes[1]; c.Change != ChangeRemoved || *c.PayerName != "Cigna" || c.OldNegotiatedDollar == nil || c.NewNegotiatedDollar != nil {
+		t.Errorf("changes[1] = %+v, want ECHO/Cigna removed", c)
+	}
+	if c := changes[2]; c.Change != ChangeAdded || c.Description != "MRI" || c.OldNegotiatedDollar != nil || *c.NewNegotiatedDollar != 3000 {
+		t.Errorf("changes[2] = %+v, want MRI added", c)
+	}
+}
+
+// TestDiffChargesRepeatedKey diffs a file that lists one key many times,
+// reordered, which must not compare every old row with every new one.
+func TestDiffChargesRepeatedKey(t *testing.T) {
+	const n = 20000
+	old := make([]HospitalChargeRow, n)
+	new := make([]HospitalChargeRow, n)
+	for i := range n {
+		dollar := float64(i)
+		old[i] = HospitalChargeRow{Description: "DRUG", Setting: "inpatient", NegotiatedDollar: &dollar}
+		new[n-1-i] = old[i]
+	}
+	changed := -1.0
+	new[0].NegotiatedDollar = &changed
+
+	changes := DiffCharges(old, new)
+	if len(changes) != 1 || *changes[0].OldNegotiatedDollar != n-1 || *changes[0].NewNegotiatedDollar != -1 {
+		t.Errorf("got %d changes, want %d -> -1: %+v", len(changes), n-1, changes)
+	}
+}
+
+// convertCharges converts a tall CSV of Test General Hospital, dated
+// lastUpdated, with the given rows of description, setting, CPT code,
+// gross, cash, min, max, payer, plan, negotiated dollar and methodology,
+// keeping payer charges. Returns the Parquet output.
+func convertCharges(t *testing.T, lastUpdated, rows string) string {
+	t.Helper()
+	dir := t.TempDir()
+	in := filepath.Join(dir, "charges.csv")
+	content := `hospital_name,last_updated_on,version,hospital_location,hospital_address
+Test General Hospital,` + lastUpdated + `,2.0.0,"New York, NY","123 Main St"
+description,setting,code|1,code|1|type,standard_charge|gross,standard_charge|discounted_cash,standard_charge|min,standard_charge|max,payer_name,plan_name,standard_charge|negotiated_dollar,standard_charge|methodology
+`
+	for _, line := range strings.Split(strings.TrimSpace(rows), "\n") {
+		desc, rest, _ := strings.Cut(strings.TrimSpace(line), ",")
+		setting, rest, _ := strings.Cut(rest, ",")
+		code, rest, _ := strings.Cut(rest, ",")
+		content += desc + "," + setting + "," + code + ",CPT," + rest + "\n"
+	}
+	if err := os.WriteFile(in, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "charges.parquet")
+	opts := DefaultProcessOptions()
+	opts.SkipPayerCharges = false
+	if err := ProcessEntry(quietLogger(), in, out, filepath.Join(dir, "log.jsonl"), "Test", opts); err != nil {
+		t.Fatalf("ProcessEntry: %v", err)
+	}
+	return out
+}
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	old := convertCharges(t, "2024-01-15", `
+		ECHO,outpatient,93306,1500,750,500,2000,Aetna,PPO,900,fee_schedule
+		XRAY,outpatient,71046,250,125,80,300,Aetna,PPO,150,fee_schedule`)
+	new := convertCharges(t, "2024-02-15", `
+		ECHO,outpatient,93306,1500,750,500,2000,Aetna,PPO,1080,fee_schedule
+		XRAY,outpatient,71046,250,125,80,300,Aetna,PPO,150,fee_schedule
+		MRI,inpatient,70553,3500,1750,1200,4000,Aetna,PPO,2200,per_diem`)
+
+	t.Run("parquet", func(t *testing.T) {
+		out := filepath.Join(dir, "changes.parquet")
+		summary, err := Diff(quietLogger(), DiffOptions{Old: old, New: new, Out: out})
+		if err != nil {
+			t.Fatalf("Diff: %v", err)
+		}
+		if summary != (DiffSummary{Added: 1, Changed: 1}) {
+			t.Errorf("summary = %+v, want 1 added, 1 changed", summary)
+		}
+		rows, err := parquet.ReadFile[ChargeChange](out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 || rows[0].Description != "ECHO" || *rows[0].NegotiatedDollarPctChange != 20 || rows[1].Change != ChangeAdded {
+			t.Errorf("rows = %+v", rows)
+		}
+		if md := parquetMetadata(t, out); md[metadataPrefix+"diff.old"] != old {
+			t.Errorf("diff.old = %q, want %q", md[metadataPrefix+"diff.old"], old)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		out := filepath.Join(dir, "changes.jsonl")
+		if _, err := Diff(quietLogger(), DiffOptions{Old: old, New: new, Out: out, Format: "json"}); err != nil {
+			t.Fatalf("Diff: %v", err)
+		}
+		f, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var changes []map[string]any
+		for sc := bufio.NewScanner(f); sc.Scan(); {
+			var c map[string]any
+			if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+				t.Fatal(err)
+			}
+			changes = append(changes, c)
+		}
+		if len(changes) != 2 || changes[1]["change"] != ChangeAdded || changes[1]["new_methodology"] != "per_diem" {
+			t.Errorf("changes = %v", changes)
+		}
+		if _, ok := changes[1]["old_negotiated_dollar"]; ok {
+			t.Error("added charge has an old value")
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		if _, err := Diff(quietLogger(), DiffOptions{Old: old, New: new, Out: filepath.Join(dir, "x"), Format: "xml"}); err == nil {
+			t.Error("Diff succeeded, want error")
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DownloadPolicy controls how long a download may take and how failed
+// downloads are retried. Large health systems publish multi-GB files that
+// legitimately take an hour, so every limit is configurable and can be
+// overridden per host.
+type DownloadPolicy struct {
+	// SteadyStateAfter is how long to download before judging throughput.
+	SteadyStateAfter time.Duration
+	// MaxETA aborts the download when the estimated time remaining exceeds
+	// it (0 = never). Only applies when the server sends Content-Length.
+	MaxETA time.Duration
+	// MinSpeedMBs aborts the download when the average speed after
+	// SteadyStateAfter falls below this many MB/s (0 = never).
+	MinSpeedMBs float64
+
+	// MaxAttempts is the total number of tries, including the first.
+	MaxAttempts int
+	// Backoff is the wait before the second attempt; it doubles for each
+	// further attempt up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter randomizes each wait by ±Jitter (a fraction, 0.2 = ±20%) so
+	// parallel workers don't retry a struggling CDN in lockstep.
+	Jitter float64
+
+	// Chunks is the number of concurrent ranged requests used for files of
+	// at least ChunkMinSize bytes on servers that support byte ranges
+	// (<= 1 = always single stream).
+	Chunks       int
+	ChunkMinSize int64
+
+	// Profiles lists client profiles (chrome, firefox, safari) in fallback
+	// order. A host that blocks one is retried with the next.
+	Profiles []string
+
+	// Hosts holds per-host overrides, keyed by hostname. A key also matches
+	// its subdomains ("hcadam.com" applies to "www.hcadam.com").
+	Hosts map[string]DownloadPolicy
+}
+
+// DefaultDownloadPolicy returns the policy used when nothing overrides it:
+// after 1 minute of downloading, abort if the ETA exceeds 10 minutes, and
+// try up to 3 times with 15s, 30s backoff. Files of 256 MB or more are
+// fetched in 4 parallel chunks when the server allows it. Requests look like
+// Chrome, falling back to Firefox and then Safari when blocked.
+func DefaultDownloadPolicy() DownloadPolicy {
+	return DownloadPolicy{
+		SteadyStateAfter: 1 * time.Minute,
+		MaxETA:           10 * time.Minute,
+		MaxAttempts:      3,
+		Backoff:          15 * time.Second,
+		MaxBackoff:       5 * time.Minute,
+		Jitter:           0.2,
+		Chunks:           4,
+		ChunkMinSize:     256 * 1024 * 1024,
+		Profiles:         slices.Clone(defaultProfiles),
+	}
+}
+
+// ForHost returns the policy for a hostname, applying the most specific
+// matching override.
+func (p DownloadPolicy) ForHost(host string) DownloadPolicy {
+	host = strings.ToLower(host)
+	best := ""
+	for h := range p.Hosts {
+		if (host == h || strings.HasSuffix(host, "."+h)) && len(h) > len(best) {
+			best = h
+		}
+	}
+	if best == "" {
+		return p
+	}
+	hp := p.Hosts[best]
+	hp.Hosts = nil
+	return hp
+}
+
+// SetHostOverride parses a per-host override of the form
+// "host:key=value;key=value" and stores it in p.Hosts. Unset keys inherit
+// from p, so call this after the base policy is final.
+//
+// Keys: steady-state-after, max-eta, min-speed, attempts, backoff,
+// max-backoff, jitter, chunks, chunk-min-mb, profiles (separated by "|",
+// e.g. profiles=firefox|safari).
+func (p *DownloadPolicy) SetHostOverride(spec string) error {
+	host, settings, ok := strings.Cut(spec, ":")
+	host = strings.ToLower(strings.TrimSpace(host))
+	if !ok || host == "" {
+		return fmt.Errorf("host policy %q: want host:key=value;...", spec)
+	}
+
+	hp := *p
+	hp.Hosts = nil
+	for _, kv := range strings.Split(settings, ";") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("host policy %q: %q is not key=value", spec, kv)
+		}
+		if err := hp.set(strings.TrimSpace(key), strings.TrimSpace(val)); err != nil {
+			return fmt.Errorf("host policy %q: %w", spec, err)
+		}
+	}
+
+	if p.Hosts == nil {
+		p.Hosts = make(map[string]DownloadPolicy)
+	}
+	p.Hosts[host] = hp
+	return nil
+}
+
+func (p *DownloadPolicy) set(key, val string) error {
+	var err error
+	switch key {
+	case "steady-state-after":
+		p.SteadyStateAfter, err = time.ParseDuration(val)
+	case "max-eta":
+		p.MaxETA, err = time.ParseDuration(val)
+	case "min-speed":
+		p.MinSpeedMBs, err = strconv.ParseFloat(val, 64)
+	case "attempts":
+		p.MaxAttempts, err = strconv.Atoi(val)
+	case "backoff":
+		p.Backoff, err = time.ParseDuration(val)
+	case "max-backoff":
+		p.MaxBackoff, err = time.ParseDuration(val)
+	case "jitter":
+		p.Jitter, err = strconv.ParseFloat(val, 64)
+	case "chunks":
+		p.Chunks, err = strconv.Atoi(val)
+	case "chunk-min-mb":
+		var mb int64
+		mb, err = strconv.ParseInt(val, 10, 64)
+		p.ChunkMinSize = mb * 1024 * 1024
+	case "profiles":
+		p.Profiles = strings.Split(val, "|")
+		err = ValidateProfiles(p.Profiles)
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+// retryDelay returns how long to wait after the given failed attempt
+// (1-based). A server-supplied Retry-After wins when it is longer, up to
+// MaxBackoff; isRetryable gives up on one asking for more.
+func (p DownloadPolicy) retryDelay(attempt int, err error) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+
+	var se *httpStatusError
+	if errors.As(err, &se) && se.RetryAfter > d {
+		d = se.RetryAfter
+		if p.MaxBackoff > 0 && d > p.MaxBackoff {
+			d = p.MaxBackoff
+		}
+	}
+	return d
+}
+
+// checkProgress returns an error when a download in progress is too slow
+// to finish within the policy limits. contentLength is -1 when unknown.
+func (p DownloadPolicy) checkProgress(totalBytes, contentLength int64, elapsed time.Duration) error {
+	if elapsed < p.SteadyStateAfter {
+		return nil
+	}
+	speed := float64(totalBytes) / elapsed.Seconds() // bytes/sec
+
+	if p.MinSpeedMBs > 0 && speed/1024/1024 < p.MinSpeedMBs {
+		return fmt.Errorf(
+			"download too slow: %.1f MB downloaded in %s, %.2f MB/s below %.2f MB/s minimum",
+			float64(totalBytes)/1024/1024,
+			elapsed.Round(time.Second),
+			speed/1024/1024,
+			p.MinSpeedMBs,
+		)
+	}
+
+	if p.MaxETA > 0 && contentLength > 0 && speed > 0 {
+		remaining := float64(contentLength-totalBytes) / speed
+		eta := time.Duration(remaining) * time.Second
+		if eta > p.MaxETA {
+			return fmt.Errorf(
+				"download too slow: %.1f MB downloaded in %s, ETA %s exceeds %s limit",
+				float64(totalBytes)/1024/1024,
+				elapsed.Round(time.Second),
+				eta.Round(time.Second),
+				p.MaxETA,
+			)
+		}
+	}
+	return nil
+}
+
+// httpStatusError is returned when the server answers with a non-success
+// status code.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // from the Retry-After header, if any
+}
+
+func (e *httpStatusError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("HTTP %d: %s (Retry-After %s)", e.StatusCode, e.Status, e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Status)
+}
+
+// newHTTPStatusError builds an httpStatusError from a response.
+func newHTTPStatusError(resp *http.Response) *httpStatusError {
+	e := &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	if ra := resp.Header.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(ra); err == nil {
+			e.RetryAfter = time.Until(t)
+		}
+	}
+	return e
+}
+
+// permanentError marks a failure that retrying can't fix, such as a full
+// disk or a malformed URL.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// isRetryable classifies a download error for this policy. Client errors (4xx) other than
+// 408 Request Timeout and 429 Too Many Requests are final; server errors,
+// timeouts, dropped connections and slow downloads are worth another try.
+// A 403 is also retried when there is another proxy to send it through,
+// and a challenge page when fallBack finds another proxy or client profile;
+// other HTML pages are final. So is a Retry-After longer
+// than MaxBackoff: a server that wants hours doesn't get a worker for them.
+func (p DownloadPolicy) isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pe *permanentError
+	if errors.As(err, &pe) {
+		return false
+	}
+	var ce *contentError
+	if errors.As(err, &ce) {
+		// A challenge may pass with another proxy or client profile (the
+		// retry loop's fallBack decides); a web page won't turn into an MRF.
+		return ce.Kind == errorKindBlocked
+	}
+	var se *httpStatusError
+	if errors.As(err, &se) {
+		switch {
+		case p.MaxBackoff > 0 && se.RetryAfter > p.MaxBackoff:
+			return false
+		case se.StatusCode == http.StatusRequestTimeout, se.StatusCode == http.StatusTooManyRequests:
+			return true
+		case se.StatusCode == http.StatusForbidden && downloadProxies.Len() > 1:
+			return true
+		case se.StatusCode >= 400 && se.StatusCode < 500:
+			return false
+		}
+		return true
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDoDownloadErrorClassification(t *testing.T) {
+	tests := []struct {
+		status    int
+		retryable bool
+	}{
+		{http.StatusNotFound, false},
+		{http.StatusForbidden, false},
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+	}
+
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		_, err := doDownload(io.Discard, srv.URL, DefaultDownloadPolicy(), nil)
+		srv.Close()
+
+		if err == nil {
+			t.Fatalf("HTTP %d: expected error", tt.status)
+		}
+		if got := DefaultDownloadPolicy().isRetryable(err); got != tt.retryable {
+			t.Errorf("HTTP %d: isRetryable = %v, want %v (err: %v)", tt.status, got, tt.retryable, err)
+		}
+	}
+}
+
+func TestDownloadPolicyForHost(t *testing.T) {
+	p := DefaultDownloadPolicy()
+	if err := p.SetHostOverride("hcadam.com:max-eta=1h;attempts=5"); err != nil {
+		t.Fatalf("SetHostOverride: %v", err)
+	}
+	if err := p.SetHostOverride("cdn.hcadam.com:attempts=2"); err != nil {
+		t.Fatalf("SetHostOverride: %v", err)
+	}
+
+	if got := p.ForHost("www.hcadam.com"); got.MaxETA != time.Hour || got.MaxAttempts != 5 {
+		t.Errorf("www.hcadam.com: MaxETA=%s MaxAttempts=%d, want 1h and 5", got.MaxETA, got.MaxAttempts)
+	}
+	if got := p.ForHost("cdn.hcadam.com"); got.MaxAttempts != 2 {
+		t.Errorf("cdn.hcadam.com: MaxAttempts=%d, want 2 (most specific override)", got.MaxAttempts)
+	}
+	if got := p.ForHost("example.org"); got.MaxETA != 10*time.Minute {
+		t.Errorf("example.org: MaxETA=%s, want default 10m", got.MaxETA)
+	}
+	if got := p.ForHost("nothcadam.com"); got.MaxAttempts != 3 {
+		t.Errorf("nothcadam.com: MaxAttempts=%d, want default 3", got.MaxAttempts)
+	}
+
+	if err := p.SetHostOverride("bad.example:attempts"); err == nil {
+		t.Error("expected error for malformed override")
+	}
+	if err := p.SetHostOverride("bad.example:colour=blue"); err == nil {
+		t.Error("expected error for unknown key")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := DownloadPolicy{Backoff: 15 * time.Second, MaxBackoff: time.Minute}
+
+	want := []time.Duration{15 * time.Second, 30 * time.Second, time.Minute, time.Minute}
+	for i, w := range want {
+		if got := p.retryDelay(i+1, nil); got != w {
+			t.Errorf("attempt %d: delay = %s, want %s", i+1, got, w)
+		}
+	}
+
+	// Retry-After longer than the backoff wins, up to MaxBackoff.
+	err := &httpStatusError{StatusCode: 429, RetryAfter: 45 * time.Second}
+	if got := p.retryDelay(1, err); got != 45*time.Second {
+		t.Errorf("Retry-After: delay = %s, want 45s", got)
+	}
+	if !p.isRetryable(err) {
+		t.Error("429 with Retry-After within MaxBackoff not retryable")
+	}
+	err = &httpStatusError{StatusCode: 503, RetryAfter: 3 * time.Hour}
+	if got := p.retryDelay(1, err); got != time.Minute {
+		t.Errorf("long Retry-After: delay = %s, want 1m", got)
+	}
+	if p.isRetryable(err) {
+		t.Error("503 with Retry-After beyond MaxBackoff retryable, want permanent")
+	}
+
+	p.Jitter = 0.5
+	for range 20 {
+		if got := p.retryDelay(1, nil); got < 7500*time.Millisecond || got > 22500*time.Millisecond {
+			t.Fatalf("jittered delay %s outside ±50%% of 15s", got)
+		}
+	}
+}
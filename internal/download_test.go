@@ -0,0 +1,435 @@
+package internal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// testBody is a CSV-ish payload large enough to be cut in half.
+var testBody = []byte(strings.Repeat("description,setting,code|1,code|1|type\n", 2000))
+
+// quietLogger discards log output in tests.
+func quietLogger() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
+}
+
+// testPolicy retries quickly so tests don't sleep for the default backoff,
+// and downloads in a single stream unless a test enables chunking.
+func testPolicy() DownloadPolicy {
+	p := DefaultDownloadPolicy()
+	p.Backoff = time.Millisecond
+	p.Jitter = 0
+	p.Chunks = 1
+	return p
+}
+
+// droppingServer serves testBody but aborts the connection halfway through
+// the first response. rangeSupport controls whether it advertises and honors
+// byte ranges. It records the Range header of every request.
+func droppingServer(t *testing.T, rangeSupport bool) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var ranges []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		mu.Unlock()
+
+		w.Header().Set("ETag", `"v1"`)
+		if first {
+			if rangeSupport {
+				w.Header().Set("Accept-Ranges", "bytes")
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(testBody)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(testBody[:len(testBody)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler) // drop the connection mid-body
+		}
+		if !rangeSupport {
+			r.Header.Del("Range")
+			w.Write(testBody)
+			return
+		}
+		http.ServeContent(w, r, "charges.csv", time.Time{}, bytes.NewReader(testBody))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
+
+func fetchTestFile(t *testing.T, rawURL string) (downloadResult, []byte) {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "download.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	result, err := fetchToFile(quietLogger(), f, rawURL, testPolicy())
+	if err != nil {
+		t.Fatalf("fetchToFile: %v", err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result, data
+}
+
+func TestFetchToFileResumesWithRange(t *testing.T) {
+	srv, ranges := droppingServer(t, true)
+
+	result, data := fetchTestFile(t, srv.URL)
+
+	if !bytes.Equal(data, testBody) {
+		t.Fatalf("downloaded %d bytes, want %d identical bytes", len(data), len(testBody))
+	}
+	if !result.Resumed {
+		t.Error("expected the second attempt to resume")
+	}
+	if result.N != int64(len(testBody)) {
+		t.Errorf("result.N = %d, want %d", result.N, len(testBody))
+	}
+	got := ranges()
+	want := fmt.Sprintf("bytes=%d-", len(testBody)/2)
+	if len(got) != 2 || got[0] != "" || got[1] != want {
+		t.Errorf("Range headers = %q, want [\"\" %q]", got, want)
+	}
+}
+
+func TestFetchToFileKeepsResumeAcrossFailedAttempt(t *testing.T) {
+	// The resume after a dropped body fails with no usable response; the
+	// next attempt must still continue from the partial data.
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		n := len(ranges)
+		mu.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Accept-Ranges", "bytes")
+		switch n {
+		case 1:
+			w.Header().Set("Content-Length", fmt.Sprint(len(testBody)))
+			w.Write(testBody[:len(testBody)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "charges.csv", time.Time{}, bytes.NewReader(testBody))
+	}))
+	defer srv.Close()
+
+	result, data := fetchTestFile(t, srv.URL)
+
+	if !bytes.Equal(data, testBody) {
+		t.Fatalf("downloaded %d bytes, want %d identical bytes", len(data), len(testBody))
+	}
+	if !result.Resumed {
+		t.Error("expected the third attempt to resume")
+	}
+	want := fmt.Sprintf("bytes=%d-", len(testBody)/2)
+	if len(ranges) != 3 || ranges[1] != want || ranges[2] != want {
+		t.Errorf("Range headers = %q, want [\"\" %q %q]", ranges, want, want)
+	}
+}
+
+func TestFetchToFileRestartsWithoutRangeSupport(t *testing.T) {
+	srv, ranges := droppingServer(t, false)
+
+	result, data := fetchTestFile(t, srv.URL)
+
+	if !bytes.Equal(data, testBody) {
+		t.Fatalf("downloaded %d bytes, want %d identical bytes", len(data), len(testBody))
+	}
+	if result.Resumed {
+		t.Error("expected a full re-download, not a resume")
+	}
+	if got := ranges(); len(got) != 2 || got[1] != "" {
+		t.Errorf("Range headers = %q, want no Range on retry", got)
+	}
+}
+
+func TestFetchToFileRestartsWhenFileChanged(t *testing.T) {
+	// The server honors If-Range: a changed ETag means a full 200 response,
+	// which must replace (not append to) the partial data.
+	changed := []byte(strings.Repeat("x", len(testBody)))
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Accept-Ranges", "bytes")
+		if requests == 1 {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", fmt.Sprint(len(testBody)))
+			w.Write(testBody[:100])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "charges.csv", time.Time{}, bytes.NewReader(changed))
+	}))
+	defer srv.Close()
+
+	result, data := fetchTestFile(t, srv.URL)
+
+	if !bytes.Equal(data, changed) {
+		t.Fatalf("expected the new file contents after If-Range mismatch")
+	}
+	if result.Resumed {
+		t.Error("expected a full re-download after the ETag changed")
+	}
+}
+
+func TestFetchToFileChunked(t *testing.T) {
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "charges.csv", time.Time{}, bytes.NewReader(testBody))
+	}))
+	defer srv.Close()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "download.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	policy := testPolicy()
+	policy.Chunks = 3
+	policy.ChunkMinSize = 1024
+	result, err := fetchToFile(quietLogger(), f, srv.URL, policy)
+	if err != nil {
+		t.Fatalf("fetchToFile: %v", err)
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testBody) {
+		t.Fatalf("assembled %d bytes, want %d identical bytes", len(data), len(testBody))
+	}
+	if result.N != int64(len(testBody)) {
+		t.Errorf("result.N = %d, want %d", result.N, len(testBody))
+	}
+
+	// The plain GET shows the size, then one request per chunk.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 4 || ranges[0] != "" {
+		t.Fatalf("Range headers = %q, want GET + 3 chunks", ranges)
+	}
+	chunk := (len(testBody) + 2) / 3
+	for i := range 3 {
+		want := fmt.Sprintf("bytes=%d-%d", i*chunk, min((i+1)*chunk, len(testBody))-1)
+		if !slices.Contains(ranges[1:], want) {
+			t.Errorf("missing chunk request %q in %q", want, ranges)
+		}
+	}
+}
+
+func TestFetchToFileChunkedFallsBackWithoutRanges(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(testBody) // ignores Range
+	}))
+	defer srv.Close()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "download.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	policy := testPolicy()
+	policy.Chunks = 4
+	policy.ChunkMinSize = 1
+	if _, err := fetchToFile(quietLogger(), f, srv.URL, policy); err != nil {
+		t.Fatalf("fetchToFile: %v", err)
+	}
+	data, _ := os.ReadFile(f.Name())
+	if !bytes.Equal(data, testBody) {
+		t.Fatalf("downloaded %d bytes, want %d identical bytes", len(data), len(testBody))
+	}
+	if requests != 1 {
+		t.Errorf("requests = %d, want a single stream", requests)
+	}
+}
+
+func TestFetchToFileSmallFileSingleRequest(t *testing.T) {
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "charges.csv", time.Time{}, bytes.NewReader(testBody))
+	}))
+	defer srv.Close()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "download.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	policy := testPolicy()
+	policy.Chunks = 4 // the default ChunkMinSize is far above testBody
+	if _, err := fetchToFile(quietLogger(), f, srv.URL, policy); err != nil {
+		t.Fatalf("fetchToFile: %v", err)
+	}
+	if len(ranges) != 1 || ranges[0] != "" {
+		t.Errorf("Range headers = %q, want one plain GET", ranges)
+	}
+}
+
+func TestFetchToFileChunkedChecksFirstChunk(t *testing.T) {
+	// Full responses look fine, but ranged ones get a login page.
+	page := []byte("<!DOCTYPE html><html><head><title>Sign in</title></head></html>" + strings.Repeat(" ", len(testBody)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		body := testBody
+		if r.Header.Get("Range") != "" {
+			body = page[:len(testBody)]
+		}
+		http.ServeContent(w, r, "charges.csv", time.Time{}, bytes.NewReader(body))
+	}))
+	defer srv.Close()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "download.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	policy := testPolicy()
+	policy.Chunks = 2
+	policy.ChunkMinSize = 1024
+	policy.MaxAttempts = 1
+	if _, err := fetchToFile(quietLogger(), f, srv.URL, policy); err != nil {
+		t.Fatalf("fetchToFile: %v", err)
+	}
+	// The chunked download fails on the page and the single stream that
+	// replaces it gets the file.
+	data, _ := os.ReadFile(f.Name())
+	if !bytes.Equal(data, testBody) {
+		t.Fatalf("downloaded %d bytes, want %d identical bytes", len(data), len(testBody))
+	}
+}
+
+// encodeBytes compresses data with the named Content-Encoding coding.
+// "deflate-raw" is a bare DEFLATE stream sent as "deflate".
+func encodeBytes(t *testing.T, coding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "deflate-raw":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		var err error
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("unknown coding %q", coding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchToFileDecodesContentEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		header  string
+		codings []string // in the order applied
+	}{
+		{"gzip", []string{"gzip"}},
+		{"deflate", []string{"deflate"}},
+		{"deflate", []string{"deflate-raw"}},
+		{"br", []string{"br"}},
+		{"zstd", []string{"zstd"}},
+		{"gzip, br", []string{"gzip", "br"}},
+	} {
+		t.Run(strings.Join(tt.codings, "+"), func(t *testing.T) {
+			body := testBody
+			for _, c := range tt.codings {
+				body = encodeBytes(t, c, body)
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", tt.header)
+				w.Write(body)
+			}))
+			defer srv.Close()
+
+			_, data := fetchTestFile(t, srv.URL)
+			if !bytes.Equal(data, testBody) {
+				t.Errorf("got %d bytes, want the %d decoded bytes", len(data), len(testBody))
+			}
+		})
+	}
+}
+
+func TestFetchToFileRejectsUnknownEncoding(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Encoding", "compress")
+		w.Write(testBody)
+	}))
+	defer srv.Close()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "download.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = fetchToFile(quietLogger(), f, srv.URL, testPolicy())
+	if err == nil || !strings.Contains(err.Error(), `unsupported Content-Encoding "compress"`) {
+		t.Errorf("fetchToFile error = %v, want unsupported Content-Encoding", err)
+	}
+	if requests != 1 {
+		t.Errorf("server got %d requests, want 1 (not retried)", requests)
+	}
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	_ "github.com/duckdb/duckdb-go/v2" // registers the "duckdb" driver
+)
+
+const (
+	// DuckDBFileName is the database a directory output of FormatDuckDB
+	// writes to, shared by every hospital of a batch run.
+	DuckDBFileName = "charges.duckdb"
+
+	// duckdbTable holds the rows; duckdbLoadsTable records each load's
+	// key-value metadata, which has no place in the rows themselves.
+	duckdbTable      = "charges"
+	duckdbLoadsTable = "pricetool_loads"
+)
+
+// indexCodeColumns are the code columns the database outputs index: the
+// ones point lookups filter on. Every index slows loading, so the rarer
+// code types are left unindexed.
+var indexCodeColumns = []string{"cpt_code", "hcpcs_code", "ms_drg_code", "ndc_code", "rc_code"}
+
+// duckdbLocks serializes loads into the same database: DuckDB allows one
+// open writer per file, and batch workers share a database.
+var duckdbLocks sync.Map // absolute path -> *sync.Mutex
+
+// DuckDBWriter appends rows to the charges table of a DuckDB database,
+// creating the table (typed from HospitalChargeRow) and its code indexes
+// when missing and adding any columns newer versions introduce.
+//
+// Rows are staged in a Parquet file by a ChargeWriter, which sorts them,
+// and loaded on Close with read_parquet through the embedded DuckDB
+// engine. Each load, with its key-value metadata recorded in
+// pricetool_loads, is one transaction.
+type DuckDBWriter struct {
+	// SortOrder orders the staged rows; see ChargeWriter.
+	SortOrder SortOrder
+
+	database string
+	staging  string
+	writer   *ChargeWriter
+	kv       [][2]string
+}
+
+// NewDuckDBWriter creates a writer that loads into the database file
+// filename, which is created if it doesn't exist.
+func NewDuckDBWriter(filename string) (*DuckDBWriter, error) {
+	f, err := os.CreateTemp("", "hospital-loader-duckdb-*.parquet")
+	if err != nil {
+		return nil, fmt.Errorf("create staging file: %w", err)
+	}
+	f.Close()
+	// Staging is read once, right away: favor write speed over size.
+	config := DefaultWriterConfig()
+	config.Compression = "snappy"
+	config.BloomColumns = []string{}
+	writer, err := NewChargeWriter(f.Name(), config)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &DuckDBWriter{database: filename, staging: f.Name(), writer: writer}, nil
+}
+
+// Write stages rows for loading on Close.
+func (w *DuckDBWriter) Write(rows []HospitalChargeRow) (int, error) {
+	return w.writer.Write(rows)
+}
+
+// SetKeyValueMetadata sets a key-value pair recorded with the load in
+// pricetool_loads. It may be called any time before Close.
+func (w *DuckDBWriter) SetKeyValueMetadata(key, value string) {
+	for i := range w.kv {
+		if w.kv[i][0] == key {
+			w.kv[i][1] = value
+			return
+		}
+	}
+	w.kv = append(w.kv, [2]string{key, value})
+}
+
+// Close loads the staged rows into the database.
+func (w *DuckDBWriter) Close() error {
+	defer os.Remove(w.staging)
+	w.writer.SortOrder = w.SortOrder
+	rows := w.writer.Count()
+	if err := w.writer.Close(); err != nil {
+		return err
+	}
+
+	path, err := filepath.Abs(w.database)
+	if err != nil {
+		return err
+	}
+	mu, _ := duckdbLocks.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", w.database, err)
+	}
+	defer db.Close()
+	if err := duckdbLoad(context.Background(), db, w.staging, rows, w.kv); err != nil {
+		return fmt.Errorf("load into %s: %w", w.database, err)
+	}
+	return nil
+}
+
+// Abort removes the staged rows without loading them.
+func (w *DuckDBWriter) Abort() {
+	w.writer.Abort()
+}
+
+// duckdbLoad loads a staged Parquet file of rows in one transaction.
+func duckdbLoad(ctx context.Context, db *sql.DB, staging string, rows int, kv [][2]string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var stmts []string
+	existing, err := duckdbColumns(ctx, tx, duckdbTable)
+	if err != nil {
+		return err
+	}
+	var defs, names, missing []string
+	for _, col := range chargeColumns {
+		def := col.name + " " + duckdbType(col.kind)
+		defs = append(defs, def)
+		names = append(names, col.name)
+		if !existing[col.name] {
+			missing = append(missing, def)
+		}
+	}
+	switch {
+	case len(existing) == 0:
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE %s (\n  %s\n)", duckdbTable, strings.Join(defs, ",\n  ")))
+	case len(missing) > 0:
+		// Tables created by older versions get the newer columns as NULLs.
+		// Older engines refuse to alter a table with indexes, so the code
+		// indexes are dropped first and rebuilt below.
+		for _, col := range indexCodeColumns {
+			stmts = append(stmts, fmt.Sprintf("DROP INDEX IF EXISTS %s", duckdbIndex(col)))
+		}
+		for _, def := range missing {
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", duckdbTable, def))
+		}
+	}
+	cols := strings.Join(names, ", ")
+	stmts = append(stmts, fmt.Sprintf("INSERT INTO %s (%s)\n  SELECT %s FROM read_parquet(%s)", duckdbTable, cols, cols, sqlString(staging)))
+	for _, col := range indexCodeColumns {
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", duckdbIndex(col), duckdbTable, col))
+	}
+
+	stmts = append(stmts, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (loaded_at TIMESTAMP, row_count BIGINT, metadata MAP(VARCHAR, VARCHAR))", duckdbLoadsTable))
+	pairs := make([]string, len(kv))
+	for i, p := range kv {
+		pairs[i] = sqlString(p[0]) + ": " + sqlString(p[1])
+	}
+	stmts = append(stmts, fmt.Sprintf("INSERT INTO %s VALUES (current_timestamp, %d, MAP {%s})", duckdbLoadsTable, rows, strings.Join(pairs, ", ")))
+
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// duckdbColumns returns the columns of a table in the main schema, none if
+// it doesn't exist.
+func duckdbColumns(ctx context.Context, tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT column_name FROM information_schema.columns WHERE table_schema = 'main' AND table_name = ?", table)
+	if err != nil {
+		return nil, fmt.Errorf("list columns: %w", err)
+	}
+	defer rows.Close()
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("list columns: %w", err)
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+// duckdbIndex names the index of a code column.
+func duckdbIndex(col string) string {
+	return duckdbTable + "_" + col + "_idx"
+}
+
+// duckdbType returns the DuckDB type of a column kind.
+func duckdbType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Float64:
+		return "DOUBLE"
+	case reflect.Bool:
+		return "BOOLEAN"
+	}
+	return "VARCHAR"
+}
+
+// sqlString quotes s as a SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// openDuckDB opens a database written by DuckDBWriter for checking.
+func openDuckDB(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// queryStrings runs a query and returns its first column as strings.
+func queryStrings(t *testing.T, db *sql.DB, query string) []string {
+	t.Helper()
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		out = append(out, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return out
+}
+
+func TestDuckDBOutput(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	outDir := t.TempDir()
+	logPath := filepath.Join(outDir, "log.jsonl")
+	opts := DefaultProcessOptions()
+	opts.OutputFormat = FormatDuckDB
+	opts.SkipPayerCharges = false
+	want := 0
+	// Both hospitals go into the one database of the directory; the second
+	// load finds the table and its indexes in place.
+	for _, input := range []string{writeTallCSV(t), writeWideCSV(t)} {
+		if err := ProcessEntry(quietLogger(), input, outDir+"/", logPath, "Test", opts); err != nil {
+			t.Fatalf("ProcessEntry: %v", err)
+		}
+		want += len(inputRows(t, input))
+	}
+
+	db := openDuckDB(t, filepath.Join(outDir, DuckDBFileName))
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM charges").Scan(&n); err != nil || n != want {
+		t.Errorf("charges has %d rows (%v), want %d", n, err, want)
+	}
+	if got := queryStrings(t, db, "SELECT DISTINCT hospital_name FROM charges ORDER BY 1"); !slices.Equal(got, []string{"Test General Hospital", "Wide Test Hospital"}) {
+		t.Errorf("hospitals = %q, want both files'", got)
+	}
+	if got := queryStrings(t, db, "SELECT metadata['pricetool.hospital_name'] FROM pricetool_loads ORDER BY loaded_at"); !slices.Equal(got, []string{"Test General Hospital", "Wide Test Hospital"}) {
+		t.Errorf("loads = %q, want one per file", got)
+	}
+	got := queryStrings(t, db, "SELECT index_name FROM duckdb_indexes() WHERE table_name = 'charges' ORDER BY index_name")
+	var wantIndexes []string
+	for _, col := range indexCodeColumns {
+		wantIndexes = append(wantIndexes, duckdbIndex(col))
+	}
+	slices.Sort(wantIndexes)
+	if !slices.Equal(got, wantIndexes) {
+		t.Errorf("indexes = %q, want %q", got, wantIndexes)
+	}
+	if staged, _ := filepath.Glob(filepath.Join(os.TempDir(), "hospital-loader-duckdb-*")); len(staged) != 0 {
+		t.Errorf("staging files left behind: %v", staged)
+	}
+}
+
+// TestDuckDBOutputUpgrade loads into a charges table an older version
+// created, with fewer columns and an index on one of them.
+func TestDuckDBOutputUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.duckdb")
+	old := openDuckDB(t, path)
+	for _, stmt := range []string{
+		"CREATE TABLE charges (hospital_name VARCHAR, description VARCHAR, cpt_code VARCHAR)",
+		"INSERT INTO charges VALUES ('Old Hospital', 'ECHO', '93306')",
+		"CREATE INDEX " + duckdbIndex("cpt_code") + " ON charges (cpt_code)",
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	old.Close()
+
+	opts := DefaultProcessOptions()
+	opts.OutputFormat = FormatDuckDB
+	if err := ProcessEntry(quietLogger(), writeTallCSV(t), path, filepath.Join(t.TempDir(), "log.jsonl"), "Test", opts); err != nil {
+		t.Fatalf("ProcessEntry: %v", err)
+	}
+
+	db := openDuckDB(t, path)
+	cols := queryStrings(t, db, "SELECT column_name FROM information_schema.columns WHERE table_name = 'charges'")
+	if len(cols) != len(chargeColumns) {
+		t.Errorf("charges has %d columns after the load, want %d", len(cols), len(chargeColumns))
+	}
+	if got := queryStrings(t, db, "SELECT coalesce(setting, 'NULL') FROM charges WHERE hospital_name = 'Old Hospital'"); !slices.Equal(got, []string{"NULL"}) {
+		t.Errorf("old row's new column = %q, want NULL", got)
+	}
+	if got := queryStrings(t, db, "SELECT index_name FROM duckdb_indexes() WHERE table_name = 'charges'"); len(got) != len(indexCodeColumns) {
+		t.Errorf("indexes = %q, want %d", got, len(indexCodeColumns))
+	}
+}
+
+func TestDuckDBOutputErrors(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	opts := DefaultProcessOptions()
+	opts.OutputFormat = FormatDuckDB
+	dir := t.TempDir()
+	notDB := filepath.Join(dir, "prices.duckdb")
+	if err := os.WriteFile(notDB, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := ProcessEntry(quietLogger(), writeTallCSV(t), notDB, filepath.Join(dir, "log.jsonl"), "Test", opts)
+	if err == nil || !strings.Contains(err.Error(), "prices.duckdb") {
+		t.Errorf("ProcessEntry into a non-database file: error = %v, want one naming it", err)
+	}
+
+	err = ProcessEntry(quietLogger(), writeTallCSV(t), "s3://bucket/prefix/", filepath.Join(dir, "log.jsonl"), "Test", opts)
+	if err == nil {
+		t.Error("ProcessEntry to S3 succeeded, want error")
+	}
+
+	// A conversion that fails partway removes its staged rows and leaves
+	// the database alone.
+	bad := filepath.Join(dir, "truncated.json")
+	if err := os.WriteFile(bad, []byte(`{"hospital_name": "Test", "standard_charge_information": [{"description": "X"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fresh := filepath.Join(dir, "fresh.duckdb")
+	err = ProcessEntry(quietLogger(), bad, fresh, filepath.Join(dir, "log.jsonl"), "Test", opts)
+	if err == nil || !strings.Contains(err.Error(), "read JSON item") {
+		t.Errorf("ProcessEntry error = %v, want a read error", err)
+	}
+	if _, err := os.Stat(fresh); err == nil {
+		t.Error("database created for a failed conversion")
+	}
+	if staged, _ := filepath.Glob(filepath.Join(os.TempDir(), "hospital-loader-duckdb-*")); len(staged) != 0 {
+		t.Errorf("staging files left behind: %v", staged)
+	}
+}
+
+func TestSQLString(t *testing.T) {
+	if got := sqlString("St. Mary's"); got != "'St. Mary''s'" {
+		t.Errorf("sqlString = %s", got)
+	}
+}
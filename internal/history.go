@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// PriceHistoryRow is a charge in a price history: a HospitalChargeRow with
+// the dates it was published for. ValidFrom is the last_updated_on of the
+// file that introduced the charge at these prices, and ValidTo that of the
+// file that changed or dropped it, or nil while it is current. A charge's
+// price on a date d is the row with ValidFrom <= d < ValidTo.
+type PriceHistoryRow struct {
+	HospitalChargeRow
+	ValidFrom string  `parquet:"valid_from"` // YYYY-MM-DD
+	ValidTo   *string `parquet:"valid_to,optional"`
+}
+
+// HistoryUpdate summarizes an AddToHistory.
+type HistoryUpdate struct {
+	File string // the hospital's history file
+	AsOf string // the new file's last_updated_on
+
+	// Added counts the charges new or changed as of AsOf, Closed those it
+	// changed or dropped, and Unchanged the rest.
+	Added, Closed, Unchanged int
+	// Skipped is set when the history already holds AsOf.
+	Skipped bool
+}
+
+// AddToHistory records a denormalized output file in the price history in
+// dir, which holds one Parquet file of PriceHistoryRows per hospital.
+// Charges are matched as by DiffCharges; only those that changed are
+// appended, and the rows they replace get a ValidTo.
+//
+// The file must hold one hospital, so compacted files are refused, and
+// is recorded as of the last_updated_on in its footer. Files must be added
+// in that order (see SortHistoryInputs). Adding one as old as the latest
+// already recorded does nothing, so reruns are safe.
+func AddToHistory(logger *slog.Logger, dir, input, region string) (HistoryUpdate, error) {
+	tmpDir, err := os.MkdirTemp("", "hospital-loader-history-*")
+	if err != nil {
+		return HistoryUpdate{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	in := compactInput{Location: input}
+	if !strings.HasPrefix(input, "s3://") {
+		in.LocalPath = input
+	}
+	if err := in.fetch(context.Background(), tmpDir, region); err != nil {
+		return HistoryUpdate{}, err
+	}
+	asOf, err := inspectHistoryInput(context.Background(), &in, region)
+	if err != nil {
+		return HistoryUpdate{}, err
+	}
+	update := HistoryUpdate{AsOf: asOf}
+	rows, err := readChargeRows(in.LocalPath)
+	if err != nil {
+		return update, fmt.Errorf("read %s: %w", input, err)
+	}
+	if len(rows) == 0 {
+		return update, fmt.Errorf("%s has no rows", input)
+	}
+	first := rows[0]
+	firstKey := hospitalKey(first.LicenseState, first.LicenseNumber, nil, first.HospitalName)
+	for i := range rows {
+		if hospitalKey(rows[i].LicenseState, rows[i].LicenseNumber, nil, rows[i].HospitalName) != firstKey {
+			return update, fmt.Errorf("%s holds more than one hospital (%s and %s); add one file per hospital", input, first.HospitalName, rows[i].HospitalName)
+		}
+	}
+
+	var npis []string
+	if v, err := parquetKeyValue(in.LocalPath, metadataPrefix+"type_2_npis"); err != nil {
+		return update, err
+	} else if v != "" {
+		npis = strings.Split(v, "|")
+	}
+	key := hospitalKey(first.LicenseState, first.LicenseNumber, npis, first.HospitalName)
+	update.File = filepath.Join(dir, sanitizeFilename(key)+".parquet")
+
+	history, err := readHistory(update.File)
+	if err != nil {
+		return update, err
+	}
+	if latest := latestHistoryDate(history); update.AsOf < latest {
+		return update, fmt.Errorf("%s is dated %s, before %s already in %s", input, update.AsOf, latest, update.File)
+	} else if update.AsOf == latest {
+		update.Skipped = true
+		logger.Info("already in history", "input", input, "file", update.File, "as_of", update.AsOf)
+		return update, nil
+	}
+
+	var current []HospitalChargeRow
+	var currentIdx []int
+	for i := range history {
+		if history[i].ValidTo == nil {
+			current = append(current, history[i].HospitalChargeRow)
+			currentIdx = append(currentIdx, i)
+		}
+	}
+	rowIdx := make(map[*HospitalChargeRow]int, len(current))
+	for i := range current {
+		rowIdx[&current[i]] = currentIdx[i]
+	}
+	matchCharges(current, rows, func(o, n *HospitalChargeRow) {
+		if o != nil {
+			history[rowIdx[o]].ValidTo = &asOf
+			update.Closed++
+		}
+		if n != nil {
+			history = append(history, PriceHistoryRow{HospitalChargeRow: *n, ValidFrom: asOf})
+			update.Added++
+		}
+	})
+	update.Unchanged = len(current) - update.Closed
+
+	if err := writeHistory(update.File, key, history); err != nil {
+		return update, fmt.Errorf("write %s: %w", update.File, err)
+	}
+	logger.Info("history updated", "input", input, "file", update.File, "as_of", update.AsOf,
+		"added", update.Added, "closed", update.Closed, "unchanged", update.Unchanged)
+	return update, nil
+}
+
+// SortHistoryInputs returns denormalized output files, local paths or s3://
+// URIs, in the last_updated_on order AddToHistory needs them in, reading
+// only their footers. Files with the same date keep their order. Inputs
+// AddToHistory would refuse for their footer are an error.
+func SortHistoryInputs(inputs []string, region string) ([]string, error) {
+	dates := make(map[string]string, len(inputs))
+	for _, input := range inputs {
+		in := compactInput{Location: input}
+		if !strings.HasPrefix(input, "s3://") {
+			in.LocalPath = input
+		}
+		date, err := inspectHistoryInput(context.Background(), &in, region)
+		if err != nil {
+			return nil, err
+		}
+		dates[input] = date
+	}
+	sorted := slices.Clone(inputs)
+	slices.SortStableFunc(sorted, func(a, b string) int { return cmp.Compare(dates[a], dates[b]) })
+	return sorted, nil
+}
+
+// inspectHistoryInput reads an input's footer and returns the
+// last_updated_on it is recorded as of. Compacted files, which mix
+// hospitals, and files without a usable date are refused.
+func inspectHistoryInput(ctx context.Context, in *compactInput, region string) (string, error) {
+	if err := in.inspect(ctx, region); err != nil {
+		return "", err
+	}
+	if in.CompactedFrom != "" {
+		return "", fmt.Errorf("%s is a compacted file; add the per-hospital files it was compacted from", in.Location)
+	}
+	date := normalizeDate(in.LastUpdatedOn)
+	if date == "" {
+		return "", fmt.Errorf("%s has no usable last_updated_on in its footer (%q)", in.Location, in.LastUpdatedOn)
+	}
+	return date, nil
+}
+
+// HistoryQuery selects charges from a price history.
+type HistoryQuery struct {
+	// Date is the YYYY-MM-DD the prices are wanted for.
+	Date string
+	// Code, if set, matches charges with this code in any code column.
+	Code string
+	// Hospital, if set, matches hospital names containing it, ignoring case.
+	Hospital string
+}
+
+// PricesAt returns the charges of the price history in dir that were
+// published for q.Date and match q.
+func PricesAt(dir string, q HistoryQuery) ([]PriceHistoryRow, error) {
+	date := normalizeDate(q.Date)
+	if date == "" {
+		return nil, fmt.Errorf("invalid date %q", q.Date)
+	}
+	var matches []PriceHistoryRow
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".parquet") {
+			return err
+		}
+		history, err := readHistory(p)
+		if err != nil {
+			return err
+		}
+		for _, row := range history {
+			if row.ValidFrom <= date && (row.ValidTo == nil || date < *row.ValidTo) && q.matches(&row.HospitalChargeRow) {
+				matches = append(matches, row)
+			}
+		}
+		return nil
+	})
+	return matches, err
+}
+
+func (q HistoryQuery) matches(row *HospitalChargeRow) bool {
+	if q.Hospital != "" && !strings.Contains(strings.ToLower(row.HospitalName), strings.ToLower(q.Hospital)) {
+		return false
+	}
+	if q.Code == "" {
+		return true
+	}
+	v := reflect.ValueOf(row).Elem()
+	for _, name := range codeColumns {
+		if f, ok := chargeColumnsByName[name].value(v); ok && f.String() == q.Code {
+			return true
+		}
+	}
+	return false
+}
+
+// latestHistoryDate returns the last date a history records, "" if none.
+func latestHistoryDate(history []PriceHistoryRow) string {
+	latest := ""
+	for _, row := range history {
+		latest = max(latest, row.ValidFrom)
+		if row.ValidTo != nil {
+			latest = max(latest, *row.ValidTo)
+		}
+	}
+	return latest
+}
+
+// historyValidity is the part of a PriceHistoryRow that isn't a
+// HospitalChargeRow.
+type historyValidity struct {
+	ValidFrom string  `parquet:"valid_from"`
+	ValidTo   *string `parquet:"valid_to,optional"`
+}
+
+// readHistory reads a hospital's history file; a missing file is an empty
+// history. parquet-go reads nulls into the optional fields of an embedded
+// struct as zero values, so the charges and their validity are read apart.
+func readHistory(path string) ([]PriceHistoryRow, error) {
+	charges, err := readChargeRows(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := parquet.NewGenericReader[historyValidity](f)
+	defer r.Close()
+	validity := make([]historyValidity, r.NumRows())
+	n, err := r.Read(validity)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if n != len(charges) {
+		return nil, fmt.Errorf("read %s: %d validity rows for %d charges", path, n, len(charges))
+	}
+	rows := make([]PriceHistoryRow, n)
+	for i := range rows {
+		rows[i] = PriceHistoryRow{HospitalChargeRow: charges[i], ValidFrom: validity[i].ValidFrom, ValidTo: validity[i].ValidTo}
+	}
+	return rows, nil
+}
+
+// writeHistory replaces a hospital's history file, through a temp file so
+// readers never see a partial one.
+func writeHistory(path, key string, history []PriceHistoryRow) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := parquet.NewGenericWriter[PriceHistoryRow](f, DefaultWriterConfig().options(reflect.TypeFor[PriceHistoryRow](), defaultBloomColumns)...)
+	w.SetKeyValueMetadata(metadataPrefix+"tool_version", ToolVersion)
+	w.SetKeyValueMetadata(metadataPrefix+"hospital_key", key)
+	if _, err := w.Write(history); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// parquetKeyValue returns a key-value metadata entry of a Parquet file, ""
+// if it has none.
+func parquetKeyValue(path, key string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	pf, err := parquet.OpenFile(f, fi.Size())
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", path, err)
+	}
+	v, _ := pf.Lookup(key)
+	return v, nil
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPriceHistory(t *testing.T) {
+	dir := t.TempDir()
+	jan := convertCharges(t, "2024-01-15", `
+		ECHO,outpatient,93306,1500,750,500,2000,Aetna,PPO,900,fee_schedule
+		ECHO,outpatient,93306,1500,750,500,2000,Cigna,Open,1000,fee_schedule
+		XRAY,outpatient,71046,250,125,80,300,Aetna,PPO,150,fee_schedule`)
+	feb := convertCharges(t, "2024-02-15", `
+		ECHO,outpatient,93306,1500,750,500,2000,Aetna,PPO,990,fee_schedule
+		ECHO,outpatient,93306,1500,750,500,2000,Cigna,Open,1000,fee_schedule`)
+	mar := convertCharges(t, "03/15/2024", `
+		ECHO,outpatient,93306,1500,750,500,2000,Aetna,PPO,990,fee_schedule
+		ECHO,outpatient,93306,1500,750,500,2000,Cigna,Open,1000,fee_schedule
+		XRAY,outpatient,71046,250,125,80,300,Aetna,PPO,160,fee_schedule`)
+
+	// Inputs are ordered by date whatever order they are given in.
+	sorted, err := SortHistoryInputs([]string{mar, feb, jan}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{jan, feb, mar}; !slices.Equal(sorted, want) {
+		t.Errorf("SortHistoryInputs = %q, want %q", sorted, want)
+	}
+
+	for _, step := range []struct {
+		input string
+		want  HistoryUpdate
+	}{
+		{jan, HistoryUpdate{AsOf: "2024-01-15", Added: 3}},
+		{feb, HistoryUpdate{AsOf: "2024-02-15", Added: 1, Closed: 2, Unchanged: 1}}, // ECHO/Aetna changed, XRAY dropped
+		{mar, HistoryUpdate{AsOf: "2024-03-15", Added: 1, Unchanged: 2}},            // XRAY back
+		{mar, HistoryUpdate{AsOf: "2024-03-15", Skipped: true}},                     // rerun
+	} {
+		got, err := AddToHistory(quietLogger(), dir, step.input, "")
+		if err != nil {
+			t.Fatalf("AddToHistory(%s): %v", step.want.AsOf, err)
+		}
+		got.File = ""
+		if got != step.want {
+			t.Errorf("AddToHistory(%s) = %+v, want %+v", step.want.AsOf, got, step.want)
+		}
+	}
+	if _, err := AddToHistory(quietLogger(), dir, feb, ""); err == nil {
+		t.Error("adding an older file succeeded, want error")
+	}
+
+	history, err := PricesAt(dir, HistoryQuery{Date: "2024-01-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 0 {
+		t.Errorf("%d prices before the first file, want 0", len(history))
+	}
+
+	tests := []struct {
+		date, code string
+		want       map[string]float64 // payer/description -> negotiated dollar
+	}{
+		{"2024-01-15", "93306", map[string]float64{"Aetna/ECHO": 900, "Cigna/ECHO": 1000}},
+		{"2024-02-14", "93306", map[string]float64{"Aetna/ECHO": 900, "Cigna/ECHO": 1000}},
+		{"2024-02-15", "93306", map[string]float64{"Aetna/ECHO": 990, "Cigna/ECHO": 1000}},
+		{"2024-02-20", "71046", map[string]float64{}},
+		{"2024-01-20", "71046", map[string]float64{"Aetna/XRAY": 150}},
+		{"2025-01-01", "71046", map[string]float64{"Aetna/XRAY": 160}},
+	}
+	for _, tt := range tests {
+		rows, err := PricesAt(dir, HistoryQuery{Date: tt.date, Code: tt.code, Hospital: "general"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]float64)
+		for _, r := range rows {
+			got[*r.PayerName+"/"+r.Description] = *r.NegotiatedDollar
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("PricesAt(%s, %s) = %v, want %v", tt.date, tt.code, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("PricesAt(%s, %s) = %v, want %v", tt.date, tt.code, got, tt.want)
+				break
+			}
+		}
+	}
+
+	if rows, _ := PricesAt(dir, HistoryQuery{Date: "2024-02-15", Hospital: "elsewhere"}); len(rows) != 0 {
+		t.Errorf("other hospital matched %d rows", len(rows))
+	}
+	if _, err := PricesAt(dir, HistoryQuery{Date: "soon"}); err == nil {
+		t.Error("PricesAt with a bad date succeeded, want error")
+	}
+}
+
+func TestAddToHistoryRefusals(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, kv map[string]string, rows ...HospitalChargeRow) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		w, err := NewChargeWriter(path, DefaultWriterConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range kv {
+			w.SetKeyValueMetadata(k, v)
+		}
+		if _, err := w.Write(rows); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	dated := map[string]string{metadataPrefix + "last_updated_on": "2024-01-15"}
+	a := HospitalChargeRow{HospitalName: "A", LastUpdatedOn: "2024-01-15", Description: "ECHO"}
+	b := HospitalChargeRow{HospitalName: "B", LastUpdatedOn: "2024-01-15", Description: "ECHO"}
+	compacted := map[string]string{
+		metadataPrefix + "last_updated_on": "2024-01-15",
+		metadataPrefix + "compacted_from":  "a.parquet\nb.parquet",
+	}
+
+	for _, tt := range []struct {
+		name, input, want string
+	}{
+		{"compacted", write("compacted.parquet", compacted, a, b), "compacted file"},
+		{"two hospitals", write("two.parquet", dated, a, b), "more than one hospital"},
+		{"no footer date", write("undated.parquet", nil, a), "no usable last_updated_on"},
+	} {
+		if _, err := AddToHistory(quietLogger(), filepath.Join(dir, "history"), tt.input, ""); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: AddToHistory error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := SortHistoryInputs([]string{write("dated.parquet", dated, a), filepath.Join(dir, "undated.parquet")}, ""); err == nil {
+		t.Error("SortHistoryInputs with an undated file succeeded, want error")
+	}
+}
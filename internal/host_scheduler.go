@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostScheduler hands out batch entries to workers so that distinct hosts
+// are processed in parallel while each host sees at most MaxPerHost
+// downloads at once and at most one new download per Interval. Entries for
+// the same host keep their input order.
+type HostScheduler struct {
+	MaxPerHost int           // concurrent entries per host; <= 0 means no limit
+	Interval   time.Duration // minimum gap between starts on one host
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	hosts   []*hostQueue // in order of first appearance
+	byIndex []*hostQueue
+	next    int // host to try first, for round-robin
+	left    int // entries not yet handed out
+	timer   *time.Timer
+}
+
+type hostQueue struct {
+	host      string
+	pending   []int
+	active    int
+	nextStart time.Time
+}
+
+// NewHostScheduler groups entries by the host of their URL. Entries without
+// a URL host (local files, empty URLs) are grouped under "" and are not
+// limited.
+func NewHostScheduler(urls []string, maxPerHost int, interval time.Duration) *HostScheduler {
+	s := &HostScheduler{MaxPerHost: maxPerHost, Interval: interval, left: len(urls)}
+	s.cond = sync.NewCond(&s.mu)
+	queues := make(map[string]*hostQueue)
+	for i, u := range urls {
+		host := entryHost(u)
+		q := queues[host]
+		if q == nil {
+			q = &hostQueue{host: host}
+			queues[host] = q
+			s.hosts = append(s.hosts, q)
+		}
+		q.pending = append(q.pending, i)
+		s.byIndex = append(s.byIndex, q)
+	}
+	return s
+}
+
+// entryHost returns the lowercase host name of an MRF URL, or "" for a
+// local path.
+func entryHost(rawURL string) string {
+	if !isURL(rawURL) {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Next blocks until an entry may start and returns its index. It returns
+// false once every entry has been handed out.
+func (s *HostScheduler) Next() (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.left == 0 {
+			return 0, false
+		}
+		now := time.Now()
+		var wake time.Time
+		for k := range s.hosts {
+			q := s.hosts[(s.next+k)%len(s.hosts)]
+			if len(q.pending) == 0 || (q.host != "" && s.MaxPerHost > 0 && q.active >= s.MaxPerHost) {
+				continue
+			}
+			if q.host != "" && now.Before(q.nextStart) {
+				if wake.IsZero() || q.nextStart.Before(wake) {
+					wake = q.nextStart
+				}
+				continue
+			}
+			i := q.pending[0]
+			q.pending = q.pending[1:]
+			q.active++
+			q.nextStart = now.Add(s.Interval)
+			s.left--
+			s.next = (s.next + k + 1) % len(s.hosts)
+			return i, true
+		}
+		// Nothing can start yet: wait for a Done or the earliest host to
+		// come off its interval.
+		if !wake.IsZero() && s.timer == nil {
+			s.timer = time.AfterFunc(wake.Sub(now), func() {
+				s.mu.Lock()
+				s.timer = nil
+				s.mu.Unlock()
+				s.cond.Broadcast()
+			})
+		}
+		s.cond.Wait()
+	}
+}
+
+// Done records that entry i, returned by Next, no longer uses its host.
+func (s *HostScheduler) Done(i int) {
+	s.mu.Lock()
+	s.byIndex[i].active--
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// runScheduler drains s with n workers calling run for each entry.
+func runScheduler(s *HostScheduler, n int, run func(i int)) {
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i, ok := s.Next()
+				if !ok {
+					return
+				}
+				run(i)
+				s.Done(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHostSchedulerLimitsConcurrency(t *testing.T) {
+	urls := []string{
+		"https://cdn.example.com/a.csv",
+		"https://cdn.example.com/b.csv",
+		"https://CDN.example.com/c.csv",
+		"https://other.example.org/d.json",
+		"local.csv",
+		"https://other.example.org/e.json",
+	}
+	s := NewHostScheduler(urls, 1, 0)
+
+	var mu sync.Mutex
+	active := make(map[string]int)
+	peak := make(map[string]int)
+	var order []int
+	runScheduler(s, 4, func(i int) {
+		host := entryHost(urls[i])
+		mu.Lock()
+		active[host]++
+		peak[host] = max(peak[host], active[host])
+		order = append(order, i)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active[host]--
+		mu.Unlock()
+	})
+
+	if len(order) != len(urls) {
+		t.Fatalf("ran %d entries, want %d", len(order), len(urls))
+	}
+	for _, host := range []string{"cdn.example.com", "other.example.org"} {
+		if peak[host] != 1 {
+			t.Errorf("%s had %d entries at once, want 1", host, peak[host])
+		}
+	}
+	// Distinct hosts start together instead of queueing behind cdn.
+	if first := order[:3]; entryHost(urls[first[0]]) == entryHost(urls[first[1]]) {
+		t.Errorf("first entries %v share a host, want distinct hosts", first)
+	}
+	// Each host keeps its input order.
+	var cdn []int
+	for _, i := range order {
+		if entryHost(urls[i]) == "cdn.example.com" {
+			cdn = append(cdn, i)
+		}
+	}
+	if len(cdn) != 3 || cdn[0] != 0 || cdn[1] != 1 || cdn[2] != 2 {
+		t.Errorf("cdn.example.com order = %v, want [0 1 2]", cdn)
+	}
+}
+
+func TestHostSchedulerInterval(t *testing.T) {
+	const interval = 30 * time.Millisecond
+	urls := []string{"https://a.example.com/1", "https://a.example.com/2", "https://a.example.com/3", "https://b.example.com/1"}
+	s := NewHostScheduler(urls, 0, interval)
+
+	var mu sync.Mutex
+	starts := make(map[int]time.Time)
+	begin := time.Now()
+	runScheduler(s, 4, func(i int) {
+		mu.Lock()
+		starts[i] = time.Now()
+		mu.Unlock()
+	})
+
+	for i := 1; i < 3; i++ {
+		if gap := starts[i].Sub(starts[i-1]); gap < interval {
+			t.Errorf("entries %d and %d on one host started %v apart, want >= %v", i-1, i, gap, interval)
+		}
+	}
+	if d := starts[3].Sub(begin); d >= interval {
+		t.Errorf("other host waited %v, want it to start immediately", d)
+	}
+}
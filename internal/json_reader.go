@@ -13,7 +13,7 @@ import (
 // and emits HospitalChargeRow records one item at a time. Only one jsonItem
 // is in memory at a time — decoded, expanded, then discarded.
 type JSONReader struct {
-	file             *os.File
+	src              io.Closer // underlying file or stream; nil if not owned
 	decoder          *json.Decoder
 	meta             hospitalMeta
 	format           string // "json-v2" or "json-v3"
@@ -27,8 +27,19 @@ func NewJSONReader(filepath string) (*JSONReader, error) {
 	if err != nil {
 		return nil, fmt.Errorf("open %s: %w", filepath, err)
 	}
+	r, err := NewJSONReaderFrom(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r.src = file
+	return r, nil
+}
 
-	bufReader := bufio.NewReaderSize(file, 256*1024)
+// NewJSONReaderFrom reads a JSON MRF from a stream, such as an HTTP response
+// body. The caller owns src and must close it after the reader.
+func NewJSONReaderFrom(src io.Reader) (*JSONReader, error) {
+	bufReader := bufio.NewReaderSize(src, 256*1024)
 
 	// Skip UTF-8 BOM if present
 	bom, err := bufReader.Peek(3)
@@ -39,13 +50,11 @@ func NewJSONReader(filepath string) (*JSONReader, error) {
 	decoder := json.NewDecoder(bufReader)
 
 	r := &JSONReader{
-		file:    file,
 		decoder: decoder,
 		format:  "json",
 	}
 
 	if err := r.readHeader(); err != nil {
-		file.Close()
 		return nil, err
 	}
 
@@ -325,8 +334,8 @@ func (r *JSONReader) Meta() RunMeta {
 
 // Close closes the underlying file.
 func (r *JSONReader) Close() error {
-	if r.file != nil {
-		return r.file.Close()
+	if r.src != nil {
+		return r.src.Close()
 	}
 	return nil
 }
@@ -49,7 +49,7 @@ func jsonToParquet(t *testing.T, jsonPath string) (string, []HospitalChargeRow)
 
 	dir := t.TempDir()
 	parquetPath := filepath.Join(dir, "output.parquet")
-	w, err := NewChargeWriter(parquetPath)
+	w, err := NewChargeWriter(parquetPath, DefaultWriterConfig())
 	if err != nil {
 		t.Fatalf("NewChargeWriter: %v", err)
 	}
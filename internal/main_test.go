@@ -0,0 +1,14 @@
+package internal
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain runs the package's tests, then shuts down the shared fixtures
+// that outlive any one test.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	testServer.stop()
+	os.Exit(code)
+}
@@ -0,0 +1,359 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Manifest files written next to the outputs of a batch run. The leading
+// underscore keeps Hive-style readers (Spark, Athena) from treating them as
+// data; DuckDB globs should match the partition directories, e.g.
+// state=*/*/*.parquet.
+const (
+	manifestJSONName  = "_manifest.json"
+	manifestIndexName = "_manifest.parquet"
+)
+
+// manifest lists the files a batch run produced, so query tools can find
+// them without listing the bucket.
+type manifest struct {
+	CreatedAt   string         `json:"created_at"`
+	ToolVersion string         `json:"tool_version"`
+	OutDir      string         `json:"out_dir"`
+	Hospitals   int            `json:"hospitals"`
+	Rows        int64          `json:"rows"`
+	Bytes       int64          `json:"bytes"`
+	Files       []manifestFile `json:"files"`
+}
+
+// manifestFile is one output file with the hospital it came from, or for
+// a compacted file, the files it was compacted from and how many hospitals
+// they held.
+type manifestFile struct {
+	fileStats
+	CompactedFrom      []string `json:"compacted_from,omitempty"`
+	Hospitals          int      `json:"hospitals,omitempty"`
+	HospitalName       string   `json:"hospital_name"`
+	CMSHPTLocationName string   `json:"cms_hpt_location_name,omitempty"`
+	LicenseNumber      *string  `json:"license_number,omitempty"`
+	LicenseState       *string  `json:"license_state,omitempty"`
+	LastUpdatedOn      string   `json:"last_updated_on,omitempty"`
+	SourceURL          string   `json:"source_url"`
+	SourceSHA256       string   `json:"source_sha256,omitempty"`
+	Latitude           *float64 `json:"latitude,omitempty"`
+	Longitude          *float64 `json:"longitude,omitempty"`
+}
+
+// manifestRow is a row of the Parquet index, one per output file, with the
+// code ranges flattened into columns.
+type manifestRow struct {
+	Path               string   `parquet:"path"`
+	Table              *string  `parquet:"table,optional"`
+	HospitalName       string   `parquet:"hospital_name"`
+	CMSHPTLocationName string   `parquet:"cms_hpt_location_name"`
+	LicenseNumber      *string  `parquet:"license_number,optional"`
+	LicenseState       *string  `parquet:"license_state,optional"`
+	LastUpdatedOn      string   `parquet:"last_updated_on"`
+	SourceURL          string   `parquet:"source_url"`
+	SourceSHA256       string   `parquet:"source_sha256"`
+	Rows               int64    `parquet:"rows"`
+	Bytes              int64    `parquet:"bytes"`
+	CPTMin             *string  `parquet:"cpt_code_min,optional"`
+	CPTMax             *string  `parquet:"cpt_code_max,optional"`
+	HCPCSMin           *string  `parquet:"hcpcs_code_min,optional"`
+	HCPCSMax           *string  `parquet:"hcpcs_code_max,optional"`
+	MSDRGMin           *string  `parquet:"ms_drg_code_min,optional"`
+	MSDRGMax           *string  `parquet:"ms_drg_code_max,optional"`
+	NDCMin             *string  `parquet:"ndc_code_min,optional"`
+	NDCMax             *string  `parquet:"ndc_code_max,optional"`
+	RCMin              *string  `parquet:"rc_code_min,optional"`
+	RCMax              *string  `parquet:"rc_code_max,optional"`
+	Latitude           *float64 `parquet:"latitude,optional"`
+	Longitude          *float64 `parquet:"longitude,optional"`
+}
+
+func (f *manifestFile) row() manifestRow {
+	rng := func(col string) (*string, *string) {
+		r, ok := f.CodeRanges[col]
+		if !ok {
+			return nil, nil
+		}
+		return &r.Min, &r.Max
+	}
+	row := manifestRow{
+		Path:               f.Path,
+		HospitalName:       f.HospitalName,
+		CMSHPTLocationName: f.CMSHPTLocationName,
+		LicenseNumber:      f.LicenseNumber,
+		LicenseState:       f.LicenseState,
+		LastUpdatedOn:      f.LastUpdatedOn,
+		SourceURL:          f.SourceURL,
+		SourceSHA256:       f.SourceSHA256,
+		Rows:               f.Rows,
+		Bytes:              f.Bytes,
+		Latitude:           f.Latitude,
+		Longitude:          f.Longitude,
+	}
+	if f.Table != "" {
+		row.Table = &f.Table
+	}
+	row.CPTMin, row.CPTMax = rng("cpt_code")
+	row.HCPCSMin, row.HCPCSMax = rng("hcpcs_code")
+	row.MSDRGMin, row.MSDRGMax = rng("ms_drg_code")
+	row.NDCMin, row.NDCMax = rng("ndc_code")
+	row.RCMin, row.RCMax = rng("rc_code")
+	return row
+}
+
+// buildManifest collects the successful entries of logFile that started at
+// or after since and wrote into outDir.
+func buildManifest(logFile, outDir string, since time.Time) (manifest, error) {
+	entries, err := readLogEntries(logFile)
+	if err != nil {
+		return manifest{}, err
+	}
+	outDir = strings.TrimSuffix(logPath(outDir), "/")
+	m := manifest{
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+		ToolVersion: ToolVersion,
+		OutDir:      outDir,
+		Files:       []manifestFile{},
+	}
+	since = since.Truncate(time.Second)
+	for _, e := range entries {
+		if !e.Success || len(e.OutputStats) == 0 {
+			continue
+		}
+		if start, err := time.Parse(time.RFC3339, e.StartTime); err != nil || start.Before(since) {
+			continue
+		}
+		var lat, lon *float64
+		for _, g := range e.Geocodes {
+			if g.Matched {
+				lat, lon = &g.Latitude, &g.Longitude
+				break
+			}
+		}
+		added := false
+		for _, st := range e.OutputStats {
+			if !strings.HasPrefix(st.Path, outDir+"/") {
+				continue
+			}
+			m.Files = append(m.Files, manifestFile{
+				fileStats:          st,
+				HospitalName:       e.HospitalName,
+				CMSHPTLocationName: e.CMSHPTLocationName,
+				LicenseNumber:      e.LicenseNumber,
+				LicenseState:       e.LicenseState,
+				LastUpdatedOn:      e.LastUpdatedOn,
+				SourceURL:          e.URL,
+				SourceSHA256:       e.SHA256,
+				Latitude:           lat,
+				Longitude:          lon,
+			})
+			m.Rows += st.Rows
+			m.Bytes += st.Bytes
+			added = true
+		}
+		if added {
+			m.Hospitals++
+		}
+	}
+	return m, nil
+}
+
+// WriteManifest writes _manifest.json and a _manifest.parquet index of the
+// files a batch run wrote to outDir (a local directory or s3:// prefix),
+// taken from the run's entries in logFile. Returns the JSON manifest's
+// location.
+func WriteManifest(logger *slog.Logger, logFile, outDir string, since time.Time, region string) (string, error) {
+	m, err := buildManifest(logFile, outDir, since)
+	if err != nil {
+		return "", fmt.Errorf("build manifest: %w", err)
+	}
+
+	if err := writeManifest(logger, m, region); err != nil {
+		return "", err
+	}
+	logger.Info("manifest written", "dest", m.OutDir+"/"+manifestJSONName,
+		"files", len(m.Files), "hospitals", m.Hospitals, "rows", m.Rows)
+	return m.OutDir + "/" + manifestJSONName, nil
+}
+
+// writeManifest writes both manifest files to m.OutDir.
+func writeManifest(logger *slog.Logger, m manifest, region string) error {
+	tmpDir, err := os.MkdirTemp("", "hospital-loader-manifest-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, manifestJSONName), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := writeManifestIndex(filepath.Join(tmpDir, manifestIndexName), m); err != nil {
+		return err
+	}
+
+	for _, name := range []string{manifestIndexName, manifestJSONName} {
+		src := filepath.Join(tmpDir, name)
+		if strings.HasPrefix(m.OutDir, "s3://") {
+			err = uploadToS3(logger, context.Background(), src, m.OutDir+"/"+name, region)
+		} else {
+			err = copyFileAtomic(src, filepath.Join(m.OutDir, name))
+		}
+		if err != nil {
+			return fmt.Errorf("write %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// updateManifests brings run manifests in line with a compaction. Deleted
+// inputs are dropped from the manifests of the runs that held them, found
+// in each file's directory or, for the Hive layout, the run root above its
+// partition, and the outputs are added to the manifest of outDir if it has
+// one. A manifest left with no files is deleted.
+func updateManifests(logger *slog.Logger, ctx context.Context, inputs []compactInput, deleted map[string]bool, outDir string, outputs []manifestFile, region string) error {
+	var roots []string
+	for _, in := range inputs {
+		if !deleted[logPath(in.Location)] {
+			continue
+		}
+		parent := filepath.Dir
+		if strings.HasPrefix(in.Location, "s3://") {
+			// path.Dir would clean "s3://" to "s3:/".
+			parent = func(p string) string { return p[:strings.LastIndex(p, "/")] }
+		}
+		dir := parent(in.Location)
+		if inPartition(in.Location) {
+			dir = parent(parent(dir))
+		}
+		if dir = logPath(dir); !slices.Contains(roots, dir) {
+			roots = append(roots, dir)
+		}
+	}
+	outDir = logPath(outDir)
+	if len(outputs) > 0 && !slices.Contains(roots, outDir) {
+		roots = append(roots, outDir)
+	}
+
+	for _, root := range roots {
+		m, ok, err := readManifest(ctx, root, region)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		files := slices.DeleteFunc(slices.Clone(m.Files), func(f manifestFile) bool { return deleted[f.Path] })
+		if root == outDir {
+			files = append(files, outputs...)
+		} else if len(files) == len(m.Files) {
+			continue
+		}
+		if len(files) == 0 {
+			for _, name := range []string{manifestJSONName, manifestIndexName} {
+				if err := removeInput(ctx, root+"/"+name, region); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return fmt.Errorf("delete manifest: %w", err)
+				}
+			}
+			logger.Info("deleted manifest of compacted files", "dest", root+"/"+manifestJSONName)
+			continue
+		}
+		m.Files, m.Rows, m.Bytes = files, 0, 0
+		hospitals := make(map[[2]string]bool)
+		compacted := 0
+		for _, f := range files {
+			m.Rows += f.Rows
+			m.Bytes += f.Bytes
+			if f.CompactedFrom != nil {
+				compacted += f.Hospitals
+			} else {
+				hospitals[[2]string{f.SourceURL, f.CMSHPTLocationName}] = true
+			}
+		}
+		m.Hospitals = len(hospitals) + compacted
+		m.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+		m.OutDir = root
+		if err := writeManifest(logger, m, region); err != nil {
+			return err
+		}
+		logger.Info("manifest updated for compaction", "dest", root+"/"+manifestJSONName, "files", len(files))
+	}
+	return nil
+}
+
+// readManifest reads the _manifest.json in dir, reporting false if there
+// is none.
+func readManifest(ctx context.Context, dir, region string) (manifest, bool, error) {
+	loc := dir + "/" + manifestJSONName
+	var data []byte
+	var err error
+	if strings.HasPrefix(dir, "s3://") {
+		var tmp *os.File
+		if tmp, err = os.CreateTemp("", "hospital-loader-manifest-*.json"); err != nil {
+			return manifest{}, false, err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		var noKey *types.NoSuchKey
+		if err = downloadS3(ctx, loc, tmp.Name(), region); errors.As(err, &noKey) {
+			return manifest{}, false, nil
+		} else if err == nil {
+			data, err = os.ReadFile(tmp.Name())
+		}
+	} else {
+		loc = filepath.Join(dir, manifestJSONName)
+		if data, err = os.ReadFile(loc); errors.Is(err, fs.ErrNotExist) {
+			return manifest{}, false, nil
+		}
+	}
+	if err != nil {
+		return manifest{}, false, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return manifest{}, false, fmt.Errorf("read %s: %w", loc, err)
+	}
+	return m, true, nil
+}
+
+// writeManifestIndex writes the manifest as a Parquet table.
+func writeManifestIndex(path string, m manifest) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := parquet.NewGenericWriter[manifestRow](f, DefaultWriterConfig().options(reflect.TypeFor[manifestRow](), nil)...)
+	rows := make([]manifestRow, len(m.Files))
+	for i := range m.Files {
+		rows[i] = m.Files[i].row()
+	}
+	if _, err := w.Write(rows); err != nil {
+		f.Close()
+		return fmt.Errorf("write manifest index: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("write manifest index: %w", err)
+	}
+	return f.Close()
+}
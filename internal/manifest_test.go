@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteManifest(t *testing.T) {
+	dir := t.TempDir()
+	outDir := filepath.Join(dir, "out")
+	logPath := filepath.Join(dir, "log.jsonl")
+	start := time.Now()
+	for _, input := range []string{writeTallCSV(t), writeWideCSV(t)} {
+		if err := ProcessEntry(quietLogger(), input, outDir+"/", logPath, "Test", DefaultProcessOptions()); err != nil {
+			t.Fatalf("ProcessEntry: %v", err)
+		}
+	}
+	// A failed entry isn't listed.
+	ProcessEntry(quietLogger(), filepath.Join(dir, "missing.csv"), outDir+"/", logPath, "Missing", DefaultProcessOptions())
+
+	loc, err := WriteManifest(quietLogger(), logPath, outDir, start, "")
+	if err != nil {
+		t.Fatalf("WriteManifest: %v", err)
+	}
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 2 || m.Hospitals != 2 {
+		t.Fatalf("manifest lists %d files for %d hospitals, want 2 and 2", len(m.Files), m.Hospitals)
+	}
+
+	var rows int64
+	for _, f := range m.Files {
+		if got := int64(len(readParquet(t, f.Path))); got != f.Rows {
+			t.Errorf("%s: rows = %d, file has %d", f.Path, f.Rows, got)
+		}
+		if fi, err := os.Stat(f.Path); err != nil || fi.Size() != f.Bytes {
+			t.Errorf("%s: bytes = %d, stat %v %v", f.Path, f.Bytes, fi, err)
+		}
+		rows += f.Rows
+	}
+	if m.Rows != rows {
+		t.Errorf("total rows = %d, want %d", m.Rows, rows)
+	}
+	tall := m.Files[0]
+	if tall.HospitalName != "Test General Hospital" {
+		t.Fatalf("first file is %q, want the tall CSV", tall.HospitalName)
+	}
+	if r := tall.CodeRanges["cpt_code"]; r != (valueRange{"93306", "93306"}) {
+		t.Errorf("cpt_code range = %+v, want 93306..93306", r)
+	}
+	if r := tall.CodeRanges["ms_drg_code"]; r != (valueRange{"001", "001"}) {
+		t.Errorf("ms_drg_code range = %+v, want 001..001", r)
+	}
+
+	index := readTable[manifestRow](t, filepath.Join(outDir, manifestIndexName))
+	if len(index) != 2 || index[0].CPTMin == nil || *index[0].CPTMin != "93306" {
+		t.Errorf("index = %+v, want 2 rows starting with cpt 93306", index)
+	}
+
+	// Entries from earlier runs sharing the log are left out.
+	if _, err := WriteManifest(quietLogger(), logPath, outDir, time.Now().Add(time.Hour), ""); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(loc)
+	if err := json.Unmarshal(data, &m); err != nil || len(m.Files) != 0 {
+		t.Errorf("later manifest lists %d files (%v), want 0", len(m.Files), err)
+	}
+}
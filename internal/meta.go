@@ -1,5 +1,10 @@
 package internal
 
+import (
+	"slices"
+	"strings"
+)
+
 // RunMeta contains hospital metadata extracted from MRF headers,
 // exposed for logging and external consumption.
 type RunMeta struct {
@@ -12,3 +17,21 @@ type RunMeta struct {
 	LastUpdatedOn     string
 	Version           string
 }
+
+// hospitalKey identifies a hospital across files and runs: by state
+// license, else by its lowest type 2 NPI, else by name. PostgreSQL output,
+// the price history and normalized hospital_ids all key hospitals by it.
+func hospitalKey(licenseState, licenseNumber *string, npis []string, name string) string {
+	if licenseNumber != nil && *licenseNumber != "" {
+		state := ""
+		if licenseState != nil {
+			state = strings.ToUpper(*licenseState)
+		}
+		return "license:" + state + ":" + *licenseNumber
+	}
+	npis = slices.DeleteFunc(slices.Clone(npis), func(s string) bool { return s == "" })
+	if len(npis) > 0 {
+		return "npi:" + slices.Min(npis)
+	}
+	return "name:" + strings.ToLower(strings.TrimSpace(name))
+}
@@ -0,0 +1,25 @@
+package internal
+
+import "testing"
+
+func TestHospitalKey(t *testing.T) {
+	ny, license := "ny", "12345"
+	tests := []struct {
+		name          string
+		state, number *string
+		npis          []string
+		hospital      string
+		want          string
+	}{
+		{"license", &ny, &license, []string{"1234567890"}, "A", "license:NY:12345"},
+		{"lowest npi", nil, nil, []string{"1999999999", "", "1000000000"}, "A", "npi:1000000000"},
+		{"name", nil, nil, nil, " General Hospital ", "name:general hospital"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hospitalKey(tt.state, tt.number, tt.npis, tt.hospital); got != tt.want {
+				t.Errorf("hospitalKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
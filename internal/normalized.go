@@ -0,0 +1,439 @@
+package internal
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Normalized output splits HospitalChargeRow into four tables joined by
+// surrogate keys, so hospital metadata and item details are stored once
+// instead of once per payer row:
+//
+//	hospitals         one row per hospital        key hospital_id
+//	items             description, codes, drug    key item_id, → hospital_id
+//	                  info, modifiers
+//	standard_charges  gross, cash, min and max    → item_id, hospital_id
+//	                  charges, notes
+//	payer_charges     payer-specific rates        → item_id, hospital_id
+//
+// Keys are hashes of the identifying columns only, hospitalKey for
+// hospitals, so the same hospital or item gets the same key in every run
+// and across files, even after its prices change; the charge tables of
+// files with different last_updated_on can be joined on them.
+const (
+	tableHospitals       = "hospitals"
+	tableItems           = "items"
+	tableStandardCharges = "standard_charges"
+	tablePayerCharges    = "payer_charges"
+)
+
+// normalizedTables lists the tables in the order their files are written.
+var normalizedTables = []string{tableHospitals, tableItems, tableStandardCharges, tablePayerCharges}
+
+// HospitalRow is a row of the hospitals table.
+type HospitalRow struct {
+	HospitalID       int64   `parquet:"hospital_id"`
+	HospitalName     string  `parquet:"hospital_name"`
+	LastUpdatedOn    string  `parquet:"last_updated_on"`
+	Version          string  `parquet:"version"`
+	HospitalLocation string  `parquet:"hospital_location"`
+	HospitalAddress  string  `parquet:"hospital_address"`
+	LicenseNumber    *string `parquet:"license_number,optional"`
+	LicenseState     *string `parquet:"license_state,optional"`
+	Affirmation      bool    `parquet:"affirmation"`
+}
+
+// ItemRow is a row of the items table: an item or service, independent of
+// its prices.
+type ItemRow struct {
+	ItemID      int64  `parquet:"item_id"`
+	HospitalID  int64  `parquet:"hospital_id"`
+	Description string `parquet:"description"`
+	Setting     string `parquet:"setting"`
+
+	CPTCode     *string `parquet:"cpt_code,optional"`
+	HCPCSCode   *string `parquet:"hcpcs_code,optional"`
+	MSDRGCode   *string `parquet:"ms_drg_code,optional"`
+	NDCCode     *string `parquet:"ndc_code,optional"`
+	RCCode      *string `parquet:"rc_code,optional"`
+	ICDCode     *string `parquet:"icd_code,optional"`
+	DRGCode     *string `parquet:"drg_code,optional"`
+	CDMCode     *string `parquet:"cdm_code,optional"`
+	LOCALCode   *string `parquet:"local_code,optional"`
+	APCCode     *string `parquet:"apc_code,optional"`
+	EAPGCode    *string `parquet:"eapg_code,optional"`
+	HIPPSCode   *string `parquet:"hipps_code,optional"`
+	CDTCode     *string `parquet:"cdt_code,optional"`
+	RDRGCode    *string `parquet:"r_drg_code,optional"`
+	SDRGCode    *string `parquet:"s_drg_code,optional"`
+	APSDRGCode  *string `parquet:"aps_drg_code,optional"`
+	APDRGCode   *string `parquet:"ap_drg_code,optional"`
+	APRDRGCode  *string `parquet:"apr_drg_code,optional"`
+	TRISDRGCode *string `parquet:"tris_drg_code,optional"`
+
+	DrugUnitOfMeasurement *float64 `parquet:"drug_unit_of_measurement,optional"`
+	DrugTypeOfMeasurement *string  `parquet:"drug_type_of_measurement,optional"`
+
+	Modifiers *string `parquet:"modifiers,optional"`
+}
+
+// StandardChargeRow is a row of the standard_charges table: an item's
+// payer-independent charges as of the file's last_updated_on.
+type StandardChargeRow struct {
+	ItemID        int64  `parquet:"item_id"`
+	HospitalID    int64  `parquet:"hospital_id"`
+	LastUpdatedOn string `parquet:"last_updated_on"`
+
+	GrossCharge    *float64 `parquet:"gross_charge,optional"`
+	DiscountedCash *float64 `parquet:"discounted_cash,optional"`
+	MinCharge      *float64 `parquet:"min_charge,optional"`
+	MaxCharge      *float64 `parquet:"max_charge,optional"`
+
+	AdditionalGenericNotes    *string `parquet:"additional_generic_notes,optional"`
+	BillingClass              *string `parquet:"billing_class,optional"`
+	FinancialAidPolicy        *string `parquet:"financial_aid_policy,optional"`
+	GeneralContractProvisions *string `parquet:"general_contract_provisions,optional"`
+}
+
+// PayerChargeRow is a row of the payer_charges table.
+type PayerChargeRow struct {
+	ItemID     int64   `parquet:"item_id"`
+	HospitalID int64   `parquet:"hospital_id"`
+	PayerName  *string `parquet:"payer_name,optional"`
+	PlanName   *string `parquet:"plan_name,optional"`
+
+	NegotiatedDollar     *float64 `parquet:"negotiated_dollar,optional"`
+	NegotiatedPercentage *float64 `parquet:"negotiated_percentage,optional"`
+	NegotiatedAlgorithm  *string  `parquet:"negotiated_algorithm,optional"`
+	EstimatedAmount      *float64 `parquet:"estimated_amount,optional"`
+	Methodology          *string  `parquet:"methodology,optional"`
+	AdditionalPayerNotes *string  `parquet:"additional_payer_notes,optional"`
+}
+
+// tablePaths returns the files written for an output path: the path itself,
+// or with normalized set, one file per table ("out.parquet" becomes
+// "out-hospitals.parquet", "out-items.parquet" and so on).
+func tablePaths(path string, normalized bool) []string {
+	if !normalized {
+		return []string{path}
+	}
+	base := strings.TrimSuffix(path, ".parquet")
+	paths := make([]string, len(normalizedTables))
+	for i, table := range normalizedTables {
+		paths[i] = base + "-" + table + ".parquet"
+	}
+	return paths
+}
+
+// stableID hashes the given fields into a positive int64 key.
+func stableID(fields ...string) int64 {
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(f))
+		h.Write([]byte{0x1f})
+	}
+	return int64(binary.BigEndian.Uint64(h.Sum(nil)) >> 1)
+}
+
+// optKey renders an optional field for stableID, keeping nil distinct from
+// an empty string.
+func optKey(s *string) string {
+	if s == nil {
+		return "\x00"
+	}
+	return *s
+}
+
+func optFloatKey(f *float64) string {
+	if f == nil {
+		return "\x00"
+	}
+	return strconv.FormatFloat(*f, 'g', -1, 64)
+}
+
+// hospitalID hashes a hospital's hospitalKey.
+func hospitalID(licenseState, licenseNumber *string, npis []string, name string) int64 {
+	return stableID(hospitalKey(licenseState, licenseNumber, npis, name))
+}
+
+// splitRow maps a denormalized row onto the four tables, for the hospital
+// keyed without type 2 NPIs; NormalizedWriter.Close rekeys it once the
+// file's NPIs are known. The payer charge is nil for rows that only carry
+// standard charges.
+func splitRow(r *HospitalChargeRow) (HospitalRow, ItemRow, StandardChargeRow, *PayerChargeRow) {
+	hid := hospitalID(r.LicenseState, r.LicenseNumber, nil, r.HospitalName)
+	hospital := HospitalRow{
+		HospitalID:       hid,
+		HospitalName:     r.HospitalName,
+		LastUpdatedOn:    r.LastUpdatedOn,
+		Version:          r.Version,
+		HospitalLocation: r.HospitalLocation,
+		HospitalAddress:  r.HospitalAddress,
+		LicenseNumber:    r.LicenseNumber,
+		LicenseState:     r.LicenseState,
+		Affirmation:      r.Affirmation,
+	}
+	item := ItemRow{
+		HospitalID:            hid,
+		Description:           r.Description,
+		Setting:               r.Setting,
+		CPTCode:               r.CPTCode,
+		HCPCSCode:             r.HCPCSCode,
+		MSDRGCode:             r.MSDRGCode,
+		NDCCode:               r.NDCCode,
+		RCCode:                r.RCCode,
+		ICDCode:               r.ICDCode,
+		DRGCode:               r.DRGCode,
+		CDMCode:               r.CDMCode,
+		LOCALCode:             r.LOCALCode,
+		APCCode:               r.APCCode,
+		EAPGCode:              r.EAPGCode,
+		HIPPSCode:             r.HIPPSCode,
+		CDTCode:               r.CDTCode,
+		RDRGCode:              r.RDRGCode,
+		SDRGCode:              r.SDRGCode,
+		APSDRGCode:            r.APSDRGCode,
+		APDRGCode:             r.APDRGCode,
+		APRDRGCode:            r.APRDRGCode,
+		TRISDRGCode:           r.TRISDRGCode,
+		DrugUnitOfMeasurement: r.DrugUnitOfMeasurement,
+		DrugTypeOfMeasurement: r.DrugTypeOfMeasurement,
+		Modifiers:             r.Modifiers,
+	}
+	item.ItemID = item.key()
+	standard := StandardChargeRow{
+		ItemID:                    item.ItemID,
+		HospitalID:                hid,
+		LastUpdatedOn:             r.LastUpdatedOn,
+		GrossCharge:               r.GrossCharge,
+		DiscountedCash:            r.DiscountedCash,
+		MinCharge:                 r.MinCharge,
+		MaxCharge:                 r.MaxCharge,
+		AdditionalGenericNotes:    r.AdditionalGenericNotes,
+		BillingClass:              r.BillingClass,
+		FinancialAidPolicy:        r.FinancialAidPolicy,
+		GeneralContractProvisions: r.GeneralContractProvisions,
+	}
+
+	if r.PayerName == nil && r.PlanName == nil && r.NegotiatedDollar == nil &&
+		r.NegotiatedPercentage == nil && r.NegotiatedAlgorithm == nil &&
+		r.EstimatedAmount == nil && r.Methodology == nil && r.AdditionalPayerNotes == nil {
+		return hospital, item, standard, nil
+	}
+	return hospital, item, standard, &PayerChargeRow{
+		ItemID:               item.ItemID,
+		HospitalID:           hid,
+		PayerName:            r.PayerName,
+		PlanName:             r.PlanName,
+		NegotiatedDollar:     r.NegotiatedDollar,
+		NegotiatedPercentage: r.NegotiatedPercentage,
+		NegotiatedAlgorithm:  r.NegotiatedAlgorithm,
+		EstimatedAmount:      r.EstimatedAmount,
+		Methodology:          r.Methodology,
+		AdditionalPayerNotes: r.AdditionalPayerNotes,
+	}
+}
+
+// key hashes the columns that identify the item: every column except
+// item_id. Prices and notes live in standard_charges so they can change
+// without the item getting a new id.
+func (it *ItemRow) key() int64 {
+	return stableID(
+		strconv.FormatInt(it.HospitalID, 10), it.Description, it.Setting,
+		optKey(it.CPTCode), optKey(it.HCPCSCode), optKey(it.MSDRGCode), optKey(it.NDCCode),
+		optKey(it.RCCode), optKey(it.ICDCode), optKey(it.DRGCode), optKey(it.CDMCode),
+		optKey(it.LOCALCode), optKey(it.APCCode), optKey(it.EAPGCode), optKey(it.HIPPSCode),
+		optKey(it.CDTCode), optKey(it.RDRGCode), optKey(it.SDRGCode), optKey(it.APSDRGCode),
+		optKey(it.APDRGCode), optKey(it.APRDRGCode), optKey(it.TRISDRGCode),
+		optFloatKey(it.DrugUnitOfMeasurement), optKey(it.DrugTypeOfMeasurement),
+		optKey(it.Modifiers),
+	)
+}
+
+// key hashes every column of the standard charge, to deduplicate them.
+func (sc *StandardChargeRow) key() int64 {
+	return stableID(
+		strconv.FormatInt(sc.ItemID, 10), sc.LastUpdatedOn,
+		optFloatKey(sc.GrossCharge), optFloatKey(sc.DiscountedCash),
+		optFloatKey(sc.MinCharge), optFloatKey(sc.MaxCharge),
+		optKey(sc.AdditionalGenericNotes), optKey(sc.BillingClass),
+		optKey(sc.FinancialAidPolicy), optKey(sc.GeneralContractProvisions),
+	)
+}
+
+// NormalizedWriter writes HospitalChargeRow records as the hospitals, items,
+// standard_charges and payer_charges tables, one Parquet file each, with
+// the same settings as ChargeWriter. Items and standard charges are
+// deduplicated as they arrive.
+type NormalizedWriter struct {
+	config    WriterConfig
+	files     []*os.File
+	hospitals *parquet.GenericWriter[HospitalRow]
+	items     *parquet.GenericWriter[ItemRow]
+	standard  *parquet.GenericWriter[StandardChargeRow]
+	charges   *parquet.GenericWriter[PayerChargeRow]
+
+	hospitalRows []HospitalRow
+	itemRows     []ItemRow
+	standardRows []StandardChargeRow
+	chargeRows   []PayerChargeRow
+	seenHospital map[int64]bool
+	seenItem     map[int64]bool
+	seenStandard map[int64]bool
+	npis         []string
+}
+
+// NewNormalizedWriter creates the table files for the output path filename
+// (see tablePaths).
+func NewNormalizedWriter(filename string, config WriterConfig) (*NormalizedWriter, error) {
+	config = config.withDefaults()
+	w := &NormalizedWriter{
+		config:       config,
+		seenHospital: make(map[int64]bool),
+		seenItem:     make(map[int64]bool),
+		seenStandard: make(map[int64]bool),
+	}
+	for _, path := range tablePaths(filename, true) {
+		f, err := os.Create(path)
+		if err != nil {
+			w.closeFiles()
+			return nil, fmt.Errorf("create parquet file: %w", err)
+		}
+		w.files = append(w.files, f)
+	}
+	w.hospitals = parquet.NewGenericWriter[HospitalRow](w.files[0], config.options(reflect.TypeFor[HospitalRow](), defaultBloomColumns)...)
+	w.items = parquet.NewGenericWriter[ItemRow](w.files[1], config.options(reflect.TypeFor[ItemRow](), defaultBloomColumns)...)
+	w.standard = parquet.NewGenericWriter[StandardChargeRow](w.files[2], config.options(reflect.TypeFor[StandardChargeRow](), defaultBloomColumns)...)
+	w.charges = parquet.NewGenericWriter[PayerChargeRow](w.files[3], config.options(reflect.TypeFor[PayerChargeRow](), defaultBloomColumns)...)
+	w.hospitals.SetKeyValueMetadata(metadataPrefix+"table", tableHospitals)
+	w.items.SetKeyValueMetadata(metadataPrefix+"table", tableItems)
+	w.standard.SetKeyValueMetadata(metadataPrefix+"table", tableStandardCharges)
+	w.charges.SetKeyValueMetadata(metadataPrefix+"table", tablePayerCharges)
+	return w, nil
+}
+
+// Write splits rows into the four tables, buffering them until Close.
+func (w *NormalizedWriter) Write(rows []HospitalChargeRow) (int, error) {
+	for i := range rows {
+		hospital, item, standard, charge := splitRow(&rows[i])
+		if !w.seenHospital[hospital.HospitalID] {
+			w.seenHospital[hospital.HospitalID] = true
+			w.hospitalRows = append(w.hospitalRows, hospital)
+		}
+		if !w.seenItem[item.ItemID] {
+			w.seenItem[item.ItemID] = true
+			w.itemRows = append(w.itemRows, item)
+		}
+		if k := standard.key(); !w.seenStandard[k] {
+			w.seenStandard[k] = true
+			w.standardRows = append(w.standardRows, standard)
+		}
+		if charge != nil {
+			w.chargeRows = append(w.chargeRows, *charge)
+		}
+	}
+	return len(rows), nil
+}
+
+// SetKeyValueMetadata sets a key-value pair in the footer of every table.
+// The type 2 NPIs are also taken into the hospital_ids on Close.
+func (w *NormalizedWriter) SetKeyValueMetadata(key, value string) {
+	if key == metadataPrefix+"type_2_npis" && value != "" {
+		w.npis = strings.Split(value, "|")
+	}
+	w.hospitals.SetKeyValueMetadata(key, value)
+	w.items.SetKeyValueMetadata(key, value)
+	w.standard.SetKeyValueMetadata(key, value)
+	w.charges.SetKeyValueMetadata(key, value)
+}
+
+// Close rekeys the rows by the file's type 2 NPIs, sorts items by cpt_code
+// (like ChargeWriter) and standard and payer charges by item, writes all
+// four tables and closes their files.
+func (w *NormalizedWriter) Close() error {
+	w.rekey()
+	slices.SortFunc(w.itemRows, func(a, b ItemRow) int {
+		return cmp.Or(cmpOptStr(a.CPTCode, b.CPTCode), cmp.Compare(a.ItemID, b.ItemID))
+	})
+	slices.SortStableFunc(w.standardRows, func(a, b StandardChargeRow) int {
+		return cmp.Compare(a.ItemID, b.ItemID)
+	})
+	slices.SortStableFunc(w.chargeRows, func(a, b PayerChargeRow) int {
+		return cmp.Compare(a.ItemID, b.ItemID)
+	})
+
+	err := errors.Join(
+		closeTable(w.hospitals, w.hospitalRows, w.config.RowsPerGroup),
+		closeTable(w.items, w.itemRows, w.config.RowsPerGroup),
+		closeTable(w.standard, w.standardRows, w.config.RowsPerGroup),
+		closeTable(w.charges, w.chargeRows, w.config.RowsPerGroup),
+	)
+	return errors.Join(err, w.closeFiles())
+}
+
+// rekey recomputes hospital_ids with the type 2 NPIs, which a JSON file
+// may list after its items, and the item_ids that depend on them.
+func (w *NormalizedWriter) rekey() {
+	if len(w.npis) == 0 {
+		return
+	}
+	hospitals := make(map[int64]int64)
+	for i := range w.hospitalRows {
+		h := &w.hospitalRows[i]
+		id := hospitalID(h.LicenseState, h.LicenseNumber, w.npis, h.HospitalName)
+		hospitals[h.HospitalID], h.HospitalID = id, id
+	}
+	items := make(map[int64]int64)
+	for i := range w.itemRows {
+		it := &w.itemRows[i]
+		old := it.ItemID
+		it.HospitalID = hospitals[it.HospitalID]
+		it.ItemID = it.key()
+		items[old] = it.ItemID
+	}
+	for i := range w.standardRows {
+		sc := &w.standardRows[i]
+		sc.HospitalID, sc.ItemID = hospitals[sc.HospitalID], items[sc.ItemID]
+	}
+	for i := range w.chargeRows {
+		c := &w.chargeRows[i]
+		c.HospitalID, c.ItemID = hospitals[c.HospitalID], items[c.ItemID]
+	}
+}
+
+// Abort closes and removes the table files without writing the buffered
+// rows.
+func (w *NormalizedWriter) Abort() {
+	w.closeFiles()
+	for _, f := range w.files {
+		os.Remove(f.Name())
+	}
+}
+
+func closeTable[T any](w *parquet.GenericWriter[T], rows []T, perGroup int) error {
+	if err := writeRowGroups(w, rows, perGroup); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("close parquet writer: %w", err)
+	}
+	return nil
+}
+
+func (w *NormalizedWriter) closeFiles() error {
+	var errs []error
+	for _, f := range w.files {
+		errs = append(errs, f.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// readTable reads every row of a Parquet file into T.
+func readTable[T any](t *testing.T, path string) []T {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open parquet: %v", err)
+	}
+	defer f.Close()
+	reader := parquet.NewGenericReader[T](f)
+	defer reader.Close()
+	rows := make([]T, reader.NumRows())
+	n, err := reader.Read(rows)
+	if err != nil && err != io.EOF {
+		t.Fatalf("read parquet: %v", err)
+	}
+	return rows[:n]
+}
+
+func TestNormalizedOutput(t *testing.T) {
+	input := writeTallCSV(t)
+	opts := DefaultProcessOptions()
+	opts.SkipPayerCharges = false
+	opts.Normalized = true
+
+	convertTo := func(out string) {
+		t.Helper()
+		info := sourceInfo{Input: input, Provenance: func() Provenance { return Provenance{} }}
+		if _, err := convert(quietLogger(), input, info, out, out, opts); err != nil {
+			t.Fatalf("convert: %v", err)
+		}
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.parquet")
+	convertTo(out)
+
+	paths := tablePaths(out, true)
+	hospitals := readTable[HospitalRow](t, paths[0])
+	items := readTable[ItemRow](t, paths[1])
+	standard := readTable[StandardChargeRow](t, paths[2])
+	charges := readTable[PayerChargeRow](t, paths[3])
+
+	if len(hospitals) != 1 || hospitals[0].HospitalName != "Test General Hospital" {
+		t.Fatalf("hospitals = %+v, want Test General Hospital once", hospitals)
+	}
+	// The echocardiogram's two payer rows share one item.
+	if len(items) != 3 {
+		t.Fatalf("got %d items, want 3", len(items))
+	}
+	if len(standard) != 3 {
+		t.Fatalf("got %d standard charges, want 3", len(standard))
+	}
+	if len(charges) != 3 {
+		t.Fatalf("got %d payer charges, want 3", len(charges))
+	}
+
+	byID := make(map[int64]ItemRow)
+	for _, it := range items {
+		if it.HospitalID != hospitals[0].HospitalID {
+			t.Errorf("item %q hospital_id = %d, want %d", it.Description, it.HospitalID, hospitals[0].HospitalID)
+		}
+		byID[it.ItemID] = it
+	}
+	for _, sc := range standard {
+		if it, ok := byID[sc.ItemID]; !ok {
+			t.Errorf("standard charge %+v references unknown item %d", sc, sc.ItemID)
+		} else if it.Description == "ECHOCARDIOGRAM COMPLETE" && (sc.GrossCharge == nil || *sc.GrossCharge != 1500) {
+			t.Errorf("echocardiogram gross charge = %v, want 1500", sc.GrossCharge)
+		}
+	}
+	payers := make(map[string][]string)
+	for _, c := range charges {
+		it, ok := byID[c.ItemID]
+		if !ok {
+			t.Fatalf("payer charge %+v references unknown item %d", c, c.ItemID)
+		}
+		payers[it.Description] = append(payers[it.Description], *c.PayerName)
+	}
+	slices.Sort(payers["ECHOCARDIOGRAM COMPLETE"])
+	if got := payers["ECHOCARDIOGRAM COMPLETE"]; !slices.Equal(got, []string{"Aetna", "UnitedHealthcare"}) {
+		t.Errorf("echocardiogram payers = %v, want [Aetna UnitedHealthcare]", got)
+	}
+	if got := payers["ACETAMINOPHEN 500MG TABLET"]; !slices.Equal(got, []string{"Cigna"}) {
+		t.Errorf("acetaminophen payers = %v, want [Cigna]", got)
+	}
+
+	for _, p := range paths {
+		if parquetMetadata(t, p)["pricetool.table"] == "" {
+			t.Errorf("%s: missing pricetool.table metadata", p)
+		}
+	}
+
+	// Keys don't change between runs.
+	again := filepath.Join(t.TempDir(), "again.parquet")
+	convertTo(again)
+	items2 := readTable[ItemRow](t, tablePaths(again, true)[1])
+	for i := range items {
+		if items[i].ItemID != items2[i].ItemID {
+			t.Errorf("item %q id changed between runs: %d, %d", items[i].Description, items[i].ItemID, items2[i].ItemID)
+		}
+	}
+}
+
+// TestNormalizedHospitalID checks hospital_id follows hospitalKey, here by
+// the lowest type 2 NPI, in every table.
+func TestNormalizedHospitalID(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "npi.csv")
+	content := `hospital_name,last_updated_on,version,hospital_location,hospital_address,type_2_npi
+Test General Hospital,2024-01-15,2.0.0,"New York, NY","123 Main St",1999999999|1000000000
+description,setting,code|1,code|1|type,standard_charge|gross,payer_name,plan_name,standard_charge|negotiated_dollar,standard_charge|methodology
+ECHO,outpatient,93306,CPT,1500,Aetna,PPO,900,fee_schedule
+`
+	if err := os.WriteFile(in, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultProcessOptions()
+	opts.SkipPayerCharges = false
+	opts.Normalized = true
+	out := filepath.Join(dir, "npi.parquet")
+	info := sourceInfo{Input: in, Provenance: func() Provenance { return Provenance{} }}
+	if _, err := convert(quietLogger(), in, info, out, out, opts); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+
+	want := stableID("npi:1000000000")
+	paths := tablePaths(out, true)
+	hospitals := readTable[HospitalRow](t, paths[0])
+	items := readTable[ItemRow](t, paths[1])
+	standard := readTable[StandardChargeRow](t, paths[2])
+	charges := readTable[PayerChargeRow](t, paths[3])
+	if len(hospitals) != 1 || hospitals[0].HospitalID != want {
+		t.Fatalf("hospitals = %+v, want hospital_id %d", hospitals, want)
+	}
+	if len(items) != 1 || items[0].HospitalID != want || items[0].ItemID != items[0].key() {
+		t.Fatalf("items = %+v, want one of hospital %d keyed by its columns", items, want)
+	}
+	if len(standard) != 1 || standard[0].HospitalID != want || standard[0].ItemID != items[0].ItemID {
+		t.Errorf("standard charges = %+v, want one of item %d", standard, items[0].ItemID)
+	}
+	if len(charges) != 1 || charges[0].HospitalID != want || charges[0].ItemID != items[0].ItemID {
+		t.Errorf("payer charges = %+v, want one of item %d", charges, items[0].ItemID)
+	}
+}
+
+// TestNormalizedItemIDAcrossPrices converts one item at two prices and
+// checks it keeps its item_id, with the prices in standard_charges.
+func TestNormalizedItemIDAcrossPrices(t *testing.T) {
+	opts := DefaultProcessOptions()
+	opts.SkipPayerCharges = false
+	opts.Normalized = true
+	dir := t.TempDir()
+	var items []ItemRow
+	var standard []StandardChargeRow
+	for _, f := range []struct{ date, gross string }{{"2024-01-15", "1500"}, {"2024-02-15", "1650"}} {
+		in := filepath.Join(dir, f.date+".csv")
+		content := `hospital_name,last_updated_on,version,hospital_location,hospital_address
+Test General Hospital,` + f.date + `,2.0.0,"New York, NY","123 Main St"
+description,setting,code|1,code|1|type,standard_charge|gross,standard_charge|discounted_cash,payer_name,plan_name,standard_charge|negotiated_dollar,standard_charge|methodology
+ECHO,outpatient,93306,CPT,` + f.gross + `,750,Aetna,PPO,900,fee_schedule
+`
+		if err := os.WriteFile(in, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out := filepath.Join(dir, f.date+".parquet")
+		info := sourceInfo{Input: in, Provenance: func() Provenance { return Provenance{} }}
+		if _, err := convert(quietLogger(), in, info, out, out, opts); err != nil {
+			t.Fatalf("convert: %v", err)
+		}
+		paths := tablePaths(out, true)
+		items = append(items, readTable[ItemRow](t, paths[1])...)
+		standard = append(standard, readTable[StandardChargeRow](t, paths[2])...)
+	}
+	if len(items) != 2 || items[0].ItemID != items[1].ItemID {
+		t.Fatalf("items = %+v, want the same item_id in both files", items)
+	}
+	if len(standard) != 2 || standard[0].ItemID != items[0].ItemID || standard[1].ItemID != items[0].ItemID ||
+		*standard[0].GrossCharge != 1500 || *standard[1].GrossCharge != 1650 {
+		t.Errorf("standard charges = %+v, want 1500 then 1650 for item %d", standard, items[0].ItemID)
+	}
+}
+
+func TestProcessEntryNormalizedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log.jsonl")
+	opts := DefaultProcessOptions()
+	opts.Normalized = true
+	if err := ProcessEntry(quietLogger(), writeTallCSV(t), dir+"/", logPath, "Test", opts); err != nil {
+		t.Fatalf("ProcessEntry: %v", err)
+	}
+
+	entries, err := readLogEntries(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || len(entries[0].OutputFiles) != len(normalizedTables) {
+		t.Fatalf("log entries = %+v, want one with %d output files", entries, len(normalizedTables))
+	}
+	for _, p := range entries[0].OutputFiles {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("output file: %v", err)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	if len(matches) != len(normalizedTables) {
+		t.Errorf("directory holds %v, want only the %d table files", matches, len(normalizedTables))
+	}
+}
@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// postgresSchemaVersion is the version of the tables PostgresWriter
+// creates, recorded in pricetool_schema. Bump it whenever HospitalChargeRow
+// or the DDL in postgresSchema changes, so existing databases are upgraded
+// on their next load.
+const postgresSchemaVersion = 1
+
+// postgresStaging is the per-load temporary table rows are copied into.
+const postgresStaging = "pricetool_staged"
+
+// PostgreSQL output stores hospitals once, keyed by license or NPI, and
+// their charges by hospital_id:
+//
+//	hospitals  the HospitalRow columns plus hospital_key, type_2_npis and
+//	           the source of the last load
+//	charges    hospital_id plus the other HospitalChargeRow columns
+var pgHospitalColumns, pgChargeColumns = splitHospitalColumns()
+
+// splitHospitalColumns splits chargeColumns into those HospitalRow also
+// has and the rest.
+func splitHospitalColumns() (hospital, charge []rowColumn) {
+	hospitalRow := rowColumnsOf(reflect.TypeFor[HospitalRow]())
+	for _, col := range chargeColumns {
+		if slices.ContainsFunc(hospitalRow, func(h rowColumn) bool { return h.name == col.name }) {
+			hospital = append(hospital, col)
+		} else {
+			charge = append(charge, col)
+		}
+	}
+	return hospital, charge
+}
+
+// PostgresWriter loads rows into a PostgreSQL database with COPY FROM
+// STDIN. Tables are created, or upgraded when an older version of the tool
+// created them, on connect.
+//
+// A load is one transaction: rows are copied into a temporary table as
+// they arrive, and Close upserts the hospital, replaces its charges with
+// the copied rows and commits. Readers see the old rows until then, and a
+// failed load leaves them in place.
+type PostgresWriter struct {
+	ctx      context.Context
+	conn     *pgx.Conn
+	tx       pgx.Tx
+	hospital *HospitalChargeRow // first row, for the hospital columns
+	kv       map[string]string
+}
+
+// NewPostgresWriter connects to the database at connURL (a postgres://
+// URL or key=value connection string) and starts a load.
+func NewPostgresWriter(connURL string) (*PostgresWriter, error) {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, connURL)
+	if err != nil {
+		return nil, fmt.Errorf("connect to postgres: %w", err)
+	}
+	if err := migratePostgres(ctx, conn); err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("begin load: %w", err)
+	}
+	defs := make([]string, len(chargeColumns))
+	for i, col := range chargeColumns {
+		defs[i] = col.name + " " + postgresType(col.kind)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (%s) ON COMMIT DROP", postgresStaging, strings.Join(defs, ", "))); err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("create staging table: %w", err)
+	}
+	return &PostgresWriter{ctx: ctx, conn: conn, tx: tx, kv: make(map[string]string)}, nil
+}
+
+// Write copies rows into the load's staging table.
+func (w *PostgresWriter) Write(rows []HospitalChargeRow) (int, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	if w.hospital == nil {
+		first := rows[0]
+		w.hospital = &first
+	}
+	names := make([]string, len(chargeColumns))
+	for i, col := range chargeColumns {
+		names[i] = col.name
+	}
+	n, err := w.tx.CopyFrom(w.ctx, pgx.Identifier{postgresStaging}, names,
+		pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+			return postgresValues(&rows[i], chargeColumns), nil
+		}))
+	if err != nil {
+		return int(n), fmt.Errorf("copy rows: %w", err)
+	}
+	return int(n), nil
+}
+
+// SetKeyValueMetadata records run metadata. The hospital's name, NPIs
+// and source are taken from it on Close.
+func (w *PostgresWriter) SetKeyValueMetadata(key, value string) {
+	w.kv[key] = value
+}
+
+// Close upserts the hospital, replaces its charges with the loaded rows
+// and commits.
+func (w *PostgresWriter) Close() error {
+	defer w.conn.Close(w.ctx)
+	if err := w.replace(); err != nil {
+		w.tx.Rollback(w.ctx)
+		return err
+	}
+	if err := w.tx.Commit(w.ctx); err != nil {
+		return fmt.Errorf("commit load: %w", err)
+	}
+	return nil
+}
+
+// Abort rolls the load back, leaving the hospital's rows as they were,
+// and closes the connection.
+func (w *PostgresWriter) Abort() {
+	w.tx.Rollback(w.ctx)
+	w.conn.Close(w.ctx)
+}
+
+func (w *PostgresWriter) replace() error {
+	hospital := w.hospital
+	if hospital == nil {
+		hospital = &HospitalChargeRow{}
+	}
+	if name := w.kv[metadataPrefix+"hospital_name"]; name != "" {
+		hospital.HospitalName = name
+	}
+	var npis []string
+	if v := w.kv[metadataPrefix+"type_2_npis"]; v != "" {
+		npis = strings.Split(v, "|")
+	}
+
+	cols := []string{"hospital_key", "type_2_npis", "source_url", "source_sha256"}
+	args := []any{
+		hospitalKey(hospital.LicenseState, hospital.LicenseNumber, npis, hospital.HospitalName),
+		npis, w.kv[metadataPrefix+"source.url"], w.kv[metadataPrefix+"source.sha256"],
+	}
+	for _, col := range pgHospitalColumns {
+		cols = append(cols, col.name)
+	}
+	args = append(args, postgresValues(hospital, pgHospitalColumns)...)
+	params := make([]string, len(cols))
+	updates := make([]string, 0, len(cols))
+	for i, col := range cols {
+		params[i] = fmt.Sprintf("$%d", i+1)
+		if col != "hospital_key" {
+			updates = append(updates, col+" = EXCLUDED."+col)
+		}
+	}
+	var id int64
+	err := w.tx.QueryRow(w.ctx, fmt.Sprintf(`INSERT INTO hospitals (%s, loaded_at) VALUES (%s, now())
+		ON CONFLICT (hospital_key) DO UPDATE SET %s, loaded_at = now()
+		RETURNING hospital_id`, strings.Join(cols, ", "), strings.Join(params, ", "), strings.Join(updates, ", ")),
+		args...).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("upsert hospital: %w", err)
+	}
+
+	if _, err := w.tx.Exec(w.ctx, "DELETE FROM charges WHERE hospital_id = $1", id); err != nil {
+		return fmt.Errorf("delete previous charges: %w", err)
+	}
+	names := make([]string, len(pgChargeColumns))
+	for i, col := range pgChargeColumns {
+		names[i] = col.name
+	}
+	list := strings.Join(names, ", ")
+	_, err = w.tx.Exec(w.ctx, fmt.Sprintf("INSERT INTO charges (hospital_id, %s) SELECT $1, %s FROM %s", list, list, postgresStaging), id)
+	if err != nil {
+		return fmt.Errorf("insert charges: %w", err)
+	}
+	return nil
+}
+
+// postgresValues returns the values of cols in row, nil for nulls.
+func postgresValues(row *HospitalChargeRow, cols []rowColumn) []any {
+	v := reflect.ValueOf(row).Elem()
+	values := make([]any, len(cols))
+	for i, col := range cols {
+		if f, ok := col.value(v); ok {
+			values[i] = f.Interface()
+		}
+	}
+	return values
+}
+
+// postgresType returns the PostgreSQL type of a column kind.
+func postgresType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Float64:
+		return "double precision"
+	case reflect.Bool:
+		return "boolean"
+	}
+	return "text"
+}
+
+// postgresSchema returns the statements that create the tables of schema
+// version postgresSchemaVersion, or upgrade older ones to it. Every
+// statement can be rerun.
+func postgresSchema() []string {
+	hospitalDefs := []string{
+		"hospital_id bigserial PRIMARY KEY",
+		"hospital_key text NOT NULL UNIQUE",
+		"type_2_npis text[]",
+		"source_url text",
+		"source_sha256 text",
+		"loaded_at timestamptz NOT NULL DEFAULT now()",
+	}
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS hospitals (" + strings.Join(hospitalDefs, ", ") + ")",
+		"CREATE TABLE IF NOT EXISTS charges (hospital_id bigint NOT NULL REFERENCES hospitals ON DELETE CASCADE)",
+	}
+	for _, col := range pgHospitalColumns {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE hospitals ADD COLUMN IF NOT EXISTS %s %s", col.name, postgresType(col.kind)))
+	}
+	for _, col := range pgChargeColumns {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE charges ADD COLUMN IF NOT EXISTS %s %s", col.name, postgresType(col.kind)))
+	}
+	stmts = append(stmts, "CREATE INDEX IF NOT EXISTS charges_hospital_id_idx ON charges (hospital_id)")
+	for _, col := range indexCodeColumns {
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX IF NOT EXISTS charges_%s_idx ON charges (%s)", col, col))
+	}
+	return stmts
+}
+
+// migratePostgres brings the database's tables to postgresSchemaVersion.
+// Concurrent loads wait on an advisory lock while one of them migrates.
+func migratePostgres(ctx context.Context, conn *pgx.Conn) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin migration: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('pricetool_schema'))"); err != nil {
+		return fmt.Errorf("lock schema: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "CREATE TABLE IF NOT EXISTS pricetool_schema (version integer NOT NULL, upgraded_at timestamptz NOT NULL DEFAULT now())"); err != nil {
+		return fmt.Errorf("create pricetool_schema: %w", err)
+	}
+	var version int
+	if err := tx.QueryRow(ctx, "SELECT coalesce(max(version), 0) FROM pricetool_schema").Scan(&version); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	if version > postgresSchemaVersion {
+		return fmt.Errorf("database schema version %d is newer than this tool's %d", version, postgresSchemaVersion)
+	}
+	if version == postgresSchemaVersion {
+		return nil
+	}
+	for _, stmt := range postgresSchema() {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("upgrade schema to version %d: %s: %w", postgresSchemaVersion, stmt, err)
+		}
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO pricetool_schema (version) VALUES ($1)", postgresSchemaVersion); err != nil {
+		return fmt.Errorf("record schema version: %w", err)
+	}
+	return tx.Commit(ctx)
+}
+
+// isPostgresURL reports whether an output location is a PostgreSQL
+// connection URL.
+func isPostgresURL(s string) bool {
+	return strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://")
+}
+
+// RedactURL hides the password of a connection URL for logging. Other
+// strings are returned unchanged.
+func RedactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
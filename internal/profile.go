@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// clientProfile is a browser identity: the TLS ClientHello it sends and the
+// request headers that go with it, in the browser's order. The User-Agent
+// matches the pinned hello so the two don't contradict each other.
+type clientProfile struct {
+	Name    string
+	Hello   utls.ClientHelloID
+	Headers [][2]string // name, value, in send order
+}
+
+// clientProfiles are the selectable profiles, by name.
+var clientProfiles = map[string]*clientProfile{
+	"chrome": {
+		Name:  "chrome",
+		Hello: utls.HelloChrome_133,
+		Headers: [][2]string{
+			{"Sec-Ch-Ua", `"Not(A:Brand";v="99", "Google Chrome";v="133", "Chromium";v="133"`},
+			{"Sec-Ch-Ua-Mobile", "?0"},
+			{"Sec-Ch-Ua-Platform", `"macOS"`},
+			{"Upgrade-Insecure-Requests", "1"},
+			{"User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/133.0.0.0 Safari/537.36"},
+			{"Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8"},
+			{"Sec-Fetch-Site", "none"},
+			{"Sec-Fetch-Mode", "navigate"},
+			{"Sec-Fetch-User", "?1"},
+			{"Sec-Fetch-Dest", "document"},
+			{"Accept-Encoding", "gzip, deflate, br, zstd"},
+			{"Accept-Language", "en-US,en;q=0.9"},
+		},
+	},
+	"firefox": {
+		Name:  "firefox",
+		Hello: utls.HelloFirefox_120,
+		Headers: [][2]string{
+			{"User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:120.0) Gecko/20100101 Firefox/120.0"},
+			{"Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8"},
+			{"Accept-Language", "en-US,en;q=0.5"},
+			{"Accept-Encoding", "gzip, deflate, br"},
+			{"Upgrade-Insecure-Requests", "1"},
+			{"Sec-Fetch-Dest", "document"},
+			{"Sec-Fetch-Mode", "navigate"},
+			{"Sec-Fetch-Site", "none"},
+			{"Sec-Fetch-User", "?1"},
+		},
+	},
+	"safari": {
+		Name:  "safari",
+		Hello: utls.HelloSafari_16_0,
+		Headers: [][2]string{
+			{"Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+			{"Sec-Fetch-Site", "none"},
+			{"Accept-Encoding", "gzip, deflate, br"},
+			{"Sec-Fetch-Mode", "navigate"},
+			{"User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Safari/605.1.15"},
+			{"Accept-Language", "en-US,en;q=0.9"},
+			{"Sec-Fetch-Dest", "document"},
+		},
+	},
+}
+
+// defaultProfiles is the fallback order used unless configured otherwise.
+var defaultProfiles = []string{"chrome", "firefox", "safari"}
+
+// ValidateProfiles checks that every name is a known client profile.
+func ValidateProfiles(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("no client profiles given")
+	}
+	for _, n := range names {
+		if clientProfiles[n] == nil {
+			return fmt.Errorf("unknown client profile %q (want chrome, firefox or safari)", n)
+		}
+	}
+	return nil
+}
+
+// apply replaces any profile headers in h with p's. A resumed download's
+// "Accept-Encoding: identity" is kept.
+func (p *clientProfile) apply(h http.Header) {
+	identity := h.Get("Accept-Encoding") == "identity"
+	for _, other := range clientProfiles {
+		for _, kv := range other.Headers {
+			h.Del(kv[0])
+		}
+	}
+	for _, kv := range p.Headers {
+		h.Set(kv[0], kv[1])
+	}
+	if identity {
+		h.Set("Accept-Encoding", "identity")
+	}
+}
+
+// hostProfiles remembers the last profile that wasn't blocked by each host,
+// so later requests start with it.
+var hostProfiles = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// profileChoice travels in a request's context so the transport can match
+// the TLS hello to the headers and fall back on a block.
+type profileChoice struct {
+	profile *clientProfile
+	names   []string // the host's fallback order
+}
+
+type profileCtxKey struct{}
+
+// withProfile picks the current profile for req's host from names,
+// applies its headers and records the choice in the request context.
+func withProfile(req *http.Request, names []string) *http.Request {
+	if len(names) == 0 {
+		names = defaultProfiles
+	}
+	host := strings.ToLower(req.URL.Hostname())
+	hostProfiles.Lock()
+	name := hostProfiles.m[host]
+	hostProfiles.Unlock()
+	if !slices.Contains(names, name) {
+		name = names[0]
+	}
+	return setProfile(req, &profileChoice{profile: clientProfiles[name], names: names})
+}
+
+func setProfile(req *http.Request, choice *profileChoice) *http.Request {
+	choice.profile.apply(req.Header)
+	return req.WithContext(context.WithValue(req.Context(), profileCtxKey{}, choice))
+}
+
+// requestProfile returns the profile chosen for req, defaulting to chrome.
+func requestProfile(req *http.Request) *profileChoice {
+	if c, ok := req.Context().Value(profileCtxKey{}).(*profileChoice); ok {
+		return c
+	}
+	return &profileChoice{profile: clientProfiles["chrome"], names: []string{"chrome"}}
+}
+
+// advanceProfile moves req's host on to the profile after the one req
+// used. It reports false when the host has no other profile to try.
+func advanceProfile(req *http.Request) bool {
+	choice := requestProfile(req)
+	if len(choice.names) < 2 {
+		return false
+	}
+	i := slices.Index(choice.names, choice.profile.Name)
+	hostProfiles.Lock()
+	hostProfiles.m[strings.ToLower(req.URL.Hostname())] = choice.names[(i+1)%len(choice.names)]
+	hostProfiles.Unlock()
+	return true
+}
+
+// nextProfile advances req's host to its next profile and returns a copy
+// of req using it, or nil when there is no other profile.
+func nextProfile(req *http.Request) *http.Request {
+	if !advanceProfile(req) {
+		return nil
+	}
+	choice := requestProfile(req)
+	i := slices.Index(choice.names, choice.profile.Name)
+	next := clientProfiles[choice.names[(i+1)%len(choice.names)]]
+	return setProfile(req.Clone(req.Context()), &profileChoice{profile: next, names: choice.names})
+}
+
+// writeRequest writes a bodiless HTTP/1.1 request with its headers in the
+// profile's order; headers the profile doesn't mention (Range, Referer on
+// redirects, ...) follow in sorted order. Go's Request.Write always sorts.
+func writeRequest(w io.Writer, req *http.Request, p *clientProfile) error {
+	if req.Body != nil && req.Body != http.NoBody {
+		return req.Write(w)
+	}
+	clean := strings.NewReplacer("\r", " ", "\n", " ")
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), clean.Replace(host))
+	if req.Close {
+		bw.WriteString("Connection: close\r\n")
+	}
+	written := make(map[string]bool)
+	writeHeader := func(k string) {
+		for _, v := range req.Header[k] {
+			fmt.Fprintf(bw, "%s: %s\r\n", k, clean.Replace(v))
+		}
+		written[k] = true
+	}
+	for _, kv := range p.Headers {
+		writeHeader(http.CanonicalHeaderKey(kv[0]))
+	}
+	var rest []string
+	for k := range req.Header {
+		if !written[k] {
+			rest = append(rest, k)
+		}
+	}
+	slices.Sort(rest)
+	for _, k := range rest {
+		writeHeader(k)
+	}
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resetHostProfiles forgets the profile state for every host before and
+// after the test; all test servers share 127.0.0.1.
+func resetHostProfiles(t *testing.T) {
+	reset := func() {
+		hostProfiles.Lock()
+		clear(hostProfiles.m)
+		hostProfiles.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestFetchFallsBackToNextProfile(t *testing.T) {
+	resetHostProfiles(t)
+	var agents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		if !strings.Contains(r.UserAgent(), "Firefox") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write(testBody)
+	}))
+	defer srv.Close()
+
+	for range 2 {
+		f, err := os.Create(filepath.Join(t.TempDir(), "download.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := fetchToFile(quietLogger(), f, srv.URL+"/charges.csv", testPolicy())
+		f.Close()
+		if err != nil {
+			t.Fatalf("fetchToFile: %v", err)
+		}
+		if result.N != int64(len(testBody)) {
+			t.Errorf("got %d bytes, want %d", result.N, len(testBody))
+		}
+	}
+
+	// Chrome is blocked once; the host then sticks with Firefox.
+	if len(agents) != 3 || !strings.Contains(agents[0], "Chrome") ||
+		!strings.Contains(agents[1], "Firefox") || !strings.Contains(agents[2], "Firefox") {
+		t.Errorf("user agents = %q, want Chrome, Firefox, Firefox", agents)
+	}
+}
+
+func TestWriteRequestHeaderOrder(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.com/charges.csv?v=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = withProfile(req, []string{"firefox"})
+	req.Header.Set("Range", "bytes=100-")
+
+	var buf bytes.Buffer
+	if err := writeRequest(&buf, req, clientProfiles["firefox"]); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\r\n")
+	want := []string{"GET /charges.csv?v=2 HTTP/1.1", "Host: example.com"}
+	for _, kv := range clientProfiles["firefox"].Headers {
+		want = append(want, kv[0]+": "+kv[1])
+	}
+	want = append(want, "Range: bytes=100-", "", "")
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("request =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metadataPrefix namespaces the key-value metadata pricetool writes into
+// Parquet footers.
+const metadataPrefix = "pricetool."
+
+// sourceInfo describes the input of a conversion for logs and the Parquet
+// footer.
+type sourceInfo struct {
+	Input        string // URL or path as given
+	LocationName string // CMS HPT location name, if known
+
+	// Provenance is called once the input has been read to the end, when
+	// the hashes of a streamed input are known.
+	Provenance func() Provenance
+}
+
+// runKeyValues returns the Parquet key-value metadata describing a
+// finished conversion: where the input came from, what it contained and
+// what produced the file.
+func runKeyValues(info sourceInfo, meta RunMeta, format string, inputCount int64, rows int, convertedAt time.Time) [][2]string {
+	kv := [][2]string{
+		{metadataPrefix + "tool_version", ToolVersion},
+		{metadataPrefix + "converted_at", convertedAt.UTC().Format(time.RFC3339)},
+		{metadataPrefix + "source.url", info.Input},
+		{metadataPrefix + "format", format},
+		{metadataPrefix + "input_count", strconv.FormatInt(inputCount, 10)},
+		{metadataPrefix + "row_count", strconv.Itoa(rows)},
+	}
+	for _, f := range [][2]string{
+		{"cms_hpt_location_name", info.LocationName},
+		{"hospital_name", meta.HospitalName},
+		{"schema_version", meta.Version},
+		{"last_updated_on", meta.LastUpdatedOn},
+		{"type_2_npis", strings.Join(meta.Type2NPIs, "|")},
+	} {
+		if f[1] != "" {
+			kv = append(kv, [2]string{metadataPrefix + f[0], f[1]})
+		}
+	}
+	return append(kv, info.Provenance().keyValues()...)
+}
+
+// Provenance identifies the exact source artifact an output was converted
+// from. The raw hash covers the file as served (after Content-Encoding is
+// removed, before any gzip or zip is unpacked); the inner hash covers the
+// CSV or JSON actually parsed when that differs.
+type Provenance struct {
+	FinalURL     string `json:"final_url,omitempty"` // after redirects
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+
+	SHA256 string `json:"source_sha256,omitempty"`
+	Size   int64  `json:"source_bytes,omitempty"`
+
+	InnerFile   string `json:"inner_file,omitempty"` // zip member name, or the gunzipped name
+	InnerSHA256 string `json:"inner_sha256,omitempty"`
+	InnerSize   int64  `json:"inner_bytes,omitempty"`
+}
+
+// gunzippedName returns the name a gzip-compressed download has once
+// decompressed: its Content-Disposition filename, or else the last element
+// of the final URL's path, without ".gz".
+func gunzippedName(finalURL, filename string) string {
+	name := filename
+	if u, err := url.Parse(finalURL); name == "" && err == nil {
+		name = path.Base(u.Path)
+	}
+	if strings.EqualFold(path.Ext(name), ".gz") {
+		name = name[:len(name)-len(".gz")]
+	}
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// responseSource records the response headers that identify a download.
+func responseSource(resp *http.Response) Provenance {
+	return Provenance{
+		FinalURL:     resp.Request.URL.String(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentType:  resp.Header.Get("Content-Type"),
+	}
+}
+
+// keyValues returns the provenance as Parquet key-value metadata, skipping
+// empty fields.
+func (p Provenance) keyValues() [][2]string {
+	var kv [][2]string
+	add := func(k, v string) {
+		if v != "" {
+			kv = append(kv, [2]string{metadataPrefix + "source." + k, v})
+		}
+	}
+	size := func(n int64) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	add("final_url", p.FinalURL)
+	add("etag", p.ETag)
+	add("last_modified", p.LastModified)
+	add("content_type", p.ContentType)
+	add("sha256", p.SHA256)
+	add("bytes", size(p.Size))
+	add("inner_file", p.InnerFile)
+	add("inner_sha256", p.InnerSHA256)
+	add("inner_bytes", size(p.InnerSize))
+	return kv
+}
+
+// hashFile returns the hex SHA-256 and size of a file.
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// hashingReader computes the SHA-256 of everything read through it.
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: sha256.New()}
+}
+
+func (r *hashingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.h.Write(b[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// sum returns the hex SHA-256 and byte count read so far.
+func (r *hashingReader) sum() (string, int64) {
+	return hex.EncodeToString(r.h.Sum(nil)), r.n
+}
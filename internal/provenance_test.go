@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// useTestServer makes chromeClient trust srv's certificate for the rest of
+// the test, so code that upgrades URLs to https can reach it.
+func useTestServer(t *testing.T, srv *httptest.Server) {
+	tr := chromeClient.Transport.(*utlsTransport)
+	saved := tr.rootCAs
+	tr.rootCAs = x509.NewCertPool()
+	tr.rootCAs.AddCert(srv.Certificate())
+	t.Cleanup(func() {
+		tr.CloseIdleConnections()
+		tr.rootCAs = saved
+	})
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// parquetMetadata returns the key-value metadata in a Parquet footer.
+func parquetMetadata(t *testing.T, path string) map[string]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf, err := parquet.OpenFile(f, fi.Size())
+	if err != nil {
+		t.Fatalf("open parquet: %v", err)
+	}
+	kv := make(map[string]string)
+	for _, m := range pf.Metadata().KeyValueMetadata {
+		kv[m.Key] = m.Value
+	}
+	return kv
+}
+
+// zipBytes returns a zip archive holding data under name.
+func zipBytes(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessEntryRecordsProvenance(t *testing.T) {
+	csv, err := os.ReadFile(writeTallCSV(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipped := zipBytes(t, "2026/tall.csv", csv)
+	gzipped := gzipBytes(t, csv)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/charges.zip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Feb 2026 10:00:00 GMT")
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write(zipped)
+	})
+	mux.HandleFunc("/tall.csv.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(gzipped)
+	})
+	srv, _ := tlsServer(t, true, mux)
+	useTestServer(t, srv)
+
+	for _, tt := range []struct {
+		name   string
+		path   string
+		stream bool
+		want   Provenance
+	}{
+		{
+			name: "zip download",
+			path: "/charges.zip",
+			want: Provenance{
+				ETag: `"v1"`, LastModified: "Mon, 02 Feb 2026 10:00:00 GMT", ContentType: "application/zip",
+				SHA256: sha256Hex(zipped), Size: int64(len(zipped)),
+				InnerFile: "2026/tall.csv", InnerSHA256: sha256Hex(csv), InnerSize: int64(len(csv)),
+			},
+		},
+		{
+			name: "gzip download",
+			path: "/tall.csv.gz",
+			want: Provenance{
+				ContentType: "application/gzip",
+				SHA256:      sha256Hex(gzipped), Size: int64(len(gzipped)),
+				InnerFile: "tall.csv", InnerSHA256: sha256Hex(csv), InnerSize: int64(len(csv)),
+			},
+		},
+		{
+			name:   "gzip stream",
+			path:   "/tall.csv.gz",
+			stream: true,
+			want: Provenance{
+				ContentType: "application/gzip",
+				SHA256:      sha256Hex(gzipped), Size: int64(len(gzipped)),
+				InnerFile: "tall.csv", InnerSHA256: sha256Hex(csv), InnerSize: int64(len(csv)),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			out := filepath.Join(dir, "out.parquet")
+			logPath := filepath.Join(dir, "log.jsonl")
+			opts := DefaultProcessOptions()
+			opts.Download = testPolicy()
+			opts.Stream = tt.stream
+			var downloads int
+			opts.DownloadDone = func() { downloads++ }
+
+			if err := ProcessEntry(quietLogger(), srv.URL+tt.path, out, logPath, "Test", opts); err != nil {
+				t.Fatalf("ProcessEntry: %v", err)
+			}
+			if want := map[bool]int{false: 1, true: 0}[tt.stream]; downloads != want {
+				t.Errorf("DownloadDone called %d times, want %d", downloads, want)
+			}
+
+			want := tt.want
+			want.FinalURL = srv.URL + tt.path
+			entries, err := readLogEntries(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Provenance != want {
+				t.Errorf("log provenance = %+v, want %+v", entries, want)
+			}
+
+			kv := parquetMetadata(t, out)
+			for _, pair := range want.keyValues() {
+				if kv[pair[0]] != pair[1] {
+					t.Errorf("parquet metadata %s = %q, want %q", pair[0], kv[pair[0]], pair[1])
+				}
+			}
+		})
+	}
+}
+
+func TestParquetRunMetadata(t *testing.T) {
+	input := writeTallCSV(t)
+	data, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.parquet")
+	if err := ProcessEntry(quietLogger(), input, out, filepath.Join(dir, "log.jsonl"), "Test General - Main Campus", DefaultProcessOptions()); err != nil {
+		t.Fatalf("ProcessEntry: %v", err)
+	}
+
+	kv := parquetMetadata(t, out)
+	for key, want := range map[string]string{
+		"pricetool.source.url":            input,
+		"pricetool.cms_hpt_location_name": "Test General - Main Campus",
+		"pricetool.hospital_name":         "Test General Hospital",
+		"pricetool.format":                "tall",
+		"pricetool.row_count":             strconv.Itoa(len(readParquet(t, out))),
+		"pricetool.tool_version":          ToolVersion,
+		"pricetool.source.sha256":         sha256Hex(data),
+	} {
+		if kv[key] != want {
+			t.Errorf("%s = %q, want %q", key, kv[key], want)
+		}
+	}
+	for _, key := range []string{"pricetool.schema_version", "pricetool.input_count"} {
+		if kv[key] == "" {
+			t.Errorf("%s missing", key)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, kv["pricetool.converted_at"]); err != nil {
+		t.Errorf("converted_at: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// connectProxy is a minimal HTTP CONNECT proxy that requires the given
+// Proxy-Authorization header.
+func connectProxy(t *testing.T, wantAuth string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != wantAuth {
+			http.Error(w, "auth required", http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		client, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		pipe(client, upstream)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// socks5Proxy is a minimal no-auth SOCKS5 server supporting CONNECT to
+// IPv4 addresses.
+func socks5Proxy(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				br := bufio.NewReader(c)
+				var hello [2]byte
+				io.ReadFull(br, hello[:])
+				io.CopyN(io.Discard, br, int64(hello[1]))
+				c.Write([]byte{5, 0})
+
+				var req [10]byte // ver, cmd, rsv, atyp=1, ipv4, port
+				if _, err := io.ReadFull(br, req[:]); err != nil || req[3] != 1 {
+					c.Close()
+					return
+				}
+				addr := net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(req[8:]))))
+				upstream, err := net.Dial("tcp", addr)
+				if err != nil {
+					c.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					c.Close()
+					return
+				}
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				pipe(c, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func pipe(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// getThrough sends a GET for target over a tunnelled connection.
+func getThrough(t *testing.T, conn net.Conn, target string) string {
+	t.Helper()
+	defer conn.Close()
+	req, _ := http.NewRequest("GET", target, nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestDialProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer target.Close()
+	addr := target.Listener.Addr().String()
+
+	connect := connectProxy(t, "Basic dXNlcjpwYXNz") // user:pass
+	tests := []struct {
+		name  string
+		proxy string
+	}{
+		{"connect", "http://user:pass@" + connect.Listener.Addr().String()},
+		{"socks5", "socks5://" + socks5Proxy(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse(tt.proxy)
+			conn, err := dialProxy(t.Context(), u, addr)
+			if err != nil {
+				t.Fatalf("dialProxy: %v", err)
+			}
+			if got := getThrough(t, conn, target.URL); got != "hello" {
+				t.Errorf("body = %q, want %q", got, "hello")
+			}
+		})
+	}
+
+	u, _ := url.Parse("http://wrong:creds@" + connect.Listener.Addr().String())
+	if _, err := dialProxy(t.Context(), u, addr); err == nil {
+		t.Error("expected CONNECT with bad credentials to fail")
+	}
+}
+
+func TestProxyPoolRotate(t *testing.T) {
+	pool, err := NewProxyPool([]string{"http://a:3128", "socks5://b:1080", "https://c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &url.URL{Scheme: "https", Host: "cdn.example.com"}
+	first, _ := pool.proxyFor(target)
+	if again, _ := pool.proxyFor(target); again != first {
+		t.Fatalf("host moved from %s to %s without a block", first, again)
+	}
+	if !pool.rotate("cdn.example.com") {
+		t.Fatal("rotate returned false with 3 proxies")
+	}
+	if next, _ := pool.proxyFor(target); next == first {
+		t.Errorf("host still on %s after rotate", first)
+	}
+
+	single, _ := NewProxyPool([]string{"http://a:3128"})
+	if single.rotate("cdn.example.com") {
+		t.Error("rotate returned true with a single proxy")
+	}
+
+	if _, err := NewProxyPool([]string{"ftp://a"}); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
+
+func TestFetchRotatesProxyOnBlock(t *testing.T) {
+	// Plain-http requests go through the proxy as absolute-URI GETs, so
+	// each "proxy" can answer directly.
+	var blocked, served atomic.Int32
+	blockProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blocked.Add(1)
+		http.Error(w, "Access denied", http.StatusForbidden)
+	}))
+	defer blockProxy.Close()
+	okProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		w.Write(testBody)
+	}))
+	defer okProxy.Close()
+
+	saved := downloadProxies
+	t.Cleanup(func() { downloadProxies = saved })
+	if err := UseProxies([]string{blockProxy.URL, okProxy.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "download.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := fetchToFile(quietLogger(), f, "http://mrf.example.com/charges.csv", testPolicy()); err != nil {
+		t.Fatalf("fetchToFile: %v", err)
+	}
+	data, _ := os.ReadFile(f.Name())
+	if !bytes.Equal(data, testBody) {
+		t.Fatalf("downloaded %d bytes, want %d identical bytes", len(data), len(testBody))
+	}
+	if blocked.Load() > 1 || served.Load() != 1 {
+		t.Errorf("requests: blocked=%d served=%d, want at most 1 blocked then 1 served", blocked.Load(), served.Load())
+	}
+}
@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Output formats for ProcessOptions.OutputFormat.
+const (
+	FormatParquet = "parquet"
+	FormatNDJSON  = "ndjson"
+	FormatCSV     = "csv"
+	FormatArrow   = "arrow" // Arrow IPC file, also readable as Feather v2
+	FormatDuckDB  = "duckdb"
+	// FormatPostgres loads into a PostgreSQL database; the output is a
+	// postgres:// URL rather than a file.
+	FormatPostgres = "postgres"
+)
+
+// outputFormats are the accepted output formats with their file extensions.
+// Database formats that aren't files have none.
+var outputFormats = map[string]string{
+	FormatParquet:  ".parquet",
+	FormatNDJSON:   ".ndjson",
+	FormatCSV:      ".csv",
+	FormatArrow:    ".arrow",
+	FormatDuckDB:   ".duckdb",
+	FormatPostgres: "",
+}
+
+// ValidateOutputFormat reports an unknown output format. Empty means
+// FormatParquet.
+func ValidateOutputFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	if _, ok := outputFormats[format]; !ok {
+		names := make([]string, 0, len(outputFormats))
+		for name := range outputFormats {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("unknown output format %q (want one of %s)", format, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// outputExt returns the file extension of an output format.
+func outputExt(format string) string {
+	if ext, ok := outputFormats[format]; ok {
+		return ext
+	}
+	return outputFormats[FormatParquet]
+}
+
+// RowWriter is the output side of a conversion. ChargeWriter and
+// NormalizedWriter write Parquet; NDJSONWriter, CSVWriter, ArrowWriter,
+// DuckDBWriter and PostgresWriter write the same HospitalChargeRow columns
+// for consumers that don't read Parquet.
+type RowWriter interface {
+	Write(rows []HospitalChargeRow) (int, error)
+	// SetKeyValueMetadata records run metadata where the format has room
+	// for it. It may be called any time before Close.
+	SetKeyValueMetadata(key, value string)
+	Close() error
+	// Abort releases what the writer holds without finishing the output,
+	// for a conversion that failed before Close.
+	Abort()
+}
+
+// newRowWriter creates the writer for the output format and layout chosen
+// in opts.
+func newRowWriter(outputPath string, opts ProcessOptions) (RowWriter, error) {
+	switch opts.OutputFormat {
+	case FormatNDJSON:
+		return NewNDJSONWriter(outputPath)
+	case FormatCSV:
+		return NewCSVWriter(outputPath)
+	case FormatArrow:
+		return NewArrowWriter(outputPath)
+	case FormatDuckDB:
+		w, err := NewDuckDBWriter(outputPath)
+		if err != nil {
+			return nil, err
+		}
+		w.SortOrder = opts.SortOrder
+		return w, nil
+	case FormatPostgres:
+		return NewPostgresWriter(outputPath)
+	}
+	if opts.Normalized {
+		return NewNormalizedWriter(outputPath, opts.Writer)
+	}
+	w, err := NewChargeWriter(outputPath, opts.Writer)
+	if err != nil {
+		return nil, err
+	}
+	w.SortOrder = opts.SortOrder
+	return w, nil
+}
+
+// rowColumn is a HospitalChargeRow column as the non-Parquet writers see
+// it: the Parquet column name and the struct field that holds it.
+type rowColumn struct {
+	name     string
+	field    int
+	kind     reflect.Kind // string, float64 or bool, after pointer indirection
+	optional bool
+}
+
+// chargeColumns are the columns of HospitalChargeRow in schema order, so
+// every output format shares the Parquet column names.
+var chargeColumns = rowColumnsOf(reflect.TypeFor[HospitalChargeRow]())
+
+func rowColumnsOf(t reflect.Type) []rowColumn {
+	var columns []rowColumn
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("parquet"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		col := rowColumn{name: name, field: i, kind: f.Type.Kind()}
+		if col.kind == reflect.Pointer {
+			col.kind = f.Type.Elem().Kind()
+			col.optional = true
+		}
+		columns = append(columns, col)
+	}
+	return columns
+}
+
+// value returns the column's value in row, or false for null.
+func (c rowColumn) value(row reflect.Value) (reflect.Value, bool) {
+	v := row.Field(c.field)
+	if c.optional {
+		if v.IsNil() {
+			return v, false
+		}
+		v = v.Elem()
+	}
+	return v, true
+}
+
+// NDJSONWriter writes one JSON object per row, keyed by column name in
+// schema order. Null columns are left out. NDJSON has no place for file
+// metadata, so SetKeyValueMetadata is a no-op; the run's provenance is in
+// the log entry.
+type NDJSONWriter struct {
+	file *os.File
+	buf  *bufio.Writer
+	line []byte
+}
+
+// NewNDJSONWriter creates an NDJSON file.
+func NewNDJSONWriter(filename string) (*NDJSONWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("create ndjson file: %w", err)
+	}
+	return &NDJSONWriter{file: file, buf: bufio.NewWriterSize(file, 1<<20)}, nil
+}
+
+// Write appends rows to the file.
+func (w *NDJSONWriter) Write(rows []HospitalChargeRow) (int, error) {
+	for i := range rows {
+		row := reflect.ValueOf(&rows[i]).Elem()
+		w.line = append(w.line[:0], '{')
+		for _, col := range chargeColumns {
+			v, ok := col.value(row)
+			if !ok {
+				continue
+			}
+			if len(w.line) > 1 {
+				w.line = append(w.line, ',')
+			}
+			w.line = append(w.line, '"')
+			w.line = append(w.line, col.name...)
+			w.line = append(w.line, '"', ':')
+			switch col.kind {
+			case reflect.String:
+				s, err := json.Marshal(v.String())
+				if err != nil {
+					return i, err
+				}
+				w.line = append(w.line, s...)
+			case reflect.Float64:
+				if f := v.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+					w.line = append(w.line, "null"...)
+				} else {
+					w.line = strconv.AppendFloat(w.line, f, 'f', -1, 64)
+				}
+			case reflect.Bool:
+				w.line = strconv.AppendBool(w.line, v.Bool())
+			}
+		}
+		w.line = append(w.line, '}', '\n')
+		if _, err := w.buf.Write(w.line); err != nil {
+			return i, fmt.Errorf("write ndjson: %w", err)
+		}
+	}
+	return len(rows), nil
+}
+
+// SetKeyValueMetadata does nothing; see NDJSONWriter.
+func (w *NDJSONWriter) SetKeyValueMetadata(key, value string) {}
+
+// Close flushes and closes the file.
+func (w *NDJSONWriter) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("write ndjson: %w", err)
+	}
+	return w.file.Close()
+}
+
+// Abort closes and removes the file, so a partial output isn't mistaken
+// for a finished one.
+func (w *NDJSONWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// CSVWriter writes rows as a CSV file with a header of column names in
+// schema order, one row per HospitalChargeRow (unlike the CMS wide and
+// tall layouts). Nulls are empty fields. Like NDJSONWriter it drops file
+// metadata.
+type CSVWriter struct {
+	file   *os.File
+	csv    *csv.Writer
+	record []string
+}
+
+// NewCSVWriter creates a CSV file and writes its header.
+func NewCSVWriter(filename string) (*CSVWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("create csv file: %w", err)
+	}
+	w := &CSVWriter{file: file, csv: csv.NewWriter(file), record: make([]string, len(chargeColumns))}
+	for i, col := range chargeColumns {
+		w.record[i] = col.name
+	}
+	if err := w.csv.Write(w.record); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write csv header: %w", err)
+	}
+	return w, nil
+}
+
+// Write appends rows to the file.
+func (w *CSVWriter) Write(rows []HospitalChargeRow) (int, error) {
+	for i := range rows {
+		row := reflect.ValueOf(&rows[i]).Elem()
+		for j, col := range chargeColumns {
+			v, ok := col.value(row)
+			switch {
+			case !ok:
+				w.record[j] = ""
+			case col.kind == reflect.String:
+				w.record[j] = v.String()
+			case col.kind == reflect.Float64:
+				w.record[j] = strconv.FormatFloat(v.Float(), 'f', -1, 64)
+			case col.kind == reflect.Bool:
+				w.record[j] = strconv.FormatBool(v.Bool())
+			}
+		}
+		if err := w.csv.Write(w.record); err != nil {
+			return i, fmt.Errorf("write csv: %w", err)
+		}
+	}
+	return len(rows), nil
+}
+
+// SetKeyValueMetadata does nothing; see CSVWriter.
+func (w *CSVWriter) SetKeyValueMetadata(key, value string) {}
+
+// Close flushes and closes the file.
+func (w *CSVWriter) Close() error {
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("write csv: %w", err)
+	}
+	return w.file.Close()
+}
+
+// Abort closes and removes the file.
+func (w *CSVWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+)
+
+// inputRows reads every row of a CSV MRF in input order, as the
+// non-Parquet writers receive them.
+func inputRows(t *testing.T, path string) []HospitalChargeRow {
+	t.Helper()
+	r, err := NewCSVReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.SkipPayerCharges = false
+	var rows []HospitalChargeRow
+	for {
+		batch, err := r.Next()
+		rows = append(rows, batch...)
+		if errors.Is(err, io.EOF) {
+			return rows
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// convertToFormat converts the tall fixture into a directory in format and
+// returns the input rows and the output path.
+func convertToFormat(t *testing.T, format string) ([]HospitalChargeRow, string) {
+	t.Helper()
+	input := writeTallCSV(t)
+	dir := t.TempDir()
+	opts := DefaultProcessOptions()
+	opts.SkipPayerCharges = false
+	opts.OutputFormat = format
+	if err := ProcessEntry(quietLogger(), input, dir+"/", filepath.Join(dir, "log.jsonl"), "Test", opts); err != nil {
+		t.Fatalf("ProcessEntry: %v", err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"+outputExt(format)))
+	if len(matches) != 1 {
+		t.Fatalf("outputs = %v, want one %s file", matches, outputExt(format))
+	}
+	return inputRows(t, input), matches[0]
+}
+
+func TestNDJSONWriter(t *testing.T) {
+	want, path := convertToFormat(t, FormatNDJSON)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []map[string]any
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var obj map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &obj); err != nil {
+			t.Fatalf("line %d: %v", len(got)+1, err)
+		}
+		got = append(got, obj)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(got), len(want))
+	}
+	for i, obj := range got {
+		if obj["description"] != want[i].Description || obj["hospital_name"] != want[i].HospitalName {
+			t.Errorf("line %d = %v, want row %+v", i+1, obj, want[i])
+		}
+		if _, ok := obj["cpt_code"]; ok != (want[i].CPTCode != nil) {
+			t.Errorf("line %d: cpt_code present = %v, want %v", i+1, ok, want[i].CPTCode != nil)
+		}
+		if want[i].NegotiatedDollar != nil && obj["negotiated_dollar"] != *want[i].NegotiatedDollar {
+			t.Errorf("line %d: negotiated_dollar = %v, want %v", i+1, obj["negotiated_dollar"], *want[i].NegotiatedDollar)
+		}
+	}
+}
+
+func TestCSVWriter(t *testing.T) {
+	want, path := convertToFormat(t, FormatCSV)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(want)+1 {
+		t.Fatalf("got %d records, want a header and %d rows", len(records), len(want))
+	}
+	col := make(map[string]int)
+	for i, name := range records[0] {
+		col[name] = i
+	}
+	if len(col) != len(chargeColumns) {
+		t.Fatalf("header has %d columns, want %d", len(col), len(chargeColumns))
+	}
+	for i, rec := range records[1:] {
+		if rec[col["description"]] != want[i].Description {
+			t.Errorf("row %d description = %q, want %q", i+1, rec[col["description"]], want[i].Description)
+		}
+		if want[i].MSDRGCode == nil && rec[col["ms_drg_code"]] != "" {
+			t.Errorf("row %d ms_drg_code = %q, want empty", i+1, rec[col["ms_drg_code"]])
+		}
+		if rec[col["affirmation"]] != "false" {
+			t.Errorf("row %d affirmation = %q, want false", i+1, rec[col["affirmation"]])
+		}
+	}
+}
+
+func TestArrowWriter(t *testing.T) {
+	want, path := convertToFormat(t, FormatArrow)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := ipc.NewFileReader(f)
+	if err != nil {
+		t.Fatalf("arrow-go can't open the file: %v", err)
+	}
+	defer r.Close()
+
+	schema := r.Schema()
+	if schema.NumFields() != len(chargeColumns) {
+		t.Fatalf("schema has %d fields, want %d", schema.NumFields(), len(chargeColumns))
+	}
+	for i, col := range chargeColumns {
+		if f := schema.Field(i); f.Name != col.name || f.Nullable != col.optional {
+			t.Errorf("field %d = %v, want %s (nullable %v)", i, f, col.name, col.optional)
+		}
+	}
+	md := schema.Metadata()
+	if i := md.FindKey(metadataPrefix + "hospital_name"); i < 0 || md.Values()[i] != "Test General Hospital" {
+		t.Errorf("schema metadata = %v, want the run's key-values", md)
+	}
+
+	var descriptions, cpt []*string
+	var negotiated []*float64
+	var affirmation []bool
+	column := func(rec arrow.Record, name string) arrow.Array {
+		return rec.Column(schema.FieldIndices(name)[0])
+	}
+	for i := range r.NumRecords() {
+		rec, err := r.Record(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := column(rec, "description").(*array.String)
+		code := column(rec, "cpt_code").(*array.String)
+		dollar := column(rec, "negotiated_dollar").(*array.Float64)
+		aff := column(rec, "affirmation").(*array.Boolean)
+		for j := range int(rec.NumRows()) {
+			descriptions = append(descriptions, arrowValue(desc, j, desc.Value))
+			cpt = append(cpt, arrowValue(code, j, code.Value))
+			negotiated = append(negotiated, arrowValue(dollar, j, dollar.Value))
+			affirmation = append(affirmation, aff.Value(j))
+		}
+	}
+	if len(descriptions) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(descriptions), len(want))
+	}
+	for i, row := range want {
+		if *descriptions[i] != row.Description {
+			t.Errorf("row %d description = %q, want %q", i, *descriptions[i], row.Description)
+		}
+		if !equalPtr(cpt[i], row.CPTCode) {
+			t.Errorf("row %d cpt_code = %v, want %v", i, cpt[i], row.CPTCode)
+		}
+		if !equalPtr(negotiated[i], row.NegotiatedDollar) {
+			t.Errorf("row %d negotiated_dollar = %v, want %v", i, negotiated[i], row.NegotiatedDollar)
+		}
+		if affirmation[i] != row.Affirmation {
+			t.Errorf("row %d affirmation = %v, want %v", i, affirmation[i], row.Affirmation)
+		}
+	}
+	if spools, _ := filepath.Glob(filepath.Join(os.TempDir(), ".arrow-spool-*")); len(spools) > 0 {
+		t.Errorf("spool files left behind: %v", spools)
+	}
+}
+
+// arrowValue returns element i of an array, nil when it is null.
+func arrowValue[T any](a arrow.Array, i int, value func(int) T) *T {
+	if a.IsNull(i) {
+		return nil
+	}
+	v := value(i)
+	return &v
+}
+
+func equalPtr[T comparable](a, b *T) bool {
+	return (a == nil) == (b == nil) && (a == nil || *a == *b)
+}
+
+func TestValidateOutputFormat(t *testing.T) {
+	for _, format := range []string{"", FormatParquet, FormatNDJSON, FormatCSV, FormatArrow} {
+		if err := ValidateOutputFormat(format); err != nil {
+			t.Errorf("%q: %v", format, err)
+		}
+	}
+	if err := ValidateOutputFormat("orc"); err == nil {
+		t.Error("orc: ValidateOutputFormat succeeded, want error")
+	}
+	if got := outputExt(""); got != ".parquet" {
+		t.Errorf("default extension = %q, want .parquet", got)
+	}
+}
+
+// TestAbortRemovesOutput checks a conversion that fails partway leaves
+// nothing at its output path for a glob to pick up.
+func TestAbortRemovesOutput(t *testing.T) {
+	bad := filepath.Join(t.TempDir(), "truncated.json")
+	if err := os.WriteFile(bad, []byte(`{"hospital_name": "Test", "standard_charge_information": [{"description": "X"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		format     string
+		normalized bool
+	}{
+		{FormatParquet, false}, {FormatParquet, true}, {FormatNDJSON, false}, {FormatCSV, false}, {FormatArrow, false},
+	} {
+		dir := t.TempDir()
+		out := filepath.Join(dir, "out"+outputExt(tt.format))
+		opts := DefaultProcessOptions()
+		opts.OutputFormat = tt.format
+		opts.Normalized = tt.normalized
+		info := sourceInfo{Input: bad, Provenance: func() Provenance { return Provenance{} }}
+		if _, err := convert(quietLogger(), bad, info, out, out, opts); err == nil {
+			t.Fatalf("%s: convert of a truncated file succeeded", tt.format)
+		}
+		if left, _ := os.ReadDir(dir); len(left) != 0 {
+			t.Errorf("%s (normalized %v): %d files left after a failed conversion", tt.format, tt.normalized, len(left))
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SortOrder is how ChargeWriter orders rows before splitting them into row
+// groups. Row group min/max statistics are only useful for the columns
+// rows are clustered on, so the order decides which lookups can skip row
+// groups.
+//
+// By default rows are sorted by Columns in turn, which makes the first
+// column's ranges tight and later columns' tight only within runs of equal
+// earlier values. With ZOrder set, rows are instead ordered along a Z-order
+// curve over all Columns, giving every column moderately tight ranges.
+type SortOrder struct {
+	Columns []string
+	ZOrder  bool
+}
+
+// DefaultSortOrder sorts by CPT code, the most common query predicate.
+var DefaultSortOrder = SortOrder{Columns: []string{"cpt_code"}}
+
+// maxZOrderColumns bounds a Z-order key to 8 bits per column.
+const maxZOrderColumns = 8
+
+// sortColumns are the columns rows can be ordered by.
+var sortColumns = map[string]func(r *HospitalChargeRow) *string{
+	"description":   func(r *HospitalChargeRow) *string { return &r.Description },
+	"setting":       func(r *HospitalChargeRow) *string { return &r.Setting },
+	"cpt_code":      func(r *HospitalChargeRow) *string { return r.CPTCode },
+	"hcpcs_code":    func(r *HospitalChargeRow) *string { return r.HCPCSCode },
+	"ms_drg_code":   func(r *HospitalChargeRow) *string { return r.MSDRGCode },
+	"ndc_code":      func(r *HospitalChargeRow) *string { return r.NDCCode },
+	"rc_code":       func(r *HospitalChargeRow) *string { return r.RCCode },
+	"icd_code":      func(r *HospitalChargeRow) *string { return r.ICDCode },
+	"drg_code":      func(r *HospitalChargeRow) *string { return r.DRGCode },
+	"cdm_code":      func(r *HospitalChargeRow) *string { return r.CDMCode },
+	"local_code":    func(r *HospitalChargeRow) *string { return r.LOCALCode },
+	"apc_code":      func(r *HospitalChargeRow) *string { return r.APCCode },
+	"eapg_code":     func(r *HospitalChargeRow) *string { return r.EAPGCode },
+	"hipps_code":    func(r *HospitalChargeRow) *string { return r.HIPPSCode },
+	"cdt_code":      func(r *HospitalChargeRow) *string { return r.CDTCode },
+	"r_drg_code":    func(r *HospitalChargeRow) *string { return r.RDRGCode },
+	"s_drg_code":    func(r *HospitalChargeRow) *string { return r.SDRGCode },
+	"aps_drg_code":  func(r *HospitalChargeRow) *string { return r.APSDRGCode },
+	"ap_drg_code":   func(r *HospitalChargeRow) *string { return r.APDRGCode },
+	"apr_drg_code":  func(r *HospitalChargeRow) *string { return r.APRDRGCode },
+	"tris_drg_code": func(r *HospitalChargeRow) *string { return r.TRISDRGCode },
+	"payer_name":    func(r *HospitalChargeRow) *string { return r.PayerName },
+	"plan_name":     func(r *HospitalChargeRow) *string { return r.PlanName },
+	"methodology":   func(r *HospitalChargeRow) *string { return r.Methodology },
+}
+
+// ParseSortOrder parses a sort specification: a comma-separated column
+// list ("ms_drg_code,hcpcs_code,payer_name"), or the same wrapped in
+// zorder(...) to cluster on the columns together.
+func ParseSortOrder(spec string) (SortOrder, error) {
+	cols := strings.TrimSpace(spec)
+	var order SortOrder
+	if inner, ok := strings.CutPrefix(cols, "zorder("); ok {
+		var closed bool
+		cols, closed = strings.CutSuffix(inner, ")")
+		if !closed {
+			return order, fmt.Errorf("sort order %q: missing closing parenthesis", spec)
+		}
+		order.ZOrder = true
+	}
+	for col := range strings.SplitSeq(cols, ",") {
+		col = strings.TrimSpace(col)
+		if _, ok := sortColumns[col]; !ok {
+			return order, fmt.Errorf("sort order: unknown or unsortable column %q", col)
+		}
+		if slices.Contains(order.Columns, col) {
+			return order, fmt.Errorf("sort order: column %q listed twice", col)
+		}
+		order.Columns = append(order.Columns, col)
+	}
+	if order.ZOrder && (len(order.Columns) < 2 || len(order.Columns) > maxZOrderColumns) {
+		return order, fmt.Errorf("sort order: zorder needs 2 to %d columns, got %d", maxZOrderColumns, len(order.Columns))
+	}
+	return order, nil
+}
+
+// String returns the order in the form ParseSortOrder accepts. It is
+// recorded in the file footer as pricetool.sort_order.
+func (o SortOrder) String() string {
+	cols := strings.Join(o.Columns, ",")
+	if o.ZOrder {
+		return "zorder(" + cols + ")"
+	}
+	return cols
+}
+
+// sortRows orders rows in place.
+func (o SortOrder) sortRows(rows []HospitalChargeRow) {
+	perm := make([]int, len(rows))
+	for i := range perm {
+		perm[i] = i
+	}
+	if o.ZOrder {
+		keys := o.zorderKeys(rows)
+		slices.SortStableFunc(perm, func(a, b int) int {
+			return cmp.Compare(keys[a], keys[b])
+		})
+	} else {
+		get := make([]func(*HospitalChargeRow) *string, len(o.Columns))
+		for i, col := range o.Columns {
+			get[i] = sortColumns[col]
+		}
+		slices.SortStableFunc(perm, func(a, b int) int {
+			for _, g := range get {
+				if c := cmpOptStr(g(&rows[a]), g(&rows[b])); c != 0 {
+					return c
+				}
+			}
+			return 0
+		})
+	}
+
+	sorted := make([]HospitalChargeRow, len(rows))
+	for i, p := range perm {
+		sorted[i] = rows[p]
+	}
+	copy(rows, sorted)
+}
+
+// zorderKeys returns each row's position on a Z-order curve: every column
+// value is mapped to its quantile among the rows (nulls first), scaled to
+// the bits available per column, and the coordinates' bits are
+// interleaved with the first column most significant. Using quantiles
+// rather than raw values makes each bit split the rows about evenly, so
+// fixed-size row groups line up with the curve's cells.
+func (o SortOrder) zorderKeys(rows []HospitalChargeRow) []uint64 {
+	bits := min(64/len(o.Columns), 32)
+	coords := make([][]uint64, len(o.Columns))
+	for d, col := range o.Columns {
+		coords[d] = quantiles(rows, sortColumns[col], bits)
+	}
+	keys := make([]uint64, len(rows))
+	for i := range rows {
+		var key uint64
+		for b := bits - 1; b >= 0; b-- {
+			for d := range coords {
+				key = key<<1 | (coords[d][i]>>b)&1
+			}
+		}
+		keys[i] = key
+	}
+	return keys
+}
+
+// quantiles returns, for each row, the number of rows whose column value
+// sorts before it (nulls sort first), scaled to [0, 2^bits).
+func quantiles(rows []HospitalChargeRow, get func(*HospitalChargeRow) *string, bits int) []uint64 {
+	var values []string
+	for i := range rows {
+		if v := get(&rows[i]); v != nil {
+			values = append(values, *v)
+		}
+	}
+	slices.Sort(values)
+	nulls := uint64(len(rows) - len(values))
+
+	limit := uint64(1) << bits
+	q := make([]uint64, len(rows))
+	for i := range rows {
+		var before uint64
+		if v := get(&rows[i]); v != nil {
+			idx, _ := slices.BinarySearch(values, *v)
+			before = nulls + uint64(idx)
+		}
+		q[i] = before * (limit - 1) / uint64(len(rows))
+	}
+	return q
+}
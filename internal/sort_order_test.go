@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// rowGroupRanges returns the min/max statistics of a column in each row
+// group of a Parquet file.
+func rowGroupRanges(t *testing.T, path, column string) []valueRange {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	pf, err := parquet.OpenFile(f, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranges []valueRange
+	for _, rg := range pf.Metadata().RowGroups {
+		for _, col := range rg.Columns {
+			if strings.Join(col.MetaData.PathInSchema, ".") == column {
+				s := col.MetaData.Statistics
+				ranges = append(ranges, valueRange{string(s.MinValue), string(s.MaxValue)})
+			}
+		}
+	}
+	return ranges
+}
+
+// writeSortedRows writes rows with random CPT and MS-DRG codes (000-999)
+// in the given order and returns the file path.
+func writeSortedRows(t *testing.T, order SortOrder) string {
+	t.Helper()
+	rng := rand.New(rand.NewPCG(1, 2))
+	rows := make([]HospitalChargeRow, 4*RowsPerGroup)
+	payers := []string{"Aetna", "Cigna", "Humana", "UnitedHealthcare"}
+	for i := range rows {
+		rows[i] = HospitalChargeRow{
+			Description: "item",
+			CPTCode:     strPtr(fmt.Sprintf("%03d", rng.IntN(1000))),
+			MSDRGCode:   strPtr(fmt.Sprintf("%03d", rng.IntN(1000))),
+			PayerName:   &payers[rng.IntN(len(payers))],
+		}
+	}
+	path := filepath.Join(t.TempDir(), "sorted.parquet")
+	w, err := NewChargeWriter(path, DefaultWriterConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SortOrder = order
+	w.Write(rows)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// groupsRead returns the average number of row groups whose min/max range
+// admits a lookup of each code 000-999, i.e. what an engine has to read.
+func groupsRead(ranges []valueRange) float64 {
+	var n int
+	for code := range 1000 {
+		c := fmt.Sprintf("%03d", code)
+		for _, r := range ranges {
+			if r.Min <= c && c <= r.Max {
+				n++
+			}
+		}
+	}
+	return float64(n) / 1000
+}
+
+func TestSortOrderRowGroupStatistics(t *testing.T) {
+	disjoint := func(t *testing.T, ranges []valueRange) {
+		t.Helper()
+		for i := 1; i < len(ranges); i++ {
+			if ranges[i].Min < ranges[i-1].Max {
+				t.Errorf("row groups %d and %d overlap: %+v, %+v", i-1, i, ranges[i-1], ranges[i])
+			}
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		path := writeSortedRows(t, SortOrder{})
+		if got := parquetMetadata(t, path)["pricetool.sort_order"]; got != "cpt_code" {
+			t.Errorf("sort_order = %q, want cpt_code", got)
+		}
+		disjoint(t, rowGroupRanges(t, path, "cpt_code"))
+		if got := groupsRead(rowGroupRanges(t, path, "ms_drg_code")); got < 3.9 {
+			t.Errorf("MS-DRG lookups read %.2f row groups, want all 4 when sorting by CPT", got)
+		}
+	})
+
+	t.Run("columns", func(t *testing.T) {
+		order, err := ParseSortOrder("ms_drg_code,hcpcs_code,payer_name")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := writeSortedRows(t, order)
+		if got := parquetMetadata(t, path)["pricetool.sort_order"]; got != "ms_drg_code,hcpcs_code,payer_name" {
+			t.Errorf("sort_order = %q", got)
+		}
+		disjoint(t, rowGroupRanges(t, path, "ms_drg_code"))
+	})
+
+	t.Run("zorder", func(t *testing.T) {
+		order, err := ParseSortOrder("zorder(cpt_code, ms_drg_code)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := writeSortedRows(t, order)
+		if got := parquetMetadata(t, path)["pricetool.sort_order"]; got != "zorder(cpt_code,ms_drg_code)" {
+			t.Errorf("sort_order = %q", got)
+		}
+		// Four row groups along a 2-D Z curve are about its quadrants, so
+		// lookups on either code skip about half the file.
+		for _, col := range []string{"cpt_code", "ms_drg_code"} {
+			if got := groupsRead(rowGroupRanges(t, path, col)); got >= 3 {
+				t.Errorf("%s lookups read %.2f of 4 row groups, want fewer than 3", col, got)
+			}
+		}
+	})
+}
+
+func TestParseSortOrderErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"cpt_code,gross_charge",
+		"cpt_code,cpt_code",
+		"zorder(cpt_code)",
+		"zorder(cpt_code,ms_drg_code",
+	} {
+		if _, err := ParseSortOrder(spec); err == nil {
+			t.Errorf("ParseSortOrder(%q) succeeded, want error", spec)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errNeedsFile means an MRF can't be parsed in a single forward pass (a zip
+// archive keeps its directory at the end) and has to be downloaded to a
+// temp file instead of streamed.
+var errNeedsFile = errors.New("content must be downloaded to a file")
+
+// mrfStream is an MRF read straight from an HTTP response body, already
+// decoded and decompressed.
+type mrfStream struct {
+	io.Reader
+	IsJSON bool
+	Size   int64      // bytes on the wire, for logging; 0 if unknown
+	Source Provenance // final URL and response headers
+
+	raw, inner *hashingReader // inner is nil unless the body was gunzipped
+	closers    []io.Closer
+}
+
+// provenance returns Source with the hashes of what has been read so far,
+// which is the whole file once the stream has been drained.
+func (s *mrfStream) provenance() Provenance {
+	p := s.Source
+	p.SHA256, p.Size = s.raw.sum()
+	if s.inner != nil {
+		p.InnerSHA256, p.InnerSize = s.inner.sum()
+	}
+	return p
+}
+
+// Close releases the decoders and the response body.
+func (s *mrfStream) Close() error {
+	var errs []error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		errs = append(errs, s.closers[i].Close())
+	}
+	return errors.Join(errs...)
+}
+
+// openStream requests rawURL and prepares its body for conversion without
+// touching disk. The Content-Encoding is decoded, a gzip payload is
+// decompressed inline, and JSON vs CSV is decided from the URL,
+// Content-Disposition or, failing both, the first bytes of the body.
+//
+// Failures before the body starts are retried according to policy. Once
+// the caller starts reading, a dropped connection can't be resumed.
+// Returns errNeedsFile for zip archives.
+//
+// spool, if not nil, receives a copy of the raw body as it is read.
+func openStream(logger *slog.Logger, rawURL string, policy DownloadPolicy, spool *os.File) (*mrfStream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse URL: %w", err)
+	}
+	policy = policy.ForHost(u.Hostname())
+
+	attempts := max(policy.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		s, err := tryOpenStream(u, policy, spool)
+		if err == nil || errors.Is(err, errNeedsFile) || attempt >= attempts || !policy.isRetryable(err) || !fallBack(err) {
+			return s, err
+		}
+		backoff := policy.retryDelay(attempt, err)
+		logger.Info("retrying download", "attempt", attempt+1, "backoff", backoff.Round(time.Second).String(), "error", err)
+		time.Sleep(backoff)
+	}
+}
+
+func tryOpenStream(u *url.URL, policy DownloadPolicy, spool *os.File) (*mrfStream, error) {
+	if spool != nil {
+		if err := resetFile(spool); err != nil {
+			return nil, &permanentError{err}
+		}
+	}
+	req, err := newDownloadRequest(u.String(), policy.Profiles)
+	if err != nil {
+		return nil, &permanentError{err}
+	}
+	resp, err := chromeClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP GET: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		statusErr := newHTTPStatusError(resp)
+		if body, err := decodeContent(resp.Header.Get("Content-Encoding"), resp.Body); err == nil {
+			defer body.Close()
+			_, head := peekReader(body)
+			if cerr := classifyResponse(resp, head, statusErr); cerr != nil {
+				return nil, cerr
+			}
+		}
+		return nil, statusErr
+	}
+
+	s := &mrfStream{closers: []io.Closer{resp.Body}, Source: responseSource(resp)}
+	if resp.ContentLength > 0 {
+		s.Size = resp.ContentLength
+	}
+
+	body, err := decodeContent(resp.Header.Get("Content-Encoding"), resp.Body)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.closers = append(s.closers, body)
+	var raw io.Reader = body
+	if spool != nil {
+		raw = io.TeeReader(body, spool)
+	}
+	s.raw = newHashingReader(raw)
+
+	now := time.Now()
+	progress := &progressReader{r: s.raw, policy: policy, size: -1, start: now, lastCheck: now}
+	if ce := resp.Header.Get("Content-Encoding"); ce == "" || strings.EqualFold(ce, "identity") {
+		progress.size = s.Size
+	}
+	br := bufio.NewReaderSize(progress, 256*1024)
+	head, _ := br.Peek(sniffLen) // a short body is fine; the reader reports real errors
+
+	// Some servers serve .json files that are actually gzip-compressed.
+	if len(head) >= 2 && head[0] == 0x1f && head[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("gzip reader: %w", err)
+		}
+		s.closers = append(s.closers, gz)
+		s.inner = newHashingReader(gz)
+		filename := ""
+		if cd := resp.Header.Get("Content-Disposition"); cd != "" {
+			if _, params, err := mime.ParseMediaType(cd); err == nil {
+				filename = params["filename"]
+			}
+		}
+		s.Source.InnerFile = gunzippedName(s.Source.FinalURL, filename)
+		br = bufio.NewReaderSize(s.inner, 256*1024)
+		head, _ = br.Peek(sniffLen)
+	}
+	if cerr := classifyResponse(resp, head, nil); cerr != nil {
+		s.Close()
+		return nil, cerr
+	}
+	s.Reader = br
+
+	ext := strings.ToLower(path.Ext(u.Path))
+	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
+		if _, params, err := mime.ParseMediaType(cd); err == nil && filepath.Ext(params["filename"]) != "" {
+			ext = strings.ToLower(filepath.Ext(params["filename"]))
+		}
+	}
+	if ext == ".zip" || bytes.HasPrefix(head, []byte("PK\x03\x04")) {
+		s.Close()
+		return nil, errNeedsFile
+	}
+	s.IsJSON = ext == ".json" || sniffContent(head) == ".json"
+	return s, nil
+}
+
+// progressReader applies a download policy's speed limits to a stream
+// that is consumed by something other than doDownload.
+type progressReader struct {
+	r      io.Reader
+	policy DownloadPolicy
+	size   int64 // -1 if unknown
+	n      int64
+
+	start, lastCheck time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.lastCheck) >= progressCheckInterval {
+		p.lastCheck = now
+		if perr := p.policy.checkProgress(p.n, p.size, now.Sub(p.start)); perr != nil {
+			return n, perr
+		}
+	}
+	return n, err
+}
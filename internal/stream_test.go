@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenStreamDetectsFormat(t *testing.T) {
+	jsonBody := []byte(`{"hospital_name": "Test", "standard_charge_information": []}`)
+	csvBody := testBody
+
+	mux := http.NewServeMux()
+	// gzip payload with no Content-Encoding and an uninformative extension.
+	mux.HandleFunc("/charges.aspx", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(gzipBytes(t, jsonBody))
+	})
+	// gzip Content-Encoding on a .csv URL.
+	mux.HandleFunc("/charges.csv", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipBytes(t, csvBody))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		isJSON bool
+		want   []byte
+	}{
+		{"/charges.aspx", true, jsonBody},
+		{"/charges.csv", false, csvBody},
+	}
+	for _, tt := range tests {
+		s, err := openStream(quietLogger(), srv.URL+tt.path, testPolicy(), nil)
+		if err != nil {
+			t.Fatalf("%s: openStream: %v", tt.path, err)
+		}
+		got, err := io.ReadAll(s)
+		s.Close()
+		if err != nil {
+			t.Fatalf("%s: read: %v", tt.path, err)
+		}
+		if s.IsJSON != tt.isJSON {
+			t.Errorf("%s: IsJSON = %v, want %v", tt.path, s.IsJSON, tt.isJSON)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: read %d bytes, want %d identical bytes", tt.path, len(got), len(tt.want))
+		}
+	}
+}
+
+func TestOpenStreamZipNeedsFile(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, _ := zw.Create("charges.csv")
+	fw.Write(testBody)
+	zw.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	_, err := openStream(quietLogger(), srv.URL+"/download", testPolicy(), nil)
+	if !errors.Is(err, errNeedsFile) {
+		t.Fatalf("openStream error = %v, want errNeedsFile", err)
+	}
+}
+
+func TestConvertFromStream(t *testing.T) {
+	csv, err := os.ReadFile(writeTallCSV(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(gzipBytes(t, csv))
+	}))
+	defer srv.Close()
+
+	s, err := openStream(quietLogger(), srv.URL+"/tall.csv.gz", testPolicy(), nil)
+	if err != nil {
+		t.Fatalf("openStream: %v", err)
+	}
+	defer s.Close()
+
+	out := filepath.Join(t.TempDir(), "out.parquet")
+	meta, err := convertFrom(quietLogger(), s, s.IsJSON, s.Size, sourceInfo{Input: srv.URL, Provenance: s.provenance}, out, out, ProcessOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatalf("convertFrom: %v", err)
+	}
+	if meta.HospitalName != "Test General Hospital" {
+		t.Errorf("HospitalName = %q", meta.HospitalName)
+	}
+	if rows := readParquet(t, out); len(rows) != 4 {
+		t.Errorf("parquet has %d rows, want 4", len(rows))
+	}
+}
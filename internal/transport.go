@@ -0,0 +1,343 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// idleConnTimeout is how long an unused connection stays open.
+	idleConnTimeout = 90 * time.Second
+	// maxIdleConnsPerHost bounds the idle HTTP/1.1 connections kept per
+	// host, enough for a chunked download's parallel requests.
+	maxIdleConnsPerHost = 8
+)
+
+// utlsTransport is an http.RoundTripper that sends the TLS fingerprint of
+// the request's client profile (see withProfile), trying the host's other
+// profiles when a response says it is blocked. HTTP/1.1 headers go out in
+// the profile's order; HTTP/2 header order is left to x/net/http2.
+//
+// It checks the negotiated ALPN protocol and keeps the connection in the
+// matching per-host pool. Redirects and repeated fetches from the same CDN
+// reuse connections instead of paying for a new TCP and TLS handshake.
+//
+// HTTP/2 connections are only reused once their previous streams finish:
+// concurrent requests (parallel chunks of one file) get a TCP connection
+// each, since bulk transfers multiplexed on one connection are no faster
+// than a single stream.
+//
+// Connections go through the proxy that downloadProxies picks for the host,
+// and a block response moves the host on to the next proxy.
+type utlsTransport struct {
+	h1 *http.Transport  // plain http:// requests
+	h2 *http2.Transport // settings for HTTP/2 client connections
+
+	rootCAs *x509.CertPool // nil = system roots; set by tests
+
+	mu    sync.Mutex
+	conns map[string][]*http2.ClientConn // connKey → HTTP/2 connections
+	idle  map[string][]*h1Conn           // connKey → idle HTTP/1.1 connections
+}
+
+func newUTLSTransport() *utlsTransport {
+	return &utlsTransport{
+		h1: &http.Transport{
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				return downloadProxies.proxyFor(req.URL)
+			},
+			DialContext:         (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+			MaxIdleConnsPerHost: maxIdleConnsPerHost,
+			IdleConnTimeout:     idleConnTimeout,
+		},
+		h2:    &http2.Transport{IdleConnTimeout: idleConnTimeout},
+		conns: make(map[string][]*http2.ClientConn),
+		idle:  make(map[string][]*h1Conn),
+	}
+}
+
+var chromeClient = &http.Client{Transport: newUTLSTransport()}
+
+func (t *utlsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for tries := 1; ; tries++ {
+		resp, err := t.roundTrip(req)
+		if err != nil || !isBlockResponse(resp) {
+			return resp, err
+		}
+		if downloadProxies.rotate(req.URL.Hostname()) {
+			// Pooled connections still go through the old proxy.
+			t.CloseIdleConnections()
+		}
+
+		// A fingerprint block may pass with another client profile. Rate
+		// limits won't, so leave 429 to the caller's backoff.
+		if resp.StatusCode == http.StatusTooManyRequests || tries >= len(requestProfile(req).names) {
+			return resp, nil
+		}
+		next := nextProfile(req)
+		if next == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		req = next
+	}
+}
+
+func (t *utlsTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	// For non-HTTPS, use default transport.
+	if req.URL.Scheme != "https" {
+		return t.h1.RoundTrip(req)
+	}
+
+	addr := req.URL.Host
+	if !strings.Contains(addr, ":") {
+		addr += ":443"
+	}
+	proxyURL, err := downloadProxies.proxyFor(req.URL)
+	if err != nil {
+		return nil, fmt.Errorf("proxy for %s: %w", addr, err)
+	}
+	profile := requestProfile(req).profile
+	key := addr + "|" + profile.Name
+	if proxyURL != nil {
+		key += "|" + proxyURL.String()
+	}
+
+	// A pooled connection may have been closed by the server while idle.
+	// Downloads are GETs without a body, so retrying on a fresh connection
+	// is safe.
+	if cc := t.getH2(key); cc != nil {
+		resp, err := cc.RoundTrip(req)
+		if err == nil || req.Context().Err() != nil {
+			return resp, err
+		}
+		t.dropH2(key, cc)
+	} else if pc := t.getIdle(key); pc != nil {
+		resp, err := t.roundTripH1(key, pc, req, profile)
+		if err == nil || req.Context().Err() != nil {
+			return resp, err
+		}
+	}
+
+	return t.roundTripNew(req, key, proxyURL, addr, profile)
+}
+
+// roundTripNew dials a new connection, adds it to the pool for its
+// negotiated protocol and sends req on it.
+func (t *utlsTransport) roundTripNew(req *http.Request, key string, proxyURL *url.URL, addr string, profile *clientProfile) (*http.Response, error) {
+	conn, err := dialProxy(req.Context(), proxyURL, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConn := utls.UClient(conn, &utls.Config{ServerName: host, RootCAs: t.rootCAs}, profile.Hello)
+	if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+
+	if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		cc, err := t.h2.NewClientConn(tlsConn)
+		if err != nil {
+			tlsConn.Close()
+			return nil, fmt.Errorf("HTTP/2 connection: %w", err)
+		}
+		t.putH2(key, cc)
+		return cc.RoundTrip(req)
+	}
+
+	return t.roundTripH1(key, &h1Conn{conn: tlsConn, br: bufio.NewReader(tlsConn)}, req, profile)
+}
+
+// roundTripH1 sends req on an HTTP/1.1 connection with headers in the
+// profile's order. The connection goes back to the idle pool once the
+// response body has been read to the end, and is closed if the body is
+// closed early or the server asked to close it.
+func (t *utlsTransport) roundTripH1(key string, pc *h1Conn, req *http.Request, profile *clientProfile) (*http.Response, error) {
+	if err := writeRequest(pc.conn, req, profile); err != nil {
+		pc.conn.Close()
+		return nil, fmt.Errorf("write request: %w", err)
+	}
+	resp, err := http.ReadResponse(pc.br, req)
+	if err != nil {
+		pc.conn.Close()
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	reusable := !resp.Close && !req.Close && resp.ProtoAtLeast(1, 1)
+	resp.Body = &h1Body{
+		ReadCloser: resp.Body,
+		release: func(eof bool) {
+			if eof && reusable {
+				t.putIdle(key, pc)
+			} else {
+				pc.conn.Close()
+			}
+		},
+	}
+	return resp, nil
+}
+
+// CloseIdleConnections closes idle HTTP/1.1 connections and retires all
+// HTTP/2 connections once their in-flight requests finish.
+func (t *utlsTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	idle, conns := t.idle, t.conns
+	t.idle = make(map[string][]*h1Conn)
+	t.conns = make(map[string][]*http2.ClientConn)
+	t.mu.Unlock()
+
+	for _, list := range idle {
+		for _, pc := range list {
+			if pc.timer.Stop() {
+				pc.conn.Close()
+			}
+		}
+	}
+	for _, list := range conns {
+		for _, cc := range list {
+			go cc.Shutdown(context.Background())
+		}
+	}
+	t.h1.CloseIdleConnections()
+}
+
+// getH2 returns an HTTP/2 connection for key with no requests in flight,
+// pruning connections that can no longer be used.
+func (t *utlsTransport) getH2(key string) *http2.ClientConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var found *http2.ClientConn
+	live := t.conns[key][:0]
+	for _, cc := range t.conns[key] {
+		if !cc.CanTakeNewRequest() {
+			go cc.Close()
+			continue
+		}
+		live = append(live, cc)
+		if st := cc.State(); found == nil && st.StreamsActive == 0 && st.StreamsPending == 0 {
+			found = cc
+		}
+	}
+	if len(live) == 0 {
+		delete(t.conns, key)
+	} else {
+		t.conns[key] = live
+	}
+	return found
+}
+
+func (t *utlsTransport) putH2(key string, cc *http2.ClientConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[key] = append(t.conns[key], cc)
+}
+
+func (t *utlsTransport) dropH2(key string, cc *http2.ClientConn) {
+	t.mu.Lock()
+	list := t.conns[key]
+	for i, c := range list {
+		if c == cc {
+			t.conns[key] = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(t.conns[key]) == 0 {
+		delete(t.conns, key)
+	}
+	t.mu.Unlock()
+	cc.Close()
+}
+
+// getIdle takes the most recently used idle HTTP/1.1 connection for key.
+func (t *utlsTransport) getIdle(key string) *h1Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for list := t.idle[key]; len(list) > 0; list = t.idle[key] {
+		pc := list[len(list)-1]
+		t.idle[key] = list[:len(list)-1]
+		if pc.timer.Stop() {
+			return pc
+		}
+		// The idle timer already fired and is closing it.
+	}
+	delete(t.idle, key)
+	return nil
+}
+
+func (t *utlsTransport) putIdle(key string, pc *h1Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle[key]) >= maxIdleConnsPerHost {
+		pc.conn.Close()
+		return
+	}
+	pc.timer = time.AfterFunc(idleConnTimeout, func() {
+		t.removeIdle(key, pc)
+		pc.conn.Close()
+	})
+	t.idle[key] = append(t.idle[key], pc)
+}
+
+func (t *utlsTransport) removeIdle(key string, pc *h1Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := t.idle[key]
+	for i, c := range list {
+		if c == pc {
+			t.idle[key] = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(t.idle[key]) == 0 {
+		delete(t.idle, key)
+	}
+}
+
+// h1Conn is a TLS connection speaking HTTP/1.1.
+type h1Conn struct {
+	conn  net.Conn
+	br    *bufio.Reader
+	timer *time.Timer // closes the connection after idleConnTimeout
+}
+
+// h1Body releases its connection exactly once: back to the pool when the
+// body was read to EOF, closed otherwise.
+type h1Body struct {
+	io.ReadCloser
+	once    sync.Once
+	release func(eof bool)
+}
+
+func (b *h1Body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.once.Do(func() { b.release(true) })
+	} else if err != nil {
+		b.once.Do(func() { b.release(false) })
+	}
+	return n, err
+}
+
+func (b *h1Body) Close() error {
+	// Release first: closing an unfinished body drains it, which for a
+	// multi-GB MRF means downloading the rest. With the connection already
+	// closed the drain fails immediately.
+	b.once.Do(func() { b.release(false) })
+	b.ReadCloser.Close()
+	return nil
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// tlsServer starts an HTTPS test server that counts new connections.
+// With h2 false it only offers HTTP/1.1 in ALPN.
+func tlsServer(t *testing.T, h2 bool, handler http.Handler) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = h2
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+// testTransport returns a utlsTransport trusting srv's certificate.
+func testTransport(srv *httptest.Server) *utlsTransport {
+	tr := newUTLSTransport()
+	tr.rootCAs = x509.NewCertPool()
+	tr.rootCAs.AddCert(srv.Certificate())
+	return tr
+}
+
+func TestUTLSTransportReusesConnections(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/charges.csv", http.StatusFound)
+	})
+	mux.HandleFunc("/charges.csv", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testBody)
+	})
+
+	for _, tt := range []struct {
+		name  string
+		h2    bool
+		proto string
+	}{
+		{"http2", true, "HTTP/2.0"},
+		{"http1", false, "HTTP/1.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, conns := tlsServer(t, tt.h2, mux)
+			tr := testTransport(srv)
+			defer tr.CloseIdleConnections()
+			client := &http.Client{Transport: tr}
+
+			for range 3 {
+				resp, err := client.Get(srv.URL + "/redirect")
+				if err != nil {
+					t.Fatalf("GET: %v", err)
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil || len(body) != len(testBody) {
+					t.Fatalf("read %d bytes (err %v), want %d", len(body), err, len(testBody))
+				}
+				if resp.Proto != tt.proto {
+					t.Errorf("proto = %s, want %s", resp.Proto, tt.proto)
+				}
+			}
+			if n := conns.Load(); n != 1 {
+				t.Errorf("server saw %d connections for 6 requests, want 1", n)
+			}
+		})
+	}
+}
+
+func TestUTLSTransportClosesAbandonedBody(t *testing.T) {
+	srv, conns := tlsServer(t, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testBody)
+	}))
+	tr := testTransport(srv)
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	// Closing a body before EOF must close its connection rather than
+	// returning it to the pool mid-response.
+	for range 2 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		resp.Body.Read(make([]byte, 10))
+		resp.Body.Close()
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("server saw %d connections, want 2", n)
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.idle) != 0 {
+		t.Errorf("idle pool has %d hosts, want none", len(tr.idle))
+	}
+}
+
+func TestUTLSTransportParallelHTTP2(t *testing.T) {
+	// Responses stay open until release is closed, like a large chunk.
+	release := make(chan struct{})
+	srv, conns := tlsServer(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testBody[:100])
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(testBody[100:])
+	}))
+	tr := testTransport(srv)
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	// Two responses open at once (like parallel chunks) need two TCP
+	// connections; once they're finished, a third request reuses one.
+	var bodies []io.ReadCloser
+	for range 2 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		bodies = append(bodies, resp.Body)
+	}
+	close(release)
+	for _, b := range bodies {
+		io.Copy(io.Discard, b)
+		b.Close()
+	}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if n := conns.Load(); n != 2 {
+		t.Errorf("server saw %d connections, want 2", n)
+	}
+}
@@ -3,13 +3,17 @@ package internal
 import (
 	"fmt"
 	"os"
-	"slices"
+	"reflect"
 	"strings"
 
 	"github.com/parquet-go/parquet-go"
-	"github.com/parquet-go/parquet-go/compress/zstd"
 )
 
+// ToolVersion is recorded in the footer of every file written. Release
+// builds set it with -ldflags "-X pricetool/internal.ToolVersion=...".
+var ToolVersion = "1.0"
+
+// Defaults for WriterConfig.
 const (
 	// RowsPerGroup controls how many rows go into each Parquet row group.
 	// Smaller row groups = more granular predicate pushdown over the network
@@ -22,6 +26,29 @@ const (
 	bloomBitsPerValue = 10
 )
 
+// codeColumns are the dedicated code columns, all bloom-filtered by default.
+var codeColumns = []string{
+	"cpt_code", "hcpcs_code", "ms_drg_code", "ndc_code", "rc_code", "icd_code",
+	"drg_code", "cdm_code", "local_code", "apc_code", "eapg_code", "hipps_code",
+	"cdt_code", "r_drg_code", "s_drg_code", "aps_drg_code", "ap_drg_code",
+	"apr_drg_code", "tris_drg_code",
+}
+
+// writeRowGroups writes rows in groups of perGroup, flushing after each
+// group to force row group boundaries.
+func writeRowGroups[T any](w *parquet.GenericWriter[T], rows []T, perGroup int) error {
+	for i := 0; i < len(rows); i += perGroup {
+		end := min(i+perGroup, len(rows))
+		if _, err := w.Write(rows[i:end]); err != nil {
+			return fmt.Errorf("write parquet rows: %w", err)
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("flush row group: %w", err)
+		}
+	}
+	return nil
+}
+
 // ChargeWriter writes HospitalChargeRow records to a Parquet file configured
 // for fast analytical queries and small file size.
 //
@@ -29,9 +56,9 @@ const (
 //
 //   - Zstd(3): ~20-30% smaller than Snappy with acceptable write overhead.
 //
-//   - Rows sorted by cpt_code ascending: clusters rows by the most common
-//     query predicate, producing tight per-row-group min/max statistics so
-//     engines can skip row groups that can't match.
+//   - Rows sorted by cpt_code ascending (or SortOrder): clusters rows by
+//     the most common query predicate, producing tight per-row-group
+//     min/max statistics so engines can skip row groups that can't match.
 //
 //   - 50K rows per row group: for a 210K-row file this yields ~4 row groups.
 //     More row groups = finer-grained predicate pushdown over the network.
@@ -42,52 +69,35 @@ const (
 //
 //   - 8KB page size with statistics: enables page-level filtering within row
 //     groups (DuckDB 0.9+, Spark 3.3+).
+//
+// These are the DefaultWriterConfig settings; WriterConfig changes them
+// per consumer.
 type ChargeWriter struct {
+	// SortOrder orders rows before they are split into row groups. The
+	// zero value means DefaultSortOrder.
+	SortOrder SortOrder
+
 	file   *os.File
 	writer *parquet.GenericWriter[HospitalChargeRow]
+	config WriterConfig
 	rows   []HospitalChargeRow
 }
 
 // NewChargeWriter creates a Parquet writer optimized for analytical queries.
-func NewChargeWriter(filename string) (*ChargeWriter, error) {
+func NewChargeWriter(filename string, config WriterConfig) (*ChargeWriter, error) {
+	config = config.withDefaults()
 	file, err := os.Create(filename)
 	if err != nil {
 		return nil, fmt.Errorf("create parquet file: %w", err)
 	}
 
 	writer := parquet.NewGenericWriter[HospitalChargeRow](file,
-		parquet.Compression(&zstd.Codec{Level: zstd.SpeedDefault}),
-		parquet.PageBufferSize(8*1024),
-		parquet.DataPageStatistics(true),
-		parquet.CreatedBy("pricetool", "1.0", ""),
-		parquet.BloomFilters(
-			parquet.SplitBlockFilter(bloomBitsPerValue, "cpt_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "hcpcs_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "ms_drg_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "ndc_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "rc_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "icd_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "drg_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "cdm_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "local_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "apc_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "eapg_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "hipps_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "cdt_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "r_drg_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "s_drg_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "aps_drg_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "ap_drg_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "apr_drg_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "tris_drg_code"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "payer_name"),
-			parquet.SplitBlockFilter(bloomBitsPerValue, "plan_name"),
-		),
-	)
+		config.options(reflect.TypeFor[HospitalChargeRow](), defaultBloomColumns)...)
 
 	return &ChargeWriter{
 		file:   file,
 		writer: writer,
+		config: config,
 	}, nil
 }
 
@@ -97,26 +107,20 @@ func (w *ChargeWriter) Write(rows []HospitalChargeRow) (int, error) {
 	return len(rows), nil
 }
 
-// Close sorts all buffered rows by cpt_code, writes them in fixed-size row
-// groups (flushing after each group to force row group boundaries), and closes.
+// Close sorts all buffered rows by the sort order, records it in the footer
+// as pricetool.sort_order, writes the rows in fixed-size row groups
+// (flushing after each group to force row group boundaries), and closes.
 func (w *ChargeWriter) Close() error {
-	slices.SortFunc(w.rows, func(a, b HospitalChargeRow) int {
-		return cmpOptStr(a.CPTCode, b.CPTCode)
-	})
-
-	for i := 0; i < len(w.rows); i += RowsPerGroup {
-		end := i + RowsPerGroup
-		if end > len(w.rows) {
-			end = len(w.rows)
-		}
-		if _, err := w.writer.Write(w.rows[i:end]); err != nil {
-			w.file.Close()
-			return fmt.Errorf("write parquet rows: %w", err)
-		}
-		if err := w.writer.Flush(); err != nil {
-			w.file.Close()
-			return fmt.Errorf("flush row group: %w", err)
-		}
+	order := w.SortOrder
+	if len(order.Columns) == 0 {
+		order = DefaultSortOrder
+	}
+	order.sortRows(w.rows)
+	w.writer.SetKeyValueMetadata(metadataPrefix+"sort_order", order.String())
+
+	if err := writeRowGroups(w.writer, w.rows, w.config.RowsPerGroup); err != nil {
+		w.file.Close()
+		return err
 	}
 
 	if err := w.writer.Close(); err != nil {
@@ -126,6 +130,19 @@ func (w *ChargeWriter) Close() error {
 	return w.file.Close()
 }
 
+// Abort closes and removes the file without writing the buffered rows,
+// so no footerless file is left at the output path.
+func (w *ChargeWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// SetKeyValueMetadata sets a key-value pair in the file footer. It may be
+// called any time before Close.
+func (w *ChargeWriter) SetKeyValueMetadata(key, value string) {
+	w.writer.SetKeyValueMetadata(key, value)
+}
+
 // Count returns the total number of rows buffered.
 func (w *ChargeWriter) Count() int {
 	return len(w.rows)
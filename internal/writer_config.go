@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	kzstd "github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	"github.com/parquet-go/parquet-go/compress/gzip"
+	"github.com/parquet-go/parquet-go/compress/lz4"
+	"github.com/parquet-go/parquet-go/compress/snappy"
+	"github.com/parquet-go/parquet-go/compress/uncompressed"
+	"github.com/parquet-go/parquet-go/compress/zstd"
+	"github.com/parquet-go/parquet-go/encoding"
+)
+
+// WriterConfig tunes the Parquet files ChargeWriter and NormalizedWriter
+// produce, trading file size against write and scan speed. The defaults
+// are the settings described on ChargeWriter; zero fields take them.
+type WriterConfig struct {
+	// Compression is the codec for every column: zstd, snappy, lz4, gzip
+	// or none.
+	Compression string
+	// CompressionLevel is the codec level: 1-22 for zstd, 1-9 for gzip and
+	// lz4. 0 uses the codec's default; snappy and none have no levels.
+	CompressionLevel int
+
+	PageBufferSize int // bytes per page before it is compressed
+	RowsPerGroup   int
+
+	// BloomColumns lists the columns with bloom filters; nil means
+	// defaultBloomColumns and an empty list disables them. Columns a table
+	// doesn't have are skipped.
+	BloomColumns      []string
+	BloomBitsPerValue int
+
+	// Encodings overrides the encoding of individual columns: plain, dict,
+	// delta (strings) or split (byte stream split, floats).
+	Encodings map[string]string
+}
+
+// defaultBloomColumns are the code columns plus the payer identifiers.
+var defaultBloomColumns = append(slices.Clone(codeColumns), "payer_name", "plan_name")
+
+// compressionCodecs are the accepted WriterConfig.Compression names.
+var compressionCodecs = []string{"zstd", "snappy", "lz4", "gzip", "none"}
+
+// DefaultWriterConfig returns the settings used unless flags override them.
+func DefaultWriterConfig() WriterConfig {
+	return WriterConfig{
+		Compression:       "zstd",
+		PageBufferSize:    8 * 1024,
+		RowsPerGroup:      RowsPerGroup,
+		BloomBitsPerValue: bloomBitsPerValue,
+	}
+}
+
+// withDefaults fills zero fields from DefaultWriterConfig.
+func (c WriterConfig) withDefaults() WriterConfig {
+	d := DefaultWriterConfig()
+	if c.Compression == "" {
+		c.Compression = d.Compression
+	}
+	if c.PageBufferSize == 0 {
+		c.PageBufferSize = d.PageBufferSize
+	}
+	if c.RowsPerGroup == 0 {
+		c.RowsPerGroup = d.RowsPerGroup
+	}
+	if c.BloomBitsPerValue == 0 {
+		c.BloomBitsPerValue = d.BloomBitsPerValue
+	}
+	return c
+}
+
+// Validate reports settings that can't be applied to HospitalChargeRow
+// files.
+func (c WriterConfig) Validate() error {
+	c = c.withDefaults()
+	if !slices.Contains(compressionCodecs, c.Compression) {
+		return fmt.Errorf("unknown compression %q (want one of %s)", c.Compression, strings.Join(compressionCodecs, ", "))
+	}
+	maxLevel := map[string]int{"zstd": 22, "gzip": 9, "lz4": 9}[c.Compression]
+	if c.CompressionLevel < 0 || c.CompressionLevel > maxLevel {
+		if maxLevel == 0 {
+			return fmt.Errorf("compression %s has no levels", c.Compression)
+		}
+		return fmt.Errorf("%s compression level %d out of range 1-%d", c.Compression, c.CompressionLevel, maxLevel)
+	}
+	if c.PageBufferSize < 0 || c.RowsPerGroup < 0 || c.BloomBitsPerValue < 0 {
+		return fmt.Errorf("page size, rows per group and bloom filter bits must be positive")
+	}
+	columns := parquetColumns(reflect.TypeFor[HospitalChargeRow]())
+	for _, col := range c.BloomColumns {
+		if _, ok := columns[col]; !ok {
+			return fmt.Errorf("bloom filter column %q: no such column", col)
+		}
+	}
+	for col, enc := range c.Encodings {
+		pc, ok := columns[col]
+		if !ok {
+			return fmt.Errorf("encoding for %q: no such column", col)
+		}
+		if !pc.accepts(enc) {
+			return fmt.Errorf("encoding %q can't be used for %s column %q", enc, pc.kind, col)
+		}
+	}
+	return nil
+}
+
+// codec returns the compression codec.
+func (c WriterConfig) codec() compress.Codec {
+	switch c.Compression {
+	case "snappy":
+		return &snappy.Codec{}
+	case "lz4":
+		if c.CompressionLevel == 0 {
+			return &lz4.Codec{Level: lz4.DefaultLevel}
+		}
+		levels := []lz4.Level{lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+		return &lz4.Codec{Level: levels[c.CompressionLevel-1]}
+	case "gzip":
+		if c.CompressionLevel == 0 {
+			return &gzip.Codec{Level: gzip.DefaultCompression}
+		}
+		return &gzip.Codec{Level: c.CompressionLevel}
+	case "none":
+		return &uncompressed.Codec{}
+	}
+	if c.CompressionLevel == 0 {
+		return &zstd.Codec{Level: zstd.SpeedDefault}
+	}
+	return &zstd.Codec{Level: kzstd.EncoderLevelFromZstd(c.CompressionLevel)}
+}
+
+// options returns the writer options for a file of model's row type, with
+// bloom filters on defaultBloom unless BloomColumns overrides it. Settings
+// for columns the row type doesn't have are ignored.
+func (c WriterConfig) options(model reflect.Type, defaultBloom []string) []parquet.WriterOption {
+	columns := parquetColumns(model)
+	bloom := defaultBloom
+	if c.BloomColumns != nil {
+		bloom = c.BloomColumns
+	}
+	var filters []parquet.BloomFilterColumn
+	for _, col := range bloom {
+		if _, ok := columns[col]; ok {
+			filters = append(filters, parquet.SplitBlockFilter(uint(c.BloomBitsPerValue), col))
+		}
+	}
+
+	opts := []parquet.WriterOption{
+		parquet.Compression(c.codec()),
+		parquet.PageBufferSize(c.PageBufferSize),
+		parquet.DataPageStatistics(true),
+		parquet.CreatedBy("pricetool", ToolVersion, ""),
+		parquet.BloomFilters(filters...),
+	}
+	if len(c.Encodings) > 0 {
+		opts = append(opts, schemaWithEncodings(model, columns, c.Encodings))
+	}
+	return opts
+}
+
+// schemaWithEncodings returns model's schema with the encodings of some
+// columns replaced. (Encoding struct tags can't be used: parquet-go rejects
+// delta and split on the pointer fields of optional columns.)
+func schemaWithEncodings(model reflect.Type, columns map[string]parquetColumn, encodings map[string]string) *parquet.Schema {
+	base := parquet.SchemaOf(reflect.New(model).Interface())
+	fields := slices.Clone(base.Fields())
+	for i, f := range fields {
+		enc, ok := encodings[f.Name()]
+		if !ok || !columns[f.Name()].accepts(enc) {
+			continue
+		}
+		fields[i] = encodedField{Field: f, encoding: columns[f.Name()].encoding(enc)}
+	}
+	return parquet.NewSchema(base.Name(), fieldGroup{Node: base, fields: fields})
+}
+
+// encodedField overrides the encoding of a schema field.
+type encodedField struct {
+	parquet.Field
+	encoding encoding.Encoding
+}
+
+func (f encodedField) Encoding() encoding.Encoding { return f.encoding }
+
+// fieldGroup is a group node with replaced fields, kept in their original
+// order.
+type fieldGroup struct {
+	parquet.Node
+	fields []parquet.Field
+}
+
+func (g fieldGroup) Fields() []parquet.Field { return g.fields }
+
+// parquetColumn is a top-level column of a row type.
+type parquetColumn struct {
+	kind reflect.Kind // of the value, after pointer indirection
+}
+
+// accepts reports whether the column can be written with an encoding.
+func (c parquetColumn) accepts(enc string) bool {
+	switch enc {
+	case "plain", "dict":
+		return true
+	case "delta":
+		return c.kind == reflect.String || c.kind == reflect.Int64 || c.kind == reflect.Int32
+	case "split":
+		return c.kind == reflect.Float64 || c.kind == reflect.Float32
+	}
+	return false
+}
+
+// encoding returns the encoding named enc, which accepts must allow.
+func (c parquetColumn) encoding(enc string) encoding.Encoding {
+	switch enc {
+	case "dict":
+		return &parquet.RLEDictionary
+	case "delta":
+		if c.kind == reflect.String {
+			return &parquet.DeltaByteArray
+		}
+		return &parquet.DeltaBinaryPacked
+	case "split":
+		return &parquet.ByteStreamSplit
+	}
+	return &parquet.Plain
+}
+
+// parquetColumns returns the columns of a row struct by name, including
+// those of embedded structs, which parquet-go flattens.
+func parquetColumns(t reflect.Type) map[string]parquetColumn {
+	columns := make(map[string]parquetColumn)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			maps.Copy(columns, parquetColumns(f.Type))
+			continue
+		}
+		tag := f.Tag.Get("parquet")
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		kind := f.Type.Kind()
+		if kind == reflect.Pointer {
+			kind = f.Type.Elem().Kind()
+		}
+		columns[name] = parquetColumn{kind: kind}
+	}
+	return columns
+}
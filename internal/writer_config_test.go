@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// syntheticRows returns n rows shaped like a tall-format file: a few
+// thousand items, each priced for several payers.
+func syntheticRows(n int) []HospitalChargeRow {
+	rng := rand.New(rand.NewPCG(3, 4))
+	payers := []string{"Aetna", "Cigna", "Humana", "UnitedHealthcare", "Medicare Advantage"}
+	plans := []string{"PPO", "HMO", "EPO", "Choice Plus"}
+	methods := []string{"fee_schedule", "case_rate", "per_diem", "percent_of_total_billed_charges"}
+	rows := make([]HospitalChargeRow, n)
+	for i := range rows {
+		item := i / len(payers)
+		gross := float64(rng.IntN(500000)) / 100
+		negotiated := gross * (0.3 + 0.5*rng.Float64())
+		rows[i] = HospitalChargeRow{
+			Description: fmt.Sprintf("PROCEDURE %d", item),
+			Setting:     []string{"inpatient", "outpatient", "both"}[item%3],
+			CPTCode:     strPtr(fmt.Sprintf("%05d", 10000+item%90000)),
+			RCCode:      strPtr(fmt.Sprintf("%04d", 100+item%900)),
+			PayerName:   &payers[i%len(payers)],
+			PlanName:    &plans[rng.IntN(len(plans))],
+			GrossCharge: &gross,
+
+			NegotiatedDollar: &negotiated,
+			Methodology:      &methods[rng.IntN(len(methods))],
+		}
+	}
+	return rows
+}
+
+// benchRows returns the rows of $PRICETOOL_BENCH_INPUT (a CSV or JSON MRF)
+// when set, else synthetic rows.
+func benchRows(b *testing.B) []HospitalChargeRow {
+	input := os.Getenv("PRICETOOL_BENCH_INPUT")
+	if input == "" {
+		return syntheticRows(200000)
+	}
+	var reader chargeReader
+	var err error
+	if strings.EqualFold(filepath.Ext(input), ".json") {
+		var jr *JSONReader
+		jr, err = NewJSONReader(input)
+		if err == nil {
+			jr.SkipPayerCharges = false
+			reader = jr
+		}
+	} else {
+		var cr *CSVReader
+		cr, err = NewCSVReader(input)
+		if err == nil {
+			cr.SkipPayerCharges = false
+			reader = cr
+		}
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer reader.Close()
+	var rows []HospitalChargeRow
+	for {
+		batch, err := reader.Next()
+		rows = append(rows, batch...)
+		if errors.Is(err, io.EOF) {
+			return rows
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriterConfig compares write time and file size across writer
+// settings. Set PRICETOOL_BENCH_INPUT to measure a real MRF:
+//
+//	PRICETOOL_BENCH_INPUT=mrf.csv go test ./internal -run ^$ -bench WriterConfig
+func BenchmarkWriterConfig(b *testing.B) {
+	rows := benchRows(b)
+	noBloom := DefaultWriterConfig()
+	noBloom.BloomColumns = []string{}
+	bigGroups := DefaultWriterConfig()
+	bigGroups.RowsPerGroup = 500000
+	bigPages := DefaultWriterConfig()
+	bigPages.PageBufferSize = 1024 * 1024
+	delta := DefaultWriterConfig()
+	delta.Encodings = map[string]string{"description": "delta", "cpt_code": "delta", "gross_charge": "split", "negotiated_dollar": "split"}
+
+	configs := []struct {
+		name   string
+		config WriterConfig
+	}{
+		{"default", DefaultWriterConfig()},
+		{"zstd-1", WriterConfig{Compression: "zstd", CompressionLevel: 1}},
+		{"zstd-19", WriterConfig{Compression: "zstd", CompressionLevel: 19}},
+		{"snappy", WriterConfig{Compression: "snappy"}},
+		{"lz4", WriterConfig{Compression: "lz4"}},
+		{"gzip", WriterConfig{Compression: "gzip"}},
+		{"none", WriterConfig{Compression: "none"}},
+		{"no-bloom", noBloom},
+		{"500k-row-groups", bigGroups},
+		{"1mb-pages", bigPages},
+		{"delta-split", delta},
+	}
+	for _, c := range configs {
+		b.Run(c.name, func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "bench.parquet")
+			for b.Loop() {
+				w, err := NewChargeWriter(path, c.config)
+				if err != nil {
+					b.Fatal(err)
+				}
+				w.Write(slices.Clone(rows))
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(fileSize(path)), "file-bytes")
+			b.ReportMetric(float64(fileSize(path))/float64(len(rows)), "bytes/row")
+		})
+	}
+}
+
+// columnChunks returns the metadata of each column chunk in a file by
+// column name.
+func columnChunks(t *testing.T, path string) map[string][]format.ColumnMetaData {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	pf, err := parquet.OpenFile(f, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := make(map[string][]format.ColumnMetaData)
+	for _, rg := range pf.Metadata().RowGroups {
+		for _, col := range rg.Columns {
+			name := strings.Join(col.MetaData.PathInSchema, ".")
+			chunks[name] = append(chunks[name], col.MetaData)
+		}
+	}
+	return chunks
+}
+
+func TestWriterConfig(t *testing.T) {
+	rows := syntheticRows(1000)
+	write := func(t *testing.T, config WriterConfig) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "out.parquet")
+		w, err := NewChargeWriter(path, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(slices.Clone(rows))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(readParquet(t, path)); got != len(rows) {
+			t.Fatalf("read back %d rows, want %d", got, len(rows))
+		}
+		return path
+	}
+
+	for name, codec := range map[string]format.CompressionCodec{
+		"zstd":   format.Zstd,
+		"snappy": format.Snappy,
+		"lz4":    format.Lz4Raw,
+		"gzip":   format.Gzip,
+		"none":   format.Uncompressed,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := write(t, WriterConfig{Compression: name})
+			if got := columnChunks(t, path)["description"][0].Codec; got != codec {
+				t.Errorf("codec = %v, want %v", got, codec)
+			}
+		})
+	}
+
+	t.Run("row groups and bloom filters", func(t *testing.T) {
+		config := DefaultWriterConfig()
+		config.RowsPerGroup = 300
+		config.BloomColumns = []string{"rc_code"}
+		chunks := columnChunks(t, write(t, config))
+		if got := len(chunks["rc_code"]); got != 4 {
+			t.Errorf("got %d row groups, want 4", got)
+		}
+		if chunks["rc_code"][0].BloomFilterOffset == 0 {
+			t.Error("rc_code has no bloom filter")
+		}
+		if chunks["cpt_code"][0].BloomFilterOffset != 0 {
+			t.Error("cpt_code has a bloom filter, want only the configured columns")
+		}
+	})
+
+	t.Run("encodings", func(t *testing.T) {
+		config := DefaultWriterConfig()
+		config.Encodings = map[string]string{"description": "delta", "gross_charge": "split"}
+		chunks := columnChunks(t, write(t, config))
+		for col, want := range map[string]format.Encoding{
+			"description":  format.DeltaByteArray,
+			"gross_charge": format.ByteStreamSplit,
+		} {
+			if encs := chunks[col][0].Encoding; !slices.Contains(encs, want) {
+				t.Errorf("%s encodings = %v, want %v", col, encs, want)
+			}
+		}
+	})
+}
+
+func TestWriterConfigValidate(t *testing.T) {
+	if err := DefaultWriterConfig().Validate(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+	for name, config := range map[string]WriterConfig{
+		"unknown codec":   {Compression: "xz"},
+		"level too high":  {Compression: "gzip", CompressionLevel: 10},
+		"snappy level":    {Compression: "snappy", CompressionLevel: 1},
+		"unknown bloom":   {BloomColumns: []string{"nope"}},
+		"unknown column":  {Encodings: map[string]string{"nope": "plain"}},
+		"delta on float":  {Encodings: map[string]string{"gross_charge": "delta"}},
+		"split on string": {Encodings: map[string]string{"cpt_code": "split"}},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: Validate succeeded, want error", name)
+		}
+	}
+}
@@ -7,6 +7,11 @@ LOAD httpfs;
 SET s3_region = 'us-east-1';
 CREATE SECRET (TYPE S3, PROVIDER CREDENTIAL_CHAIN);
 
+-- Runs written with `batch --layout hive` don't need a file list:
+--   CREATE VIEW all_charges AS
+--   SELECT * FROM read_parquet('s3://hospital-mrf/<run>/state=*/*/*.parquet',
+--                              filename=true, hive_partitioning=true)
+--   WHERE state = 'NY';
 CREATE VIEW all_charges AS
 SELECT * FROM read_parquet([
   's3://hospital-mrf/111631788_Jamaica-Hospital_standardcharges.parquet',